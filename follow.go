@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+func postFollow(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postFollow ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionFollow) {
+		return
+	}
+
+	followeeId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+	if followeeId == userId {
+		respondWithError(w, 400, "can't follow yourself")
+		return
+	}
+
+	follow, err := db.Follow(userId, followeeId, time.Now().UTC())
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, follow)
+}
+
+func deleteFollow(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteFollow ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	followeeId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	err = db.Unfollow(userId, followeeId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
+
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getFollowers ---")
+	respondWithFollows(w, r, db.GetFollowers)
+}
+
+func getFollowing(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getFollowing ---")
+	respondWithFollows(w, r, db.GetFollowing)
+}
+
+// respondWithFollows writes the follows that list returns for the user in the path.
+func respondWithFollows(w http.ResponseWriter, r *http.Request, list func(userId int) ([]database.Follow, error)) {
+	userId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	_, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	follows, err := list(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if follows == nil {
+		follows = []database.Follow{}
+	}
+
+	respondWithJson(w, 200, follows)
+}
+
+// getTimeline lists the chirps of everyone the user follows, and their own,
+// newest first unless sort=asc. It pages like getChirps.
+func getTimeline(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getTimeline ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	query, err := chirpQueryFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		query.Desc = true
+	}
+
+	following, err := db.GetFollowing(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	query.AuthorIds = []int{userId}
+	for _, follow := range following {
+		query.AuthorIds = append(query.AuthorIds, follow.FolloweeId)
+	}
+
+	page, err := db.QueryChirps(query)
+	if errors.Is(err, database.ErrBadCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithPage(w, r, page)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+// maxTrendingWindow is the longest window GET /api/trending looks back over.
+const maxTrendingWindow = 7 * 24 * time.Hour
+
+// getHashtagChirps lists the chirps tagged with the tag in the path, newest
+// first unless sort=asc. It pages like getChirps.
+func getHashtagChirps(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getHashtagChirps ---")
+
+	query, err := chirpQueryFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if r.URL.Query().Get("sort") == "" {
+		query.Desc = true
+	}
+
+	query.Hashtag = database.NormalizeHashtag(r.PathValue("tag"))
+	if query.Hashtag == "" {
+		respondWithError(w, 404, "hashtag doesn't exist")
+		return
+	}
+
+	page, err := db.QueryChirps(query)
+	if errors.Is(err, database.ErrBadCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithPage(w, r, page)
+}
+
+// getTrending ranks the tags used over the last window (24h by default) with
+// recent uses counting for more. limit sets how many tags come back.
+func getTrending(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getTrending ---")
+
+	params := r.URL.Query()
+	opts := database.TrendingOptions{}
+	if window := params.Get("window"); window != "" {
+		value, err := time.ParseDuration(window)
+		if err != nil || value <= 0 || value > maxTrendingWindow {
+			respondWithError(w, 400, fmt.Sprintf("window must be a duration up to %s", maxTrendingWindow))
+			return
+		}
+		opts.Window = value
+	}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > 100 {
+			respondWithError(w, 400, "limit must be between 1 and 100")
+			return
+		}
+		opts.Limit = value
+	}
+
+	trending, err := database.Trending(db, time.Now().UTC(), opts)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, trending)
+}
@@ -2,33 +2,70 @@ package authorize
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/djmarkymark007/chirpy/internal/database"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func CreateJwt(id int, expiresRequest int, secret string) (string, error) {
+const (
+	issuer = "chirpy"
+	// mfaIssuer issues MFA challenges, so they can't pass for access tokens
+	mfaIssuer = "chirpy-mfa"
+)
+
+// ErrWrongTokenType is returned for a valid token that is for something else,
+// like an MFA challenge used as an access token.
+var ErrWrongTokenType = errors.New("token is for something else")
+
+// Claims are what a chirpy token says about the user it was issued to.
+type Claims struct {
+	jwt.RegisteredClaims
+	// Role is the role the user had when the token was issued, a change of
+	// role shows once the token is refreshed.
+	Role string `json:"role,omitempty"`
+}
+
+// Identity is the user a token was issued to.
+type Identity struct {
+	Id   int
+	Role string
+}
+
+// HasRole reports whether role is allowed to do what required is.
+func HasRole(role string, required string) bool {
+	have := slices.Index(database.Roles, role)
+	need := slices.Index(database.Roles, required)
+	if have < 0 {
+		have = 0
+	}
+	return need >= 0 && have >= need
+}
+
+// CreateJwt signs a token for the user with the signing key of keys. It
+// expires in an hour, or in expiresRequest seconds when that is sooner.
+func CreateJwt(id int, role string, expiresRequest int, keys *Keyring) (string, error) {
 	expires := 60 * 60
 	if expiresRequest < expires && expiresRequest != 0 {
 		expires = expiresRequest
 	}
 
-	claim := jwt.RegisteredClaims{Issuer: "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expires * int(time.Second)))),
-		Subject:   fmt.Sprint(id)}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-	jwtToken, err := token.SignedString([]byte(secret))
-	if err != nil {
-		return "", err
+	claim := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: issuer,
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expires * int(time.Second)))),
+			Subject:   fmt.Sprint(id)},
+		Role: role,
 	}
-	return jwtToken, nil
+
+	return keys.Sign(claim)
 }
 
 func CreateRefreshToken() (string, error) {
@@ -38,52 +75,150 @@ func CreateRefreshToken() (string, error) {
 	return refreshToken, err
 }
 
-func ValidateRefreshToken(token string, db *database.Database) (bool, database.UserDatabase, error) {
-	var currentUser = database.UserDatabase{}
+// CreateResetToken returns a new password reset token, random like a
+// refresh token.
+func CreateResetToken() (string, error) {
+	return CreateRefreshToken()
+}
+
+// recoveryAlphabet leaves out letters and digits that are easy to mix up.
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
 
-	users, err := db.GetUsers()
+// CreateRecoveryCode returns a new one time recovery code for logging in
+// without a second factor, like "7kq2m-x9dfp". Each of the ten characters is
+// picked uniformly, which gives about 50 bits.
+func CreateRecoveryCode() (string, error) {
+	var rnd [10]byte
+	_, err := rand.Read(rnd[:])
 	if err != nil {
-		return false, currentUser, err
+		return "", err
 	}
-
-	validToken := false
-
-	for _, user := range users {
-		if user.RefreshToken == token {
-			if user.TokenExpiresAt.After(time.Now().UTC()) {
-				validToken = true
-				currentUser = user
-			} else {
-				//NOTE(Mark): should this be logged?
-				log.Print("time miss match")
+	code := make([]byte, 0, 11)
+	for i, b := range rnd {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		// 256 isn't a multiple of the alphabet, redraw bytes that would favour
+		// its first letters
+		for int(b) >= 256/len(recoveryAlphabet)*len(recoveryAlphabet) {
+			var again [1]byte
+			_, err := rand.Read(again[:])
+			if err != nil {
+				return "", err
 			}
-			break
+			b = again[0]
 		}
+		code = append(code, recoveryAlphabet[int(b)%len(recoveryAlphabet)])
 	}
-	return validToken, currentUser, nil
+	return string(code), nil
 }
 
-func GetClaimFromJwt(token string, secret string) (*jwt.Token, error) {
-	claims, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method != jwt.SigningMethodHS256 {
-			// Not sure if this should be fatal or not
-			log.Fatalf("Token Method: %v want: %v", token.Method, jwt.SigningMethodHS256)
+// HashRecoveryCode returns what a recovery code is stored as. Case, spaces
+// and hyphens are ignored since the code is typed in by hand.
+func HashRecoveryCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
 		}
-		return []byte(secret), nil
-	})
-	return claims, err
+		return r
+	}, strings.ToLower(code))
+	return HashToken(code)
 }
 
-func GetIdFromJwt(token string, secret string) (int, error) {
-	claims, err := GetClaimFromJwt(token, secret)
+// HashToken returns what refresh and password reset tokens are stored as.
+// They are random, so a plain SHA-256 is enough to keep a leaked database
+// from handing out working tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetClaimFromJwt verifies token with keys and parses its claims. A token
+// signed with a key that isn't in keys or with another algorithm than its key
+// is an error.
+func GetClaimFromJwt(token string, keys *Keyring) (*jwt.Token, error) {
+	parsed, err := keys.Parse(token, &Claims{})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	// tokens from before there was an issuer have none, so only tokens
+	// for something else are refused
+	if parsed.Claims.(*Claims).Issuer == mfaIssuer {
+		return nil, ErrWrongTokenType
+	}
+	return parsed, nil
+}
 
-	idString, err := claims.Claims.GetSubject()
+func GetIdFromJwt(token string, keys *Keyring) (int, error) {
+	identity, err := GetIdentityFromJwt(token, keys)
 	if err != nil {
 		return 0, err
 	}
+	return identity.Id, nil
+}
+
+// GetIdentityFromJwt returns the user token was issued to. Tokens from before
+// roles were added to them have no role and are database.RoleUser.
+func GetIdentityFromJwt(token string, keys *Keyring) (Identity, error) {
+	parsed, err := GetClaimFromJwt(token, keys)
+	if err != nil {
+		return Identity{}, err
+	}
+	claims := parsed.Claims.(*Claims)
 
-	return strconv.Atoi(idString)
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Identity{}, err
+	}
+	role := claims.Role
+	if role == "" {
+		role = database.RoleUser
+	}
+	return Identity{Id: id, Role: role}, nil
+}
+
+// MFAChallenge is a login that got the password right and still has to give
+// a second factor. It carries what the login asked for so the session can be
+// started once the second factor is given.
+type MFAChallenge struct {
+	UserId           int
+	Device           string
+	ExpiresInSeconds int
+}
+
+type mfaClaims struct {
+	jwt.RegisteredClaims
+	Device           string `json:"device,omitempty"`
+	ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+}
+
+// CreateMFAChallenge signs a token for challenge that expires after
+// lifetime. It is only good for finishing the login, GetIdFromJwt refuses it.
+func CreateMFAChallenge(challenge MFAChallenge, lifetime time.Duration, keys *Keyring) (string, error) {
+	now := time.Now().UTC()
+	claims := mfaClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: mfaIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+			Subject:   fmt.Sprint(challenge.UserId)},
+		Device:           challenge.Device,
+		ExpiresInSeconds: challenge.ExpiresInSeconds,
+	}
+	return keys.Sign(claims)
+}
+
+// ParseMFAChallenge verifies a token from CreateMFAChallenge. Access tokens
+// are refused.
+func ParseMFAChallenge(token string, keys *Keyring) (MFAChallenge, error) {
+	parsed, err := keys.Parse(token, &mfaClaims{}, jwt.WithIssuer(mfaIssuer))
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	claims := parsed.Claims.(*mfaClaims)
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	return MFAChallenge{UserId: id, Device: claims.Device, ExpiresInSeconds: claims.ExpiresInSeconds}, nil
 }
@@ -0,0 +1,146 @@
+package authorize_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// hmacKeyring returns a keyring with only the HMAC secret in it.
+func hmacKeyring(t *testing.T, secret string) *authorize.Keyring {
+	t.Helper()
+	keys, err := authorize.NewKeyring(authorize.NewHMACKey(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestRoleClaim(t *testing.T) {
+	keys := hmacKeyring(t, "secret")
+	token, err := authorize.CreateJwt(7, database.RoleModerator, 0, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := authorize.GetIdentityFromJwt(token, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != (authorize.Identity{Id: 7, Role: database.RoleModerator}) {
+		t.Errorf("identity: got %+v", identity)
+	}
+
+	_, err = authorize.GetIdentityFromJwt(token, hmacKeyring(t, "other secret"))
+	if err == nil {
+		t.Error("wrong secret: want an error")
+	}
+
+	// tokens from before roles have none and are plain users
+	old, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "7",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err = authorize.GetIdentityFromJwt(old, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Role != database.RoleUser {
+		t.Errorf("role of old token: got %q", identity.Role)
+	}
+}
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role     string
+		required string
+		want     bool
+	}{
+		{database.RoleAdmin, database.RoleModerator, true},
+		{database.RoleModerator, database.RoleModerator, true},
+		{database.RoleUser, database.RoleModerator, false},
+		{database.RoleModerator, database.RoleAdmin, false},
+		{"", database.RoleUser, true},
+		{"", database.RoleModerator, false},
+		{database.RoleAdmin, "owner", false},
+	}
+	for _, test := range tests {
+		if got := authorize.HasRole(test.role, test.required); got != test.want {
+			t.Errorf("HasRole(%q, %q) = %v, want %v", test.role, test.required, got, test.want)
+		}
+	}
+}
+
+func TestMFAChallenge(t *testing.T) {
+	keys := hmacKeyring(t, "secret")
+	challenge := authorize.MFAChallenge{UserId: 7, Device: "phone", ExpiresInSeconds: 60}
+	token, err := authorize.CreateMFAChallenge(challenge, 5*time.Minute, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := authorize.ParseMFAChallenge(token, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != challenge {
+		t.Errorf("challenge: got %+v, want %+v", got, challenge)
+	}
+
+	// neither token passes for the other
+	_, err = authorize.GetIdFromJwt(token, keys)
+	if !errors.Is(err, authorize.ErrWrongTokenType) {
+		t.Errorf("challenge as access token: got %v, want ErrWrongTokenType", err)
+	}
+	access, err := authorize.CreateJwt(7, database.RoleUser, 0, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.ParseMFAChallenge(access, keys)
+	if err == nil {
+		t.Error("access token as challenge: want an error")
+	}
+
+	expired, err := authorize.CreateMFAChallenge(challenge, -time.Minute, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.ParseMFAChallenge(expired, keys)
+	if !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("expired challenge: got %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 50 {
+		code, err := authorize.CreateRecoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != 11 || code[5] != '-' || strings.ContainsAny(code, "01ilo") {
+			t.Errorf("code %q: want 5 characters, a hyphen and 5 more, none easy to mix up", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q came up twice", code)
+		}
+		seen[code] = true
+	}
+
+	hash := authorize.HashRecoveryCode("7kq2m-x9dfp")
+	for _, typed := range []string{"7KQ2M-X9DFP", "7kq2mx9dfp", "7kq2m x9dfp"} {
+		if authorize.HashRecoveryCode(typed) != hash {
+			t.Errorf("code typed as %q hashes differently", typed)
+		}
+	}
+	if authorize.HashRecoveryCode("7kq2m-x9dfq") == hash {
+		t.Error("different codes hash the same")
+	}
+}
@@ -0,0 +1,230 @@
+package authorize
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA key tokens are signed or verified with.
+const minRSABits = 2048
+
+var (
+	// ErrUnknownKey is returned for a token whose kid isn't in the keyring.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrUnexpectedAlgorithm is returned for a token signed with a different
+	// algorithm than the key its kid names, like an HS256 token naming an
+	// RSA key.
+	ErrUnexpectedAlgorithm = errors.New("unexpected signing algorithm")
+)
+
+// Key is a key tokens are signed or verified with.
+type Key struct {
+	// Id is the kid of the tokens signed with the key. For RSA and Ed25519
+	// keys it is the RFC 7638 thumbprint of the public key, for an HMAC
+	// secret it is "" so its tokens have no kid, like they did before there
+	// were other keys.
+	Id     string
+	Method jwt.SigningMethod
+	// private signs tokens, nil when only the public half of the key is known
+	private any
+	public  any
+}
+
+// NewHMACKey returns the key for an HS256 shared secret.
+func NewHMACKey(secret string) Key {
+	return Key{Method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+}
+
+// ParseKey reads an RSA or Ed25519 key out of PEM data. RSA keys are used
+// with RS256 and Ed25519 keys with EdDSA. A public key only verifies tokens.
+func ParseKey(data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM data found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	var key Key
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key = Key{Method: jwt.SigningMethodRS256, private: k, public: &k.PublicKey}
+	case *rsa.PublicKey:
+		key = Key{Method: jwt.SigningMethodRS256, public: k}
+	case ed25519.PrivateKey:
+		key = Key{Method: jwt.SigningMethodEdDSA, private: k, public: k.Public()}
+	case ed25519.PublicKey:
+		key = Key{Method: jwt.SigningMethodEdDSA, public: k}
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T, want RSA or Ed25519", parsed)
+	}
+	if public, ok := key.public.(*rsa.PublicKey); ok && public.N.BitLen() < minRSABits {
+		return Key{}, fmt.Errorf("RSA key has %d bits, want at least %d", public.N.BitLen(), minRSABits)
+	}
+	key.Id = key.JWK().thumbprint()
+	return key, nil
+}
+
+// LoadKey reads an RSA or Ed25519 key out of the PEM file at path.
+func LoadKey(path string) (Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// CanSign reports whether the private half of the key is known.
+func (key Key) CanSign() bool {
+	return key.private != nil
+}
+
+// JWK is a public key as it is published in a JWKSet.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// N and E are the modulus and exponent of an RSA key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv and X are the curve and public key of an Ed25519 key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is the JSON Web Key Set other services verify tokens with.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key, the zero JWK for an HMAC secret,
+// which can't be published.
+func (key Key) JWK() JWK {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: key.Id,
+			Use: "sig",
+			Alg: key.Method.Alg(),
+			N:   encode(public.N.Bytes()),
+			E:   encode(big.NewInt(int64(public.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Kid: key.Id, Use: "sig", Alg: key.Method.Alg(), Crv: "Ed25519", X: encode(public)}
+	default:
+		return JWK{}
+	}
+}
+
+// thumbprint is the RFC 7638 thumbprint of the key, the SHA-256 of its
+// required members in lexicographic order.
+func (jwk JWK) thumbprint() string {
+	var canonical string
+	switch jwk.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Keyring holds the key new tokens are signed with and every key tokens are
+// still verified with. Keeping the old keys in it after a rotation lets the
+// tokens they signed validate until they expire.
+type Keyring struct {
+	signing Key
+	keys    []Key
+	byId    map[string]Key
+}
+
+// NewKeyring returns a keyring that signs with signing and verifies with it
+// and others.
+func NewKeyring(signing Key, others ...Key) (*Keyring, error) {
+	if !signing.CanSign() {
+		return nil, fmt.Errorf("key %q can't sign tokens, only the public half of it is known", signing.Id)
+	}
+
+	keys := &Keyring{signing: signing, byId: make(map[string]Key)}
+	for _, key := range append([]Key{signing}, others...) {
+		if _, found := keys.byId[key.Id]; found {
+			continue
+		}
+		keys.byId[key.Id] = key
+		keys.keys = append(keys.keys, key)
+	}
+	return keys, nil
+}
+
+// Sign signs claims with the signing key.
+func (keys *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(keys.signing.Method, claims)
+	if keys.signing.Id != "" {
+		token.Header["kid"] = keys.signing.Id
+	}
+	return token.SignedString(keys.signing.private)
+}
+
+// Parse verifies token with the key its kid names and parses its claims
+// into claims. The token has to be signed with the algorithm of that key.
+func (keys *Keyring) Parse(token string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(token, claims, keys.verifyingKey, options...)
+}
+
+func (keys *Keyring) verifyingKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, found := keys.byId[kid]
+	if !found {
+		return nil, fmt.Errorf("kid %q: %w", kid, ErrUnknownKey)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("token is %s, key %q is %s: %w", token.Method.Alg(), kid, key.Method.Alg(), ErrUnexpectedAlgorithm)
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public keys of the keyring, the signing key first. HMAC
+// secrets are left out.
+func (keys *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range keys.keys {
+		if jwk := key.JWK(); jwk.Kty != "" {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
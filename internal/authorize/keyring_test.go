@@ -0,0 +1,259 @@
+package authorize_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func encodePEM(t *testing.T, blockType string, der []byte, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func parseKey(t *testing.T, data []byte) authorize.Key {
+	t.Helper()
+	key, err := authorize.ParseKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestParseKey(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	rsaPrivate := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+	rsaPKCS1 := parseKey(t, encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil))
+	pkix, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	rsaPublic := parseKey(t, encodePEM(t, "PUBLIC KEY", pkix, err))
+
+	if rsaPrivate.Method != jwt.SigningMethodRS256 || !rsaPrivate.CanSign() || !rsaPKCS1.CanSign() {
+		t.Errorf("RSA private key: got %s, can sign %v", rsaPrivate.Method.Alg(), rsaPrivate.CanSign())
+	}
+	if rsaPublic.CanSign() {
+		t.Error("RSA public key can sign")
+	}
+	if rsaPrivate.Id == "" || rsaPrivate.Id != rsaPKCS1.Id || rsaPrivate.Id != rsaPublic.Id {
+		t.Errorf("kids of the same RSA key: %q, %q and %q", rsaPrivate.Id, rsaPKCS1.Id, rsaPublic.Id)
+	}
+
+	edKey := newEd25519Key(t)
+	pkcs8, err = x509.MarshalPKCS8PrivateKey(edKey)
+	edPrivate := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+	pkix, err = x509.MarshalPKIXPublicKey(edKey.Public())
+	edPublic := parseKey(t, encodePEM(t, "PUBLIC KEY", pkix, err))
+	if edPrivate.Method != jwt.SigningMethodEdDSA || !edPrivate.CanSign() || edPublic.CanSign() {
+		t.Errorf("Ed25519 key: got %s, can sign %v, public can sign %v", edPrivate.Method.Alg(), edPrivate.CanSign(), edPublic.CanSign())
+	}
+	if edPrivate.Id == "" || edPrivate.Id != edPublic.Id || edPrivate.Id == rsaPrivate.Id {
+		t.Errorf("kids of the Ed25519 key: %q and %q", edPrivate.Id, edPublic.Id)
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.ParseKey(encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(small), nil))
+	if err == nil {
+		t.Error("1024 bit RSA key: want an error")
+	}
+	_, err = authorize.ParseKey([]byte("not a key"))
+	if err == nil {
+		t.Error("not PEM: want an error")
+	}
+}
+
+// TestKeyId checks the kid against the thumbprint worked out in RFC 7638.
+func TestKeyId(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	key := parseKey(t, encodePEM(t, "PUBLIC KEY", pkix, err))
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; key.Id != want {
+		t.Errorf("kid: got %q, want %q", key.Id, want)
+	}
+	if jwk := key.JWK(); jwk.E != "AQAB" || jwk.Kty != "RSA" || jwk.Alg != "RS256" {
+		t.Errorf("JWK: got %+v", jwk)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	edKey := newEd25519Key(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	oldKey := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+	pkix, err := x509.MarshalPKIXPublicKey(edKey.Public())
+	oldPublic := parseKey(t, encodePEM(t, "PUBLIC KEY", pkix, err))
+	pkcs8, err = x509.MarshalPKCS8PrivateKey(newRSAKey(t))
+	newKey := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+
+	_, err = authorize.NewKeyring(oldPublic)
+	if err == nil {
+		t.Error("signing with a public key: want an error")
+	}
+
+	before, err := authorize.NewKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := authorize.CreateJwt(3, database.RoleUser, 0, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := authorize.NewKeyring(newKey, oldPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := authorize.CreateJwt(4, database.RoleUser, 0, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		token string
+		kid   string
+		alg   string
+		id    int
+	}{
+		{oldToken, oldKey.Id, "EdDSA", 3},
+		{newToken, newKey.Id, "RS256", 4},
+	} {
+		parsed, err := authorize.GetClaimFromJwt(test.token, after)
+		if err != nil {
+			t.Errorf("token %d after rotation: %s", test.id, err)
+			continue
+		}
+		if parsed.Header["kid"] != test.kid || parsed.Method.Alg() != test.alg {
+			t.Errorf("token %d header: got %v", test.id, parsed.Header)
+		}
+		id, err := authorize.GetIdFromJwt(test.token, after)
+		if err != nil || id != test.id {
+			t.Errorf("token %d: got id %d, %v", test.id, id, err)
+		}
+	}
+
+	// once the old key is dropped its tokens stop validating
+	dropped, err := authorize.NewKeyring(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.GetIdFromJwt(oldToken, dropped)
+	if !errors.Is(err, authorize.ErrUnknownKey) {
+		t.Errorf("token of a dropped key: got %v, want %v", err, authorize.ErrUnknownKey)
+	}
+}
+
+func TestUnexpectedAlgorithm(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	key := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+	keys, err := authorize.NewKeyring(key, authorize.NewHMACKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.RegisteredClaims{Subject: "1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+
+	// an HS256 token keyed with the published RSA public key, naming that key
+	pkix, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	public := encodePEM(t, "PUBLIC KEY", pkix, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = key.Id
+	token, err := forged.SignedString(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.GetIdFromJwt(token, keys)
+	if !errors.Is(err, authorize.ErrUnexpectedAlgorithm) {
+		t.Errorf("HS256 token naming an RSA key: got %v, want %v", err, authorize.ErrUnexpectedAlgorithm)
+	}
+
+	// an unsigned token naming the HMAC secret
+	token, err = jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorize.GetIdFromJwt(token, keys)
+	if !errors.Is(err, authorize.ErrUnexpectedAlgorithm) {
+		t.Errorf("unsigned token: got %v, want %v", err, authorize.ErrUnexpectedAlgorithm)
+	}
+
+	// the HMAC secret only verifies, new tokens are signed with the RSA key
+	token, err = authorize.CreateJwt(1, database.RoleUser, 0, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := authorize.GetClaimFromJwt(token, keys)
+	if err != nil || parsed.Method.Alg() != "RS256" {
+		t.Errorf("new token: got %v, %v", parsed, err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	signing := parseKey(t, encodePEM(t, "PRIVATE KEY", pkcs8, err))
+	pkix, err := x509.MarshalPKIXPublicKey(newEd25519Key(t).Public())
+	old := parseKey(t, encodePEM(t, "PUBLIC KEY", pkix, err))
+
+	keys, err := authorize.NewKeyring(signing, old, authorize.NewHMACKey("secret"), old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS: got %+v, want the RSA and Ed25519 keys", set)
+	}
+	if set.Keys[0].Kid != signing.Id || set.Keys[0].Kty != "RSA" || set.Keys[0].Use != "sig" {
+		t.Errorf("first key: got %+v", set.Keys[0])
+	}
+	n, err := base64.RawURLEncoding.DecodeString(set.Keys[0].N)
+	if err != nil || new(big.Int).SetBytes(n).Cmp(rsaKey.N) != 0 {
+		t.Errorf("RSA modulus: got %q", set.Keys[0].N)
+	}
+	if set.Keys[1].Kid != old.Id || set.Keys[1].Kty != "OKP" || set.Keys[1].Crv != "Ed25519" || set.Keys[1].Alg != "EdDSA" {
+		t.Errorf("second key: got %+v", set.Keys[1])
+	}
+
+	keys, err = authorize.NewKeyring(authorize.NewHMACKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set := keys.JWKS(); set.Keys == nil || len(set.Keys) != 0 {
+		t.Errorf("JWKS of an HMAC secret: got %+v, want no keys", set)
+	}
+}
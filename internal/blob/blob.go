@@ -0,0 +1,39 @@
+// Package blob stores uploaded files, like avatars and chirp attachments,
+// outside of the database.
+package blob
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound = errors.New("blob: not found")
+	// ErrBadKey is returned for a key that isn't a clean relative path.
+	ErrBadKey = errors.New("blob: bad key")
+)
+
+// Store holds blobs by key. Keys are slash separated relative paths like
+// "avatars/0f3a.png" and are never reused, so a blob doesn't change once it
+// is put.
+type Store interface {
+	Put(key string, r io.Reader) error
+	Open(key string) (io.ReadCloser, error)
+	// Delete removes the blob with key, deleting a blob that doesn't exist
+	// is not an error.
+	Delete(key string) error
+	// URL is where clients can fetch the blob from.
+	URL(key string) string
+}
+
+// NewKey returns a new random key in dir with the extension ext, like ".png".
+func NewKey(dir string, ext string) (string, error) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return dir + "/" + hex.EncodeToString(data) + ext, nil
+}
@@ -0,0 +1,113 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS is a Store that keeps each blob as a file under a directory.
+type FS struct {
+	dir       string
+	urlPrefix string
+}
+
+var _ Store = (*FS)(nil)
+
+// NewFS returns a Store keeping blobs under dir, creating dir if needed. The
+// blobs are served by the application under urlPrefix, so URL is urlPrefix
+// followed by the key.
+func NewFS(dir string, urlPrefix string) (*FS, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{dir: dir, urlPrefix: urlPrefix}, nil
+}
+
+// path returns the file that holds key, keys that could reach outside of
+// the directory are refused.
+func (fs *FS) path(key string) (string, error) {
+	if !iofs.ValidPath(key) || key == "." {
+		return "", ErrBadKey
+	}
+	return filepath.Join(fs.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file first and renames it into place so
+// a blob is never seen half written.
+func (fs *FS) Put(key string, r io.Reader) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (fs *FS) Open(key string) (io.ReadCloser, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a key can name a directory of blobs, which isn't a blob itself
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = ErrNotFound
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *FS) Delete(key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (fs *FS) URL(key string) string {
+	return fs.urlPrefix + key
+}
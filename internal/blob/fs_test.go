@@ -0,0 +1,69 @@
+package blob_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/djmarkymark007/chirpy/internal/blob"
+)
+
+func TestFS(t *testing.T) {
+	store, err := blob.NewFS(t.TempDir(), "/media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := blob.NewKey("avatars", ".png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "avatars/") || !strings.HasSuffix(key, ".png") {
+		t.Errorf("key: got %s", key)
+	}
+
+	err = store.Put(key, strings.NewReader("image data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := store.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "image data" {
+		t.Errorf("data: got %q", data)
+	}
+	if got := store.URL(key); got != "/media/"+key {
+		t.Errorf("url: got %s", got)
+	}
+
+	err = store.Delete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete(key)
+	if err != nil {
+		t.Errorf("deleting twice: %s", err)
+	}
+	_, err = store.Open(key)
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("open after delete: got %v, want ErrNotFound", err)
+	}
+	_, err = store.Open("avatars")
+	if !errors.Is(err, blob.ErrNotFound) {
+		t.Errorf("open a directory: got %v, want ErrNotFound", err)
+	}
+
+	for _, bad := range []string{"", ".", "../secret", "/etc/passwd", "a/../../b", "a//b"} {
+		err = store.Put(bad, strings.NewReader("x"))
+		if !errors.Is(err, blob.ErrBadKey) {
+			t.Errorf("Put(%q): got %v, want ErrBadKey", bad, err)
+		}
+	}
+}
@@ -5,39 +5,210 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorId  int       `json:"author_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// InReplyTo is the id of the chirp this one replies to, 0 if it isn't a reply.
+	InReplyTo  int `json:"in_reply_to,omitempty"`
+	ReplyCount int `json:"reply_count"`
+	// Deleted marks a tombstone, a deleted chirp that is kept, without its
+	// body, because other chirps reply to it.
+	Deleted bool `json:"deleted,omitempty"`
+	// RechirpOf is the id of the chirp this one reposts, a rechirp has no body
+	// of its own and AuthorId is who rechirped it.
+	RechirpOf    int `json:"rechirp_of,omitempty"`
+	LikeCount    int `json:"like_count"`
+	RechirpCount int `json:"rechirp_count"`
+	// Hashtags are the #tags in Body, they are parsed out whenever Body is set.
+	Hashtags []Hashtag `json:"hashtags,omitempty"`
+	// Mentions are the users @mentioned in Body, resolved whenever Body is set.
+	Mentions []Mention `json:"mentions,omitempty"`
+	// Attachments are the images posted with the chirp.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// NeedsReview marks a chirp the profanity filter flagged for a moderator.
+	NeedsReview bool `json:"needs_review,omitempty"`
+	// Hidden marks a chirp a moderator hid. It is left out everywhere chirps
+	// are listed and shows as a tombstone in its thread.
+	Hidden bool `json:"hidden,omitempty"`
+	// AuthorHandle is the handle of the author, it is filled in on the way out
+	// to a client and never stored since handles can change.
+	AuthorHandle string `json:"author_handle,omitempty"`
+}
+
+// ChirpRevision is a body a chirp had before it was edited.
+type ChirpRevision struct {
+	Id      int    `json:"id"`
+	ChirpId int    `json:"chirp_id"`
+	Body    string `json:"body"`
+	// CreatedAt is when the chirp got this body, ReplacedAt is when an edit replaced it.
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+func revisionOf(chirp Chirp, replacedAt time.Time) ChirpRevision {
+	return ChirpRevision{ChirpId: chirp.Id, Body: chirp.Body, CreatedAt: chirp.UpdatedAt, ReplacedAt: replacedAt}
 }
 
 type User struct {
 	Email       string `json:"email"`
 	Id          int    `json:"id"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarUrl   string `json:"avatar_url"`
+	Role        string `json:"role"`
+	// EmailVerified is whether the user showed they can read mail sent to Email.
+	EmailVerified bool `json:"email_verified"`
+	// PendingEmail is the email the user is changing to, it only replaces
+	// Email once it is verified.
+	PendingEmail string `json:"pending_email,omitempty"`
+	// TOTPEnabled is whether logging in takes a code from an authenticator.
+	TOTPEnabled bool `json:"totp_enabled"`
 }
 
 type UserDatabase struct {
-	Email          string    `json:"email"`
-	Id             int       `json:"id"`
-	IsChirpyRed    bool      `json:"is_chirpy_red"`
-	PasswordHash   []byte    `json:"password_hash"`
-	RefreshToken   string    `json:"refresh_token"`
-	TokenExpiresAt time.Time `json:"token_expires_at"`
+	Email        string `json:"email"`
+	Id           int    `json:"id"`
+	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	PasswordHash []byte `json:"password_hash"`
+	// Handle is the public name of the user, unique ignoring case. Users from
+	// before handles existed have none until they pick one.
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarUrl   string `json:"avatar_url"`
+	// Suspended users were suspended by a moderator and can't log in.
+	Suspended bool `json:"suspended"`
+	// Role is what the user is allowed to do, see RoleOf.
+	Role string `json:"role"`
+	// EmailVerified is whether the user showed they can read mail sent to
+	// Email, PendingEmail is the email they are changing to until they show
+	// the same for it.
+	EmailVerified bool   `json:"email_verified"`
+	PendingEmail  string `json:"pending_email"`
+	// TOTPSecret is the secret of the authenticator of the user. It is kept
+	// as it is since codes are checked against it. Logging in only takes a
+	// code once TOTPEnabled, after the user confirmed they enrolled it.
+	TOTPSecret  string `json:"totp_secret"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// TOTPLastStep is the time step of the last code used, see UseTOTPStep.
+	TOTPLastStep int64 `json:"totp_last_step"`
 }
 
 type Database struct {
-	path string
-	mu   *sync.RWMutex
+	path         string
+	mu           *sync.RWMutex
+	journal      bool
+	journalPath  string
+	compactEvery int
+	journalLen   int
+
+	// data is the whole database held in memory, the file is only read in NewDB.
+	data  DBStructure
+	index *indexes
+}
+
+// Options changes how a Database stores its data.
+type Options struct {
+	// Journal appends each change to an operation journal next to the database
+	// file instead of rewriting the whole file every time.
+	Journal bool
+	// CompactEvery is how many journal entries are written before they are
+	// folded into a new snapshot. Defaults to 1000.
+	CompactEvery int
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp        `json:"chirps"`
-	Users  map[int]UserDatabase `json:"users"`
+	Chirps        map[int]Chirp         `json:"chirps"`
+	Users         map[int]UserDatabase  `json:"users"`
+	Revisions     map[int]ChirpRevision `json:"revisions"`
+	Follows       map[int]Follow        `json:"follows"`
+	Likes         map[int]Like          `json:"likes"`
+	Notifications map[int]Notification  `json:"notifications"`
+	Media         map[int]Media         `json:"media"`
+	Reports       map[int]Report        `json:"reports"`
+	// Moderation is the audit log of moderation actions.
+	Moderation    map[int]ModerationAction `json:"moderation"`
+	Sessions      map[int]Session          `json:"sessions"`
+	RotatedTokens map[int]RotatedToken     `json:"rotated_tokens"`
+	// PasswordResets are the outstanding password reset tokens.
+	PasswordResets     map[int]PasswordReset     `json:"password_resets"`
+	EmailVerifications map[int]EmailVerification `json:"email_verifications"`
+	RecoveryCodes      map[int]RecoveryCode      `json:"recovery_codes"`
+	// Sequences holds the last id handed out for each table. Ids only ever go
+	// up so a deleted chirp's id is never reused.
+	Sequences map[string]int `json:"sequences"`
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		Chirps:             make(map[int]Chirp),
+		Users:              make(map[int]UserDatabase),
+		Revisions:          make(map[int]ChirpRevision),
+		Follows:            make(map[int]Follow),
+		Likes:              make(map[int]Like),
+		Notifications:      make(map[int]Notification),
+		Media:              make(map[int]Media),
+		Reports:            make(map[int]Report),
+		Moderation:         make(map[int]ModerationAction),
+		Sessions:           make(map[int]Session),
+		RotatedTokens:      make(map[int]RotatedToken),
+		PasswordResets:     make(map[int]PasswordReset),
+		EmailVerifications: make(map[int]EmailVerification),
+		RecoveryCodes:      make(map[int]RecoveryCode),
+		Sequences:          make(map[string]int),
+	}
+}
+
+// nextId allocates a new id for table.
+func (dbs *DBStructure) nextId(table string) int {
+	dbs.Sequences[table]++
+	return dbs.Sequences[table]
+}
+
+// repair fixes up files written before the maps were keyed by id, when keys and
+// ids could disagree and deletes shuffled chirps around. Every row ends up
+// under its own id, rows that share an id get a new one, and the sequences are
+// moved past the biggest id. Chirps from before hashtags were parsed get
+// theirs. It reports whether anything changed.
+func (dbs *DBStructure) repair() bool {
+	changed := false
+	for _, t := range tables {
+		if t.rekey(dbs) {
+			changed = true
+		}
+	}
+	if dbs.backfillHashtags() {
+		changed = true
+	}
+	return changed
+}
+
+// backfillHashtags parses the hashtags of chirps that have none stored. Those
+// are chirps without any or from before hashtags were parsed, telling them
+// apart would take parsing anyway.
+func (dbs *DBStructure) backfillHashtags() bool {
+	changed := false
+	for id, chirp := range dbs.Chirps {
+		if chirp.Hashtags != nil || chirp.Deleted {
+			continue
+		}
+		chirp.Hashtags = ParseHashtags(chirp.Body)
+		if chirp.Hashtags != nil {
+			dbs.Chirps[id] = chirp
+			changed = true
+		}
+	}
+	return changed
 }
 
 // NOTE(Mark): not sure if this is need
@@ -46,15 +217,83 @@ func (dbs *DBStructure) len() int {
 }
 
 func NewDB(path string) (*Database, error) {
-	db := Database{path: path, mu: &sync.RWMutex{}}
+	return NewDBWithOptions(path, Options{})
+}
+
+func NewDBWithOptions(path string, opts Options) (*Database, error) {
+	db := Database{
+		path:         path,
+		mu:           &sync.RWMutex{},
+		journal:      opts.Journal,
+		journalPath:  path + ".journal",
+		compactEvery: opts.CompactEvery,
+	}
+	if db.compactEvery <= 0 {
+		db.compactEvery = defaultCompactEvery
+	}
+
 	err := db.ensureDB()
 	if err != nil {
 		return &Database{}, err
 	}
 
+	// replay whatever the journal holds from the last run into a fresh snapshot,
+	// fixing up files from before ids were stable on the way. This also runs
+	// with the journal turned off so a left over journal is never lost.
+	data, err := db.loadDB()
+	if err != nil {
+		return &Database{}, err
+	}
+
+	db.data = data
+	repaired := db.data.repair()
+	db.index = newIndexes(&db.data)
+
+	if repaired {
+		err = db.writeSnapshot()
+		if err != nil {
+			return &Database{}, err
+		}
+	}
+	err = db.compact()
+	if err != nil {
+		return &Database{}, err
+	}
+
 	return &db, nil
 }
 
+// Compact folds the journal into the snapshot and empties the journal.
+func (db *Database) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.compact()
+}
+
+func (db *Database) compact() error {
+	_, err := os.Stat(db.journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	err = db.writeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(db.journalPath)
+	if err != nil {
+		return err
+	}
+	db.journalLen = 0
+	return syncDir(filepath.Dir(db.journalPath))
+}
+
+// Close is a no-op, the json file is only held open while reading or writing.
+func (db *Database) Close() error {
+	return nil
+}
+
 func (db *Database) ensureDB() error {
 	f, err := os.Open(db.path)
 	if err != nil {
@@ -74,13 +313,11 @@ func (db *Database) ensureDB() error {
 }
 
 func (db *Database) CreateChirp(chirp Chirp) (Chirp, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-	chirp.Id = len(data.Chirps) + 1
-	data.Chirps[len(data.Chirps)] = chirp
-	err = db.writeDB(data)
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.CreateChirp(chirp)
+		return err
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -89,153 +326,152 @@ func (db *Database) CreateChirp(chirp Chirp) (Chirp, error) {
 }
 
 func (db *Database) UpdateUser(userChange UserDatabase) error {
-	data, err := db.loadDB()
-	if err != nil {
-		return err
-	}
+	return db.Update(func(tx *Tx) error {
+		return tx.UpdateUser(userChange)
+	})
+}
 
-	data.Users[userChange.Id-1] = userChange
+func (db *Database) DeleteChirp(chripId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DeleteChirp(chripId)
+	})
+}
 
-	err = db.writeDB(data)
-	if err != nil {
+func (db *Database) EditChirp(chirpId int, body string, editedAt time.Time) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.EditChirp(chirpId, body, editedAt)
 		return err
-	}
-	return nil
+	})
+	return chirp, err
 }
 
-func (db *Database) DeleteChirp(chripId int) error {
-	data, err := db.loadDB()
-	if err != nil {
+func (db *Database) SetNeedsReview(chirpId int, needsReview bool) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = tx.SetNeedsReview(chirpId, needsReview)
 		return err
-	}
-
-	delete(data.Chirps, chripId-1)
-
-	for index, chirp := range data.Chirps {
-		if chirp.Id < chripId {
-			chripId--
-			data.Chirps[index] = chirp
-		}
-	}
+	})
+	return chirp, err
+}
 
-	err = db.writeDB(data)
-	if err != nil {
-		return err
-	}
+func (db *Database) GetChirpHistory(chirpId int) ([]ChirpRevision, error) {
+	var result []ChirpRevision
+	err := db.View(func(tx *Tx) error {
+		result = tx.ChirpHistory(chirpId)
+		return nil
+	})
+	return result, err
+}
 
-	return nil
+func (db *Database) GetDescendants(chirpId int) ([]Chirp, error) {
+	var result []Chirp
+	err := db.View(func(tx *Tx) error {
+		result = tx.Descendants(chirpId)
+		return nil
+	})
+	return result, err
 }
 
 func (db *Database) GetChirpById(id int) (Chirp, error) {
-	foundChirp := Chirp{}
-	chirps, err := db.GetChirps()
-	if err != nil {
-		return foundChirp, err
-	}
-
-	for _, chirp := range chirps {
-		if chirp.Id == id {
-			foundChirp = chirp
-			break
-		}
-	}
-
-	return foundChirp, nil
+	var chirp Chirp
+	err := db.View(func(tx *Tx) error {
+		chirp, _ = tx.Chirp(id)
+		return nil
+	})
+	return chirp, err
 }
 
 func (db *Database) CreateUser(email string, passwordHash []byte) (User, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+	return db.CreateUserWithProfile(UserDatabase{Email: email, PasswordHash: passwordHash})
+}
 
-	newUser := UserDatabase{Id: len(data.Users) + 1, Email: email, PasswordHash: passwordHash, IsChirpyRed: false}
-	data.Users[len(data.Users)] = newUser
-	err = db.writeDB(data)
+func (db *Database) CreateUserWithProfile(user UserDatabase) (User, error) {
+	newUser := UserDatabase{
+		Email:        user.Email,
+		PasswordHash: user.PasswordHash,
+		Role:         RoleUser,
+		Handle:       user.Handle,
+		DisplayName:  user.DisplayName,
+		Bio:          user.Bio,
+		AvatarUrl:    user.AvatarUrl,
+	}
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		newUser, err = tx.CreateUser(newUser)
+		return err
+	})
 	if err != nil {
 		return User{}, err
 	}
 
 	//NOTE(Mark): i don' t like having to struct on for the database and on for the return
-	return User{Id: newUser.Id, Email: newUser.Email}, nil
+	return newUser.Account(), nil
 }
 
 func (db *Database) UserExist(email string) (bool, error) {
-	user, err := db.GetUser(email)
-	if err != nil {
-		return false, err
-	}
-
-	if user.Email != email {
-		return false, nil
-	}
-
-	return true, nil
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		_, found = tx.UserByEmail(email)
+		return nil
+	})
+	return found, err
 }
 
 func (db *Database) GetUser(email string) (UserDatabase, error) {
-	users, err := db.GetUsers()
-	if err != nil {
-		return UserDatabase{}, fmt.Errorf("failed to get users to check if a user exist. %s", err)
-	}
-
-	for _, value := range users {
-		if email == value.Email {
-			return value, nil
-		}
-	}
-
-	return UserDatabase{}, nil
+	var user UserDatabase
+	err := db.View(func(tx *Tx) error {
+		user, _ = tx.UserByEmail(email)
+		return nil
+	})
+	return user, err
 }
 
 func (db *Database) GetUserById(id int) (UserDatabase, bool, error) {
-	users, err := db.GetUsers()
-	if err != nil {
-		return UserDatabase{}, false, fmt.Errorf("failed to get users to check if a user exist. %s", err)
-	}
-
-	for _, value := range users {
-		if id == value.Id {
-			return value, true, nil
-		}
-	}
-
-	return UserDatabase{}, false, nil
+	var user UserDatabase
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		user, found = tx.User(id)
+		return nil
+	})
+	return user, found, err
 }
 
 func (db *Database) GetUsers() ([]UserDatabase, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		return []UserDatabase{}, err
-	}
 	var result []UserDatabase
-
-	for _, value := range data.Users {
-		result = append(result, value)
-	}
-
-	return result, nil
+	err := db.View(func(tx *Tx) error {
+		result = tx.Users()
+		return nil
+	})
+	return result, err
 }
 
 func (db *Database) GetChirps() ([]Chirp, error) {
-	data, err := db.loadDB()
-	if err != nil {
-		return []Chirp{}, err
-	}
 	var result []Chirp
+	err := db.View(func(tx *Tx) error {
+		result = tx.Chirps()
+		return nil
+	})
+	return result, err
+}
 
-	for _, value := range data.Chirps {
-		result = append(result, value)
-	}
-
-	return result, nil
+func (db *Database) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	var result []Chirp
+	err := db.View(func(tx *Tx) error {
+		result = tx.ChirpsByAuthor(authorId)
+		return nil
+	})
+	return result, err
 }
 
+// loadDB reads the snapshot from disk and replays the journal on top of it.
 func (db *Database) loadDB() (DBStructure, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	result := DBStructure{Chirps: make(map[int]Chirp), Users: make(map[int]UserDatabase)}
+	result := newDBStructure()
 
 	db.ensureDB()
 
@@ -244,28 +480,55 @@ func (db *Database) loadDB() (DBStructure, error) {
 		return DBStructure{}, fmt.Errorf("error loading database. path: %s, error: %s", db.path, err)
 	}
 
-	if len(data) == 0 {
-		return result, nil
+	if len(data) != 0 {
+		err = json.Unmarshal(data, &result)
+		if err != nil {
+			return DBStructure{}, errors.New("failed to decode json data")
+		}
+		if result.Sequences == nil {
+			result.Sequences = make(map[string]int)
+		}
 	}
 
-	err = json.Unmarshal(data, &result)
+	entries, err := readJournal(db.journalPath)
 	if err != nil {
-		return DBStructure{}, errors.New("failed to decode json data")
+		return DBStructure{}, fmt.Errorf("error loading journal. path: %s, error: %s", db.journalPath, err)
 	}
+	for _, entry := range entries {
+		err = entry.apply(&result)
+		if err != nil {
+			return DBStructure{}, err
+		}
+	}
+	db.journalLen = len(entries)
 
 	return result, nil
 }
 
-func (db *Database) writeDB(dbstructure DBStructure) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	db.ensureDB()
+// writeDB persists the in memory data. With the journal on only entries, the
+// changes just made to it, are appended and the snapshot is rewritten once the
+// journal gets long. db.mu must be held.
+func (db *Database) writeDB(entries ...journalEntry) error {
+	if !db.journal {
+		return db.writeSnapshot()
+	}
 
-	data, err := json.Marshal(dbstructure)
+	err := appendJournal(db.journalPath, entries)
 	if err != nil {
 		return err
 	}
-	os.WriteFile(db.path, data, 0666)
+	db.journalLen += len(entries)
+
+	if db.journalLen >= db.compactEvery {
+		return db.compact()
+	}
 	return nil
 }
+
+func (db *Database) writeSnapshot() error {
+	data, err := json.Marshal(db.data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.path, data)
+}
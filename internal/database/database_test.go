@@ -1,9 +1,15 @@
 package database_test
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/djmarkymark007/chirpy/internal/database"
 )
@@ -37,3 +43,2149 @@ func TestDatabase(t *testing.T) {
 	}
 
 }
+
+func TestSQLiteDatabase(t *testing.T) {
+	path := t.TempDir() + "/database.db"
+
+	db, err := database.NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateChirp(database.Chirp{Body: "this is a chirp", AuthorId: 1})
+	db.CreateChirp(database.Chirp{Body: "this is another chirp", AuthorId: 2})
+	user, err := db.CreateUser("test@example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// reopening must not run the migrations again
+	db, err = database.NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	got, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []database.Chirp{
+		{Id: 1, Body: "this is a chirp", AuthorId: 1},
+		{Id: 2, Body: "this is another chirp", AuthorId: 2},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value mis match: got %v, want %v\n", got, want)
+	}
+
+	found, err := db.GetUser("test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != user.Id || string(found.PasswordHash) != "hash" {
+		t.Errorf("value mis match: got %v, want %v\n", found, user)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	db, err := database.NewDBWithOptions(path, database.Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp(database.Chirp{Body: "this is a chirp", AuthorId: 1})
+	db.CreateChirp(database.Chirp{Body: "this is another chirp", AuthorId: 2})
+
+	// a crash in the middle of an append leaves a partial entry behind
+	f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"op":"put","table":"chirps","ke`))
+	f.Close()
+
+	db, err = database.NewDBWithOptions(path, database.Options{Journal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path + ".journal"); !os.IsNotExist(err) {
+		t.Errorf("journal should be compacted on open, stat error: %v", err)
+	}
+
+	got, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []database.Chirp{
+		{Id: 1, Body: "this is a chirp", AuthorId: 1},
+		{Id: 2, Body: "this is another chirp", AuthorId: 2},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value mis match: got %v, want %v\n", got, want)
+	}
+}
+
+func TestIdsAreNotReused(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateChirp(database.Chirp{Body: "one", AuthorId: 1})
+	db.CreateChirp(database.Chirp{Body: "two", AuthorId: 1})
+	db.CreateChirp(database.Chirp{Body: "three", AuthorId: 1})
+	db.DeleteChirp(1)
+	db.DeleteChirp(3)
+	chirp, err := db.CreateChirp(database.Chirp{Body: "four", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 4 {
+		t.Errorf("new chirp id: got %d, want 4", chirp.Id)
+	}
+
+	got, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []database.Chirp{
+		{Id: 2, Body: "two", AuthorId: 1},
+		{Id: 4, Body: "four", AuthorId: 1},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value mis match: got %v, want %v\n", got, want)
+	}
+}
+
+func TestRepairOldDatabase(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	// keys used to be len(map) while ids were len(map)+1
+	old := `{"chirps":{"0":{"id":1,"body":"one","author_id":1},"1":{"id":3,"body":"three","author_id":1}},` +
+		`"users":{"0":{"id":1,"email":"test@example.com"}}}`
+	err := os.WriteFile(path, []byte(old), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirp, err := db.GetChirpById(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Body != "three" {
+		t.Errorf("chirp 3: got %v", chirp)
+	}
+
+	chirp, err = db.CreateChirp(database.Chirp{Body: "four", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 4 {
+		t.Errorf("new chirp id: got %d, want 4", chirp.Id)
+	}
+
+	user, found, err := db.GetUserById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || user.Email != "test@example.com" {
+		t.Errorf("user 1: got %v, found %v", user, found)
+	}
+}
+
+func TestIndexesFollowWrites(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateChirp(database.Chirp{Body: "one", AuthorId: 1})
+	db.CreateChirp(database.Chirp{Body: "two", AuthorId: 2})
+	db.CreateChirp(database.Chirp{Body: "three", AuthorId: 1})
+	db.DeleteChirp(1)
+
+	got, err := db.GetChirpsByAuthor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []database.Chirp{{Id: 3, Body: "three", AuthorId: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value mis match: got %v, want %v\n", got, want)
+	}
+
+	newUser, err := db.CreateUser("old@example.com", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _, _ := db.GetUserById(newUser.Id)
+	user.Email = "new@example.com"
+	err = db.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exist, _ := db.UserExist("old@example.com"); exist {
+		t.Error("old email is still indexed")
+	}
+	if exist, _ := db.UserExist("new@example.com"); !exist {
+		t.Error("new email isn't indexed")
+	}
+}
+
+// run with -race, every chirp created concurrently has to survive
+func TestConcurrentCreateChirp(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	db, err := database.NewDBWithOptions(path, database.Options{Journal: true, CompactEvery: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 8
+	const chirpsPerWriter = 25
+	var wg sync.WaitGroup
+	for writer := 1; writer <= writers; writer++ {
+		wg.Add(1)
+		go func(authorId int) {
+			defer wg.Done()
+			for i := 0; i < chirpsPerWriter; i++ {
+				_, err := db.CreateChirp(database.Chirp{Body: "chirp", AuthorId: authorId})
+				if err != nil {
+					t.Error(err)
+				}
+				db.GetChirps()
+			}
+		}(writer)
+	}
+	wg.Wait()
+
+	// reopen to check what made it to disk, not just memory
+	db, err = database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != writers*chirpsPerWriter {
+		t.Fatalf("got %d chirps, want %d", len(chirps), writers*chirpsPerWriter)
+	}
+	for index, chirp := range chirps {
+		if chirp.Id != index+1 {
+			t.Fatalf("chirp %d has id %d", index, chirp.Id)
+		}
+	}
+}
+
+func TestUpdateRollsBack(t *testing.T) {
+	path := t.TempDir() + "/database.json"
+
+	db, err := database.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateChirp(database.Chirp{Body: "one", AuthorId: 1})
+
+	errFailed := errors.New("failed")
+	err = db.Update(func(tx *database.Tx) error {
+		tx.CreateChirp(database.Chirp{Body: "two", AuthorId: 1})
+		tx.DeleteChirp(1)
+		return errFailed
+	})
+	if err != errFailed {
+		t.Fatalf("got error %v, want %v", err, errFailed)
+	}
+
+	got, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []database.Chirp{{Id: 1, Body: "one", AuthorId: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value mis match: got %v, want %v\n", got, want)
+	}
+
+	chirp, err := db.CreateChirp(database.Chirp{Body: "two", AuthorId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 2 {
+		t.Errorf("rolled back id was not released: got %d, want 2", chirp.Id)
+	}
+}
+
+// stores opens an empty store of every kind.
+func stores(t *testing.T) map[string]database.Store {
+	t.Helper()
+	dir := t.TempDir()
+
+	jsonStore, err := database.NewDB(dir + "/database.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteStore, err := database.NewSQLiteDB(dir + "/database.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+
+	return map[string]database.Store{"json": jsonStore, "sqlite": sqliteStore}
+}
+
+func chirpIds(chirps []database.Chirp) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.Id)
+	}
+	return ids
+}
+
+func TestQueryChirps(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 1; i <= 6; i++ {
+				db.CreateChirp(database.Chirp{Body: "chirp", AuthorId: i%2 + 1})
+			}
+			db.DeleteChirp(3)
+
+			page, err := db.QueryChirps(database.ChirpQuery{Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{1, 2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("first page: got %v, want %v", got, want)
+			}
+			if page.PrevCursor != "" {
+				t.Error("first page has a previous cursor")
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{Limit: 2, After: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{4, 5}; !reflect.DeepEqual(got, want) {
+				t.Errorf("second page: got %v, want %v", got, want)
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{Limit: 2, After: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{6}; !reflect.DeepEqual(got, want) {
+				t.Errorf("last page: got %v, want %v", got, want)
+			}
+			if page.NextCursor != "" {
+				t.Error("last page has a next cursor")
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{Limit: 2, Before: page.PrevCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{4, 5}; !reflect.DeepEqual(got, want) {
+				t.Errorf("page before last: got %v, want %v", got, want)
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{Limit: 2, Desc: true, AuthorId: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{6, 4}; !reflect.DeepEqual(got, want) {
+				t.Errorf("newest by author: got %v, want %v", got, want)
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{Limit: 2, Desc: true, AuthorId: 1, After: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("oldest by author: got %v, want %v", got, want)
+			}
+
+			_, err = db.QueryChirps(database.ChirpQuery{After: "not a cursor"})
+			if !errors.Is(err, database.ErrBadCursor) {
+				t.Errorf("got error %v, want %v", err, database.ErrBadCursor)
+			}
+		})
+	}
+}
+
+func TestEditChirp(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			posted := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			chirp, err := db.CreateChirp(database.Chirp{Body: "frist", AuthorId: 1, CreatedAt: posted, UpdatedAt: posted})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			edited := posted.Add(time.Minute)
+			chirp, err = db.EditChirp(chirp.Id, "first", edited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.Body != "first" || !chirp.UpdatedAt.Equal(edited) || !chirp.CreatedAt.Equal(posted) {
+				t.Errorf("edited chirp: got %v", chirp)
+			}
+
+			history, err := db.GetChirpHistory(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []database.ChirpRevision{{Id: 1, ChirpId: chirp.Id, Body: "frist", CreatedAt: posted, ReplacedAt: edited}}
+			if !reflect.DeepEqual(history, want) {
+				t.Errorf("history: got %v, want %v", history, want)
+			}
+
+			_, err = db.EditChirp(100, "nope", edited)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("got error %v, want %v", err, database.ErrNotFound)
+			}
+
+			err = db.DeleteChirp(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history, err = db.GetChirpHistory(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 0 {
+				t.Errorf("history outlived its chirp: %v", history)
+			}
+		})
+	}
+}
+
+func TestQueryChirpsByCreatedAt(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			// ids 1, 2, 3 created at minutes 2, 0, 1
+			for _, minute := range []int{2, 0, 1} {
+				at := start.Add(time.Duration(minute) * time.Minute)
+				db.CreateChirp(database.Chirp{Body: "chirp", AuthorId: 1, CreatedAt: at, UpdatedAt: at})
+			}
+
+			page, err := db.QueryChirps(database.ChirpQuery{OrderBy: database.OrderByCreatedAt, Desc: true, Limit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{1, 3}; !reflect.DeepEqual(got, want) {
+				t.Errorf("first page: got %v, want %v", got, want)
+			}
+
+			page, err = db.QueryChirps(database.ChirpQuery{OrderBy: database.OrderByCreatedAt, Desc: true, Limit: 2, After: page.NextCursor})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := chirpIds(page.Chirps), []int{2}; !reflect.DeepEqual(got, want) {
+				t.Errorf("second page: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestThreads(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			create := func(body string, inReplyTo int) database.Chirp {
+				t.Helper()
+				chirp, err := db.CreateChirp(database.Chirp{Body: body, AuthorId: 1, InReplyTo: inReplyTo})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return chirp
+			}
+			root := create("root", 0)
+			a := create("a", root.Id)
+			b := create("b", root.Id)
+			aa := create("aa", a.Id)
+
+			_, err := db.CreateChirp(database.Chirp{Body: "orphan", AuthorId: 1, InReplyTo: 100})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("reply to a missing chirp: got error %v, want %v", err, database.ErrNotFound)
+			}
+
+			thread, found, err := database.GetThread(db, a.Id)
+			if err != nil || !found {
+				t.Fatal(found, err)
+			}
+			if got := chirpIds(thread.Ancestors); !reflect.DeepEqual(got, []int{root.Id}) {
+				t.Errorf("ancestors: got %v", got)
+			}
+			if thread.Chirp.ReplyCount != 1 || len(thread.Replies) != 1 || thread.Replies[0].Id != aa.Id || thread.Replies[0].Depth != 1 {
+				t.Errorf("replies: got %+v", thread)
+			}
+
+			thread, _, err = database.GetThread(db, root.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var flat []int
+			for _, node := range thread.Flatten() {
+				flat = append(flat, node.Id)
+			}
+			if want := []int{a.Id, aa.Id, b.Id}; !reflect.DeepEqual(flat, want) {
+				t.Errorf("flattened thread: got %v, want %v", flat, want)
+			}
+
+			// a has a reply so deleting it leaves a tombstone, which isn't listed
+			err = db.DeleteChirp(a.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tombstone, err := db.GetChirpById(a.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tombstone.Deleted || tombstone.Body != "" || tombstone.ReplyCount != 1 {
+				t.Errorf("tombstone: got %+v", tombstone)
+			}
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIds(chirps); !reflect.DeepEqual(got, []int{root.Id, b.Id, aa.Id}) {
+				t.Errorf("chirps: got %v", got)
+			}
+			_, err = db.CreateChirp(database.Chirp{Body: "late", AuthorId: 1, InReplyTo: a.Id})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("reply to a tombstone: got error %v, want %v", err, database.ErrNotFound)
+			}
+
+			// its last reply going takes the tombstone with it
+			err = db.DeleteChirp(aa.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gone, err := db.GetChirpById(a.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gone.Id != 0 {
+				t.Errorf("tombstone outlived its replies: %+v", gone)
+			}
+			root, err = db.GetChirpById(root.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root.ReplyCount != 1 {
+				t.Errorf("root reply count: got %d, want 1", root.ReplyCount)
+			}
+		})
+	}
+}
+
+func TestFollowTimeline(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			var users []int
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				user, err := db.CreateUser(email, []byte("hash"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				users = append(users, user.Id)
+			}
+			a, b, c := users[0], users[1], users[2]
+
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			follow, err := db.Follow(a, b, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := db.Follow(a, b, now.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(again, follow) {
+				t.Errorf("following twice: got %v, want %v", again, follow)
+			}
+			_, err = db.Follow(a, 100, now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("following a missing user: got error %v, want %v", err, database.ErrNotFound)
+			}
+
+			followers, err := db.GetFollowers(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(followers, []database.Follow{follow}) {
+				t.Errorf("followers: got %v", followers)
+			}
+
+			var want []int
+			for i, author := range []int{a, b, c, b, a} {
+				posted := now.Add(time.Duration(i) * time.Minute)
+				chirp, err := db.CreateChirp(database.Chirp{Body: "chirp", AuthorId: author, CreatedAt: posted, UpdatedAt: posted})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if author != c {
+					want = append([]int{chirp.Id}, want...)
+				}
+			}
+
+			query := database.ChirpQuery{AuthorIds: []int{a, b}, OrderBy: database.OrderByCreatedAt, Desc: true, Limit: 3}
+			page, err := db.QueryChirps(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := chirpIds(page.Chirps)
+			query.After = page.NextCursor
+			page, err = db.QueryChirps(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, chirpIds(page.Chirps)...)
+			if !reflect.DeepEqual(got, want) || page.NextCursor != "" {
+				t.Errorf("timeline: got %v, want %v", got, want)
+			}
+
+			err = db.Unfollow(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			following, err := db.GetFollowing(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(following) != 0 {
+				t.Errorf("following after unfollow: got %v", following)
+			}
+		})
+	}
+}
+
+func TestLikesAndRechirps(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			chirp, err := db.CreateChirp(database.Chirp{Body: "like me", AuthorId: 1, CreatedAt: now, UpdatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				chirp, err = db.LikeChirp(2, chirp.Id, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				chirp, err = db.Rechirp(2, chirp.Id, now.Add(time.Minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			chirp, err = db.LikeChirp(3, chirp.Id, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.LikeCount != 2 || chirp.RechirpCount != 1 {
+				t.Errorf("counts: got %d likes and %d rechirps, want 2 and 1", chirp.LikeCount, chirp.RechirpCount)
+			}
+
+			// the rechirp is one of the rechirper's chirps
+			page, err := db.QueryChirps(database.ChirpQuery{AuthorId: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Chirps) != 1 || page.Chirps[0].RechirpOf != chirp.Id {
+				t.Fatalf("rechirper's chirps: got %v", page.Chirps)
+			}
+			rechirp := page.Chirps[0]
+			_, err = db.LikeChirp(3, rechirp.Id, now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("liking a rechirp: got error %v, want %v", err, database.ErrNotFound)
+			}
+
+			chirp, err = db.UnlikeChirp(2, chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err = db.Unrechirp(2, chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err = db.Unrechirp(2, chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.LikeCount != 1 || chirp.RechirpCount != 0 {
+				t.Errorf("counts: got %d likes and %d rechirps, want 1 and 0", chirp.LikeCount, chirp.RechirpCount)
+			}
+			gone, err := db.GetChirpById(rechirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gone.Id != 0 {
+				t.Errorf("rechirp outlived unrechirp: %v", gone)
+			}
+
+			// deleting a chirp takes its rechirps with it
+			_, err = db.Rechirp(3, chirp.Id, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirp(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 0 {
+				t.Errorf("chirps left after delete: %v", chirps)
+			}
+		})
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			posted := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			bodies := []string{
+				"Going to the Kernel meetup tonight",
+				"kernel patches and more KERNEL, kernel hacking all day",
+				"the meetup was great",
+				"I'm tonight's speaker at the meetup",
+			}
+			var ids []int
+			for i, body := range bodies {
+				at := posted.Add(time.Duration(i) * time.Hour)
+				chirp, err := db.CreateChirp(database.Chirp{Body: body, AuthorId: 1 + i%2, CreatedAt: at, UpdatedAt: at})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, chirp.Id)
+			}
+
+			search := func(query database.SearchQuery) []int {
+				t.Helper()
+				result, err := db.SearchChirps(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Total < len(result.Chirps) {
+					t.Errorf("%q: total %d is less than the %d chirps returned", query.Text, result.Total, len(result.Chirps))
+				}
+				return chirpIds(result.Chirps)
+			}
+			tests := []struct {
+				query database.SearchQuery
+				want  []int
+			}{
+				{database.SearchQuery{Text: "KERNEL"}, []int{ids[1], ids[0]}},
+				{database.SearchQuery{Text: "kern*"}, []int{ids[1], ids[0]}},
+				{database.SearchQuery{Text: "meetup tonight"}, []int{ids[0]}},
+				{database.SearchQuery{Text: `"the meetup"`}, []int{ids[2], ids[3]}},
+				{database.SearchQuery{Text: "meetup", AuthorId: 1}, []int{ids[2], ids[0]}},
+				{database.SearchQuery{Text: "meetup", Since: posted.Add(time.Hour), Until: posted.Add(3 * time.Hour)}, []int{ids[2]}},
+				{database.SearchQuery{Text: "tonight's"}, []int{ids[3]}},
+				{database.SearchQuery{Text: "nothing"}, []int{}},
+			}
+			for _, test := range tests {
+				if got := search(test.query); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("%+v: got %v, want %v", test.query, got, test.want)
+				}
+			}
+
+			_, err := db.SearchChirps(database.SearchQuery{Text: " !? "})
+			if !errors.Is(err, database.ErrBadSearch) {
+				t.Errorf("empty search: got error %v, want %v", err, database.ErrBadSearch)
+			}
+			tooLarge := []string{
+				strings.Repeat("a", database.MaxSearchLength+1),
+				strings.Repeat("meetup ", database.MaxSearchTerms+1),
+			}
+			for _, text := range tooLarge {
+				_, err = db.SearchChirps(database.SearchQuery{Text: text})
+				if !errors.Is(err, database.ErrSearchTooLarge) {
+					t.Errorf("search of %d bytes: got error %v, want %v", len(text), err, database.ErrSearchTooLarge)
+				}
+			}
+			if got := search(database.SearchQuery{Text: strings.Repeat("meetup ", database.MaxSearchTerms)}); len(got) == 0 {
+				t.Errorf("search of %d terms: got nothing", database.MaxSearchTerms)
+			}
+
+			_, err = db.EditChirp(ids[2], "the party was great", posted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirp(ids[3])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := search(database.SearchQuery{Text: "meetup"}); !reflect.DeepEqual(got, []int{ids[0]}) {
+				t.Errorf("after edit and delete: got %v, want %v", got, []int{ids[0]})
+			}
+		})
+	}
+}
+
+func TestParseHashtags(t *testing.T) {
+	tests := []struct {
+		body string
+		want []database.Hashtag
+	}{
+		{"no tags", nil},
+		{"#Go is fun", []database.Hashtag{{Tag: "go", Start: 0, End: 3}}},
+		{"héllo #Café_2024, #123 and mail#not", []database.Hashtag{{Tag: "café_2024", Start: 6, End: 16}}},
+		{"##twice #a#b", []database.Hashtag{{Tag: "twice", Start: 1, End: 7}, {Tag: "a", Start: 8, End: 10}}},
+	}
+	for _, test := range tests {
+		got := database.ParseHashtags(test.body)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.body, got, test.want)
+		}
+	}
+}
+
+func TestHashtags(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			var ids []int
+			for i, body := range []string{"#go #Go", "#rust", "#go again", "old #rust"} {
+				at := now.Add(-time.Duration(i) * time.Hour)
+				if i == 3 {
+					at = now.Add(-48 * time.Hour)
+				}
+				chirp, err := db.CreateChirp(database.Chirp{Body: body, AuthorId: 1, CreatedAt: at, UpdatedAt: at})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, chirp.Id)
+			}
+
+			page, err := db.QueryChirps(database.ChirpQuery{Hashtag: "go"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIds(page.Chirps); !reflect.DeepEqual(got, []int{ids[0], ids[2]}) {
+				t.Errorf("#go chirps: got %v", got)
+			}
+
+			trending, err := database.Trending(db, now, database.TrendingOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trending) != 2 || trending[0].Tag != "go" || trending[0].Count != 2 || trending[1].Tag != "rust" || trending[1].Count != 1 {
+				t.Errorf("trending: got %+v", trending)
+			}
+
+			_, err = db.EditChirp(ids[2], "#rust again", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirp(ids[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, err = db.QueryChirps(database.ChirpQuery{Hashtag: "go"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Chirps) != 0 {
+				t.Errorf("#go chirps after edit and delete: got %v", chirpIds(page.Chirps))
+			}
+			page, err = db.QueryChirps(database.ChirpQuery{Hashtag: "rust"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIds(page.Chirps); !reflect.DeepEqual(got, []int{ids[1], ids[2], ids[3]}) {
+				t.Errorf("#rust chirps: got %v", got)
+			}
+		})
+	}
+}
+
+func TestHashtagBackfill(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// each store is filled, its hashtags are wiped to look like they were
+	// written before hashtags were parsed, and it is opened again
+	forget := map[string]func(path string){
+		"json": func(path string) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var file map[string]any
+			err = json.Unmarshal(data, &file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, chirp := range file["chirps"].(map[string]any) {
+				delete(chirp.(map[string]any), "hashtags")
+			}
+			data, err = json.Marshal(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, data, 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		"sqlite": func(path string) {
+			conn, err := sql.Open("sqlite", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = conn.Exec("UPDATE chirps SET hashtags = ''; DELETE FROM chirp_hashtags; PRAGMA user_version = 17;")
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	open := map[string]func(path string) (database.Store, func()){
+		"json": func(path string) (database.Store, func()) {
+			db, err := database.NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db, func() {}
+		},
+		"sqlite": func(path string) (database.Store, func()) {
+			db, err := database.NewSQLiteDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db, func() { db.Close() }
+		},
+	}
+
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			path := dir + "/backfill." + name
+			db, closeStore := openStore(path)
+			tagged, err := db.CreateChirp(database.Chirp{Body: "old #go", AuthorId: 1, CreatedAt: now, UpdatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateChirp(database.Chirp{Body: "no tags", AuthorId: 1, CreatedAt: now, UpdatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeStore()
+
+			forget[name](path)
+			db, closeStore = openStore(path)
+			defer closeStore()
+
+			page, err := db.QueryChirps(database.ChirpQuery{Hashtag: "go"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chirpIds(page.Chirps); !reflect.DeepEqual(got, []int{tagged.Id}) {
+				t.Errorf("#go chirps: got %v", got)
+			}
+			trending, err := database.Trending(db, now, database.TrendingOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(trending) != 1 || trending[0].Tag != "go" || trending[0].Count != 1 {
+				t.Errorf("trending: got %+v", trending)
+			}
+		})
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			var users []int
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				user, err := db.CreateUser(email, []byte("hash"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				users = append(users, user.Id)
+			}
+			a, b, c := users[0], users[1], users[2]
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+			post, err := db.CreateChirp(database.Chirp{Body: "hi @b@example.com, mail me at a@example.com or @nobody@example.com.", AuthorId: a, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []database.Mention{{UserId: b, Start: 3, End: 17}}
+			if !reflect.DeepEqual(post.Mentions, want) {
+				t.Errorf("mentions: got %v, want %v", post.Mentions, want)
+			}
+
+			// c replying and mentioning a only tells a once, b liking and following tells a twice
+			_, err = db.CreateChirp(database.Chirp{Body: "@a@example.com hey", AuthorId: c, InReplyTo: post.Id, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.LikeChirp(b, post.Id, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.LikeChirp(a, post.Id, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Follow(b, a, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kinds := func(userId int, unreadOnly bool) []string {
+				t.Helper()
+				notifications, err := db.GetNotifications(database.NotificationQuery{UserId: userId, UnreadOnly: unreadOnly})
+				if err != nil {
+					t.Fatal(err)
+				}
+				result := []string{}
+				for _, notification := range notifications {
+					result = append(result, notification.Kind)
+				}
+				return result
+			}
+			wantKinds := []string{database.NotificationFollow, database.NotificationLike, database.NotificationMention}
+			if got := kinds(a, false); !reflect.DeepEqual(got, wantKinds) {
+				t.Errorf("a's notifications: got %v, want %v", got, wantKinds)
+			}
+			if got := kinds(b, false); !reflect.DeepEqual(got, []string{database.NotificationMention}) {
+				t.Errorf("b's notifications: got %v", got)
+			}
+
+			notifications, err := db.GetNotifications(database.NotificationQuery{UserId: a, Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.MarkNotificationsRead(a, []int{notifications[0].Id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			unread, err := db.CountUnreadNotifications(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unread != 2 {
+				t.Errorf("unread: got %d, want 2", unread)
+			}
+			err = db.MarkNotificationsRead(a, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := kinds(a, true); len(got) != 0 {
+				t.Errorf("unread after marking all read: got %v", got)
+			}
+
+			// deleting the chirp takes the notifications about it along
+			err = db.DeleteChirp(post.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := kinds(b, false); len(got) != 0 {
+				t.Errorf("b's notifications after delete: got %v", got)
+			}
+		})
+	}
+}
+
+func TestHandles(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			var users []database.UserDatabase
+			for _, email := range []string{"a@example.com", "b@example.com"} {
+				created, err := db.CreateUser(email, []byte("hash"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				user, _, err := db.GetUserById(created.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				users = append(users, user)
+			}
+			a, b := users[0], users[1]
+
+			a.Handle = "Alice"
+			a.Bio = "hello"
+			err := db.UpdateUser(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Handle = "aLICE"
+			err = db.UpdateUser(b)
+			if !errors.Is(err, database.ErrHandleTaken) {
+				t.Errorf("taking a's handle: got %v, want ErrHandleTaken", err)
+			}
+			// saving a again keeps its own handle
+			err = db.UpdateUser(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a taken handle at signup leaves no user behind
+			_, err = db.CreateUserWithProfile(database.UserDatabase{Email: "c@example.com", PasswordHash: []byte("hash"), Handle: "ALICE"})
+			if !errors.Is(err, database.ErrHandleTaken) {
+				t.Errorf("signing up with a's handle: got %v, want ErrHandleTaken", err)
+			}
+			if exists, _ := db.UserExist("c@example.com"); exists {
+				t.Error("signup with a taken handle created the user")
+			}
+			created, err := db.CreateUserWithProfile(database.UserDatabase{Email: "c@example.com", PasswordHash: []byte("hash"), Handle: "carol", Bio: "hi"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Handle != "carol" || created.Bio != "hi" || created.Role != database.RoleUser {
+				t.Errorf("created with profile: got %+v", created)
+			}
+
+			user, found, err := db.GetUserByHandle("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || user.Id != a.Id || user.Handle != "Alice" || user.Bio != "hello" {
+				t.Errorf("by handle: got %+v, %v", user, found)
+			}
+			_, found, err = db.GetUserByHandle("")
+			if err != nil || found {
+				t.Errorf("empty handle: got %v, %v", found, err)
+			}
+
+			_, err = db.Follow(b.Id, a.Id, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile, found, err := database.GetProfile(db, "ALICE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := database.Profile{Id: a.Id, Handle: "Alice", Bio: "hello", FollowerCount: 1}
+			if !found || profile != want {
+				t.Errorf("profile: got %+v, want %+v", profile, want)
+			}
+
+			handles, err := db.GetUserHandles([]int{a.Id, b.Id, 99})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(handles, map[int]string{a.Id: "Alice"}) {
+				t.Errorf("handles: got %v", handles)
+			}
+
+			// a new handle frees the old one and mentions find users by handle
+			a.Handle = "al"
+			err = db.UpdateUser(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.Handle = "alice"
+			err = db.UpdateUser(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirp, err := db.CreateChirp(database.Chirp{Body: "hi @Alice and @al.", AuthorId: a.Id, AuthorHandle: "stale"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantMentions := []database.Mention{{UserId: b.Id, Start: 3, End: 9}, {UserId: a.Id, Start: 14, End: 17}}
+			if !reflect.DeepEqual(chirp.Mentions, wantMentions) {
+				t.Errorf("mentions: got %v, want %v", chirp.Mentions, wantMentions)
+			}
+			stored, err := db.GetChirpById(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.AuthorHandle != "" || stored.AuthorHandle != "" {
+				t.Errorf("author handle was stored: %q", stored.AuthorHandle)
+			}
+		})
+	}
+}
+
+func TestMedia(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			a, err := db.CreateUser("a@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := db.CreateUser("b@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			upload := func(ownerId int, key string) database.Media {
+				t.Helper()
+				media, err := db.CreateMedia(database.Media{OwnerId: ownerId, Kind: database.MediaAttachment, ContentType: "image/png",
+					Width: 2, Height: 1, Key: key, ThumbnailKey: key + "_thumb", Url: "/media/" + key, ThumbnailUrl: "/media/" + key + "_thumb"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return media
+			}
+			first, second, third := upload(a.Id, "1"), upload(a.Id, "2"), upload(a.Id, "3")
+			others := upload(b.Id, "4")
+
+			attach := func(ids ...int) (database.Chirp, error) {
+				var attachments []database.Attachment
+				for _, id := range ids {
+					attachments = append(attachments, database.Attachment{Id: id})
+				}
+				return db.CreateChirp(database.Chirp{Body: "look", AuthorId: a.Id, Attachments: attachments})
+			}
+
+			chirp, err := attach(first.Id, second.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []database.Attachment{first.Attachment(), second.Attachment()}
+			if !reflect.DeepEqual(chirp.Attachments, want) {
+				t.Errorf("attachments: got %+v, want %+v", chirp.Attachments, want)
+			}
+			stored, err := db.GetChirpById(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(stored.Attachments, want) {
+				t.Errorf("stored attachments: got %+v, want %+v", stored.Attachments, want)
+			}
+
+			bad := map[string][]int{
+				"already used":   {third.Id, first.Id},
+				"someone else's": {others.Id},
+				"missing":        {99},
+				"twice":          {third.Id, third.Id},
+				"too many":       {third.Id, 5, 6, 7, 8},
+			}
+			for name, ids := range bad {
+				_, err = attach(ids...)
+				if !errors.Is(err, database.ErrBadAttachment) {
+					t.Errorf("%s: got %v, want ErrBadAttachment", name, err)
+				}
+			}
+			// the failed chirps didn't hold on to third
+			_, err = attach(third.Id)
+			if err != nil {
+				t.Errorf("third after failed chirps: %s", err)
+			}
+
+			media, err := db.GetChirpMedia(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(media) != 2 || media[0].Id != first.Id || media[0].ChirpId != chirp.Id || media[1].Key != "2" {
+				t.Errorf("chirp media: got %+v", media)
+			}
+			err = db.DeleteChirp(chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			media, err = db.GetChirpMedia(chirp.Id)
+			if err != nil || len(media) != 0 {
+				t.Errorf("chirp media after delete: got %+v, %v", media, err)
+			}
+
+			avatar, replaced, err := db.SetAvatar(a.Id, database.Media{Key: "avatar1", Url: "/media/avatar1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replaced) != 0 || avatar.Kind != database.MediaAvatar || avatar.OwnerId != a.Id {
+				t.Errorf("first avatar: got %+v replacing %+v", avatar, replaced)
+			}
+			_, replaced, err = db.SetAvatar(a.Id, database.Media{Key: "avatar2", Url: "/media/avatar2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(replaced) != 1 || replaced[0].Key != "avatar1" {
+				t.Errorf("replaced avatars: got %+v", replaced)
+			}
+			user, _, err := db.GetUserById(a.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.AvatarUrl != "/media/avatar2" {
+				t.Errorf("avatar url: got %s", user.AvatarUrl)
+			}
+			_, _, err = db.SetAvatar(99, database.Media{Key: "avatar3"})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("avatar for a missing user: got %v, want ErrNotFound", err)
+			}
+
+			// others was uploaded long ago and never posted, fresh just now
+			fresh, err := db.CreateMedia(database.Media{OwnerId: b.Id, Kind: database.MediaAttachment, Key: "5", CreatedAt: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			removed, err := db.RemoveUnattachedMedia(time.Now().Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(removed) != 1 || removed[0].Id != others.Id || removed[0].Key != "4" {
+				t.Errorf("removed unattached media: got %+v", removed)
+			}
+			_, err = db.CreateChirp(database.Chirp{Body: "late", AuthorId: b.Id, Attachments: []database.Attachment{{Id: others.Id}}})
+			if !errors.Is(err, database.ErrBadAttachment) {
+				t.Errorf("attaching removed media: got %v, want ErrBadAttachment", err)
+			}
+			_, err = db.CreateChirp(database.Chirp{Body: "fresh", AuthorId: b.Id, Attachments: []database.Attachment{{Id: fresh.Id}}})
+			if err != nil {
+				t.Errorf("attaching fresh media: %s", err)
+			}
+		})
+	}
+}
+
+func TestNeedsReview(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			flagged, err := db.CreateChirp(database.Chirp{Body: "a kerfuffle", AuthorId: 1, NeedsReview: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := db.GetChirpById(flagged.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.NeedsReview {
+				t.Error("stored chirp: not flagged")
+			}
+
+			cleared, err := db.SetNeedsReview(flagged.Id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err = db.GetChirpById(flagged.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cleared.NeedsReview || stored.NeedsReview || stored.Body != "a kerfuffle" {
+				t.Errorf("cleared: got %+v, stored %+v", cleared, stored)
+			}
+
+			_, err = db.SetNeedsReview(flagged.Id+100, true)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("missing chirp: got %v, want ErrNotFound", err)
+			}
+
+			// a tombstone keeps nothing of the chirp to review
+			_, err = db.SetNeedsReview(flagged.Id, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateChirp(database.Chirp{Body: "reply", AuthorId: 2, InReplyTo: flagged.Id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.DeleteChirp(flagged.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err = db.GetChirpById(flagged.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stored.Deleted || stored.NeedsReview {
+				t.Errorf("tombstone: got %+v", stored)
+			}
+		})
+	}
+}
+
+func reportIds(reports []database.Report) []int {
+	ids := []int{}
+	for _, report := range reports {
+		ids = append(ids, report.Id)
+	}
+	return ids
+}
+
+func TestModeration(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			author, err := db.CreateUser("author@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reporter, err := db.CreateUser("reporter@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := db.CreateUser("other@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+
+			chirp, err := db.CreateChirp(database.Chirp{Body: "rude words", AuthorId: author.Id, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, err := db.CreateChirp(database.Chirp{Body: "a reply", AuthorId: other.Id, InReplyTo: chirp.Id, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			flagged, err := db.CreateChirp(database.Chirp{Body: "a kerfuffle", AuthorId: author.Id, CreatedAt: now, UpdatedAt: now, NeedsReview: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			byReporter, err := db.CreateReport(database.Report{ReporterId: reporter.Id, ChirpId: chirp.Id, Reason: "rude", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if byReporter.UserId != author.Id || byReporter.Status != database.ReportOpen {
+				t.Errorf("chirp report: got %+v", byReporter)
+			}
+			_, err = db.CreateReport(database.Report{ReporterId: reporter.Id, ChirpId: chirp.Id, Reason: "still rude", CreatedAt: now})
+			if !errors.Is(err, database.ErrAlreadyReported) {
+				t.Errorf("second report: got %v, want ErrAlreadyReported", err)
+			}
+			byOther, err := db.CreateReport(database.Report{ReporterId: other.Id, ChirpId: chirp.Id, Reason: "rude", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			account, err := db.CreateReport(database.Report{ReporterId: reporter.Id, UserId: author.Id, Reason: "spam account", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, missing := range []database.Report{{ReporterId: reporter.Id, ChirpId: 999}, {ReporterId: reporter.Id, UserId: 999}} {
+				_, err = db.CreateReport(missing)
+				if !errors.Is(err, database.ErrNotFound) {
+					t.Errorf("report %+v: got %v, want ErrNotFound", missing, err)
+				}
+			}
+
+			// the chirp the profanity filter flagged is in the queue too
+			queue, err := db.GetReports(database.ReportQuery{Status: database.ReportOpen})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(queue) != 4 || queue[0].ChirpId != flagged.Id || queue[0].ReporterId != 0 || queue[0].Reason != database.ReasonProfanity {
+				t.Fatalf("queue: got %+v", queue)
+			}
+			page, err := db.GetReports(database.ReportQuery{Status: database.ReportOpen, After: queue[1].Id, Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{byOther.Id}; !reflect.DeepEqual(reportIds(page), want) {
+				t.Errorf("page: got %v, want %v", reportIds(page), want)
+			}
+
+			_, _, err = db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionHideChirp, ReportId: account.Id})
+			if !errors.Is(err, database.ErrBadAction) {
+				t.Errorf("hiding an account: got %v, want ErrBadAction", err)
+			}
+
+			hide, closed, err := db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionHideChirp, ReportId: byReporter.Id, Note: "rude", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hide.ChirpId != chirp.Id || hide.UserId != author.Id {
+				t.Errorf("hide: got %+v", hide)
+			}
+			if want := []int{byReporter.Id, byOther.Id}; !reflect.DeepEqual(reportIds(closed), want) {
+				t.Errorf("closed by hide: got %v, want %v", reportIds(closed), want)
+			}
+			for _, report := range closed {
+				if report.Status != database.ReportActioned || report.ActionId != hide.Id {
+					t.Errorf("closed report: got %+v", report)
+				}
+			}
+			_, _, err = db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionDismiss, ReportId: byOther.Id})
+			if !errors.Is(err, database.ErrReportClosed) {
+				t.Errorf("closed report: got %v, want ErrReportClosed", err)
+			}
+
+			// the hidden chirp is gone from listings and search but keeps its
+			// place in the thread
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{reply.Id, flagged.Id}; !reflect.DeepEqual(chirpIds(chirps), want) {
+				t.Errorf("chirps: got %v, want %v", chirpIds(chirps), want)
+			}
+			found, err := db.SearchChirps(database.SearchQuery{Text: "rude"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.Total != 0 {
+				t.Errorf("search: got %v", chirpIds(found.Chirps))
+			}
+			thread, ok, err := database.GetThread(db, reply.Id)
+			if err != nil || !ok {
+				t.Fatal(ok, err)
+			}
+			if len(thread.Ancestors) != 1 || !thread.Ancestors[0].Hidden || thread.Ancestors[0].Body != "" {
+				t.Errorf("ancestors: got %+v", thread.Ancestors)
+			}
+			_, ok, err = database.GetThread(db, chirp.Id)
+			if err != nil || ok {
+				t.Errorf("thread of hidden chirp: got %v, %v", ok, err)
+			}
+			_, err = db.LikeChirp(reporter.Id, chirp.Id, now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("liking hidden chirp: got %v, want ErrNotFound", err)
+			}
+
+			// editing the profanity away takes the chirp out of the queue
+			_, err = db.SetNeedsReview(flagged.Id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			queue, err = db.GetReports(database.ReportQuery{Status: database.ReportOpen})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{account.Id}; !reflect.DeepEqual(reportIds(queue), want) {
+				t.Errorf("queue: got %v, want %v", reportIds(queue), want)
+			}
+
+			user, _, err := db.GetUserById(author.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateSession(database.Session{UserId: user.Id, TokenHash: "hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// only users the moderator outranks can be suspended
+			_, _, err = db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionSuspendUser, ReportId: account.Id, CreatedAt: now})
+			if !errors.Is(err, database.ErrOutranked) {
+				t.Errorf("suspending by a user: got %v, want ErrOutranked", err)
+			}
+			moderator, _, err := db.GetUserById(other.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			moderator.Role = database.RoleModerator
+			err = db.UpdateUser(moderator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.Role = database.RoleModerator
+			err = db.UpdateUser(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionSuspendUser, ReportId: account.Id, CreatedAt: now})
+			if !errors.Is(err, database.ErrOutranked) {
+				t.Errorf("suspending a moderator: got %v, want ErrOutranked", err)
+			}
+			user.Role = database.RoleUser
+			err = db.UpdateUser(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			suspend, closed, err := db.Moderate(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionSuspendUser, ReportId: account.Id, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{account.Id}; !reflect.DeepEqual(reportIds(closed), want) {
+				t.Errorf("closed by suspend: got %v, want %v", reportIds(closed), want)
+			}
+			user, _, err = db.GetUserById(author.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.Suspended {
+				t.Errorf("suspended user: got %+v", user)
+			}
+			sessions, err := db.GetSessions(author.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("sessions of suspended user: got %+v", sessions)
+			}
+
+			log, err := db.GetModerationLog(database.ModerationLogQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(log) != 2 || log[0].Id != suspend.Id || log[1].Id != hide.Id || log[1].Note != "rude" {
+				t.Errorf("log: got %+v", log)
+			}
+			log, err = db.GetModerationLog(database.ModerationLogQuery{Before: suspend.Id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(log) != 1 || log[0].Id != hide.Id {
+				t.Errorf("log before %d: got %+v", suspend.Id, log)
+			}
+
+			all, err := db.GetReports(database.ReportQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			statuses := map[string]int{}
+			for _, report := range all {
+				statuses[report.Status]++
+			}
+			if want := map[string]int{database.ReportActioned: 3, database.ReportDismissed: 1}; !reflect.DeepEqual(statuses, want) {
+				t.Errorf("statuses: got %v, want %v", statuses, want)
+			}
+
+			unsuspend, err := db.Unsuspend(database.ModerationAction{ModeratorId: reporter.Id, UserId: author.Id, ReportId: account.Id, Note: "appealed", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unsuspend.Action != database.ActionUnsuspendUser || unsuspend.ReportId != 0 || unsuspend.UserId != author.Id {
+				t.Errorf("unsuspend: got %+v", unsuspend)
+			}
+			user, _, err = db.GetUserById(author.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Suspended {
+				t.Errorf("unsuspended user: got %+v", user)
+			}
+			_, err = db.Unsuspend(database.ModerationAction{ModeratorId: reporter.Id, UserId: 999, CreatedAt: now})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("unsuspending unknown user: got %v, want ErrNotFound", err)
+			}
+
+			// actions chirpy takes by itself have no moderator or report
+			lock, err := db.LogAction(database.ModerationAction{ModeratorId: other.Id, Action: database.ActionLockLogin, ReportId: 1, UserId: author.Id, Note: "5 failed logins", CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			log, err = db.GetModerationLog(database.ModerationLogQuery{Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(log) != 1 || log[0].Id != lock.Id || log[0].ModeratorId != 0 || log[0].ReportId != 0 || log[0].UserId != author.Id || log[0].Action != database.ActionLockLogin {
+				t.Errorf("logged action: got %+v", log)
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			created, err := db.CreateUser("a@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created.Role != database.RoleUser {
+				t.Errorf("new user: got role %q", created.Role)
+			}
+
+			user, _, err := db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.RoleOf() != database.RoleUser {
+				t.Errorf("stored user: got role %q", user.RoleOf())
+			}
+			user.Role = database.RoleModerator
+			err = db.UpdateUser(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _, err = db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != database.RoleModerator || user.Account().Role != database.RoleModerator {
+				t.Errorf("updated user: got role %q", user.Role)
+			}
+		})
+	}
+}
+
+func sessionIds(sessions []database.Session) []int {
+	ids := []int{}
+	for _, session := range sessions {
+		ids = append(ids, session.Id)
+	}
+	return ids
+}
+
+func TestSessions(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("a@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := db.CreateUser("b@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			newSession := func(userId int, hash string, expiresAt time.Time) database.Session {
+				t.Helper()
+				session, err := db.CreateSession(database.Session{UserId: userId, TokenHash: hash, Device: "phone", CreatedAt: now, ExpiresAt: expiresAt})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return session
+			}
+
+			expired := newSession(user.Id, "expired", now.Add(-time.Minute))
+			phone := newSession(user.Id, "phone-1", now.Add(time.Hour))
+			laptop := newSession(user.Id, "laptop-1", now.Add(time.Hour))
+			elsewhere := newSession(other.Id, "other-1", now.Add(time.Hour))
+			_, err = db.CreateSession(database.Session{UserId: 99, TokenHash: "nobody", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("session of unknown user: got %v, want ErrNotFound", err)
+			}
+
+			// logging in on the laptop cleared out the expired session and
+			// kept the phone logged in
+			sessions, err := db.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{phone.Id, laptop.Id}; !reflect.DeepEqual(sessionIds(sessions), want) {
+				t.Errorf("sessions: got %v, want %v", sessionIds(sessions), want)
+			}
+			_, err = db.RotateSession(expired.TokenHash, "expired-2", now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("rotating expired session: got %v, want ErrNotFound", err)
+			}
+
+			later := now.Add(time.Minute)
+			rotated, err := db.RotateSession("phone-1", "phone-2", later)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.Id != phone.Id || rotated.TokenHash != "phone-2" || !rotated.LastUsedAt.Equal(later) || rotated.Device != "phone" {
+				t.Errorf("rotated session: got %+v", rotated)
+			}
+			_, err = db.RotateSession("phone-2", "phone-3", later)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, ok, err := db.GetSessionByToken("phone-3")
+			if err != nil || !ok || found.Id != phone.Id {
+				t.Errorf("session by token: got %+v, %v, %v", found, ok, err)
+			}
+			_, ok, err = db.GetSessionByToken("phone-1")
+			if err != nil || ok {
+				t.Errorf("session by rotated token: got %v, %v", ok, err)
+			}
+
+			// the first token of the phone turns up again, it leaked
+			_, err = db.RotateSession("phone-1", "stolen", later)
+			if !errors.Is(err, database.ErrTokenReused) {
+				t.Errorf("reusing rotated token: got %v, want ErrTokenReused", err)
+			}
+			_, err = db.RotateSession("phone-3", "phone-4", later)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("rotating revoked family: got %v, want ErrNotFound", err)
+			}
+			sessions, err = db.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{laptop.Id}; !reflect.DeepEqual(sessionIds(sessions), want) {
+				t.Errorf("sessions after reuse: got %v, want %v", sessionIds(sessions), want)
+			}
+
+			err = db.RevokeSession(laptop.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.RevokeSession(laptop.Id)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("revoking twice: got %v, want ErrNotFound", err)
+			}
+
+			newSession(user.Id, "tablet-1", now.Add(time.Hour))
+			newSession(user.Id, "desktop-1", now.Add(time.Hour))
+			count, err := db.RevokeSessions(user.Id)
+			if err != nil || count != 2 {
+				t.Errorf("logging out everywhere: got %d, %v", count, err)
+			}
+			sessions, err = db.GetSessions(other.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []int{elsewhere.Id}; !reflect.DeepEqual(sessionIds(sessions), want) {
+				t.Errorf("sessions of other user: got %v, want %v", sessionIds(sessions), want)
+			}
+		})
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("a@example.com", []byte("old hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			_, err = db.CreateSession(database.Session{UserId: user.Id, TokenHash: "session", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			newReset := func(hash string, expiresAt time.Time) {
+				t.Helper()
+				_, err := db.CreatePasswordReset(database.PasswordReset{UserId: user.Id, TokenHash: hash, CreatedAt: now, ExpiresAt: expiresAt}, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = db.CreatePasswordReset(database.PasswordReset{UserId: 99, TokenHash: "nobody", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, 0)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("reset of unknown user: got %v, want ErrNotFound", err)
+			}
+
+			newReset("expired", now.Add(-time.Minute))
+			_, err = db.ResetPassword("expired", []byte("new hash"), now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("expired reset: got %v, want ErrNotFound", err)
+			}
+
+			// a pending email change is dropped by a reset
+			stored, _, err := db.GetUserById(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored.PendingEmail = "attacker@example.com"
+			err = db.UpdateUser(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.CreateEmailVerification(database.EmailVerification{UserId: user.Id, Email: "attacker@example.com", TokenHash: "change", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// asking again makes the first token stop working
+			newReset("first", now.Add(time.Hour))
+			newReset("second", now.Add(time.Hour))
+			pending, found, err := db.GetPasswordReset("second")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found || pending.UserId != user.Id || !pending.ExpiresAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("pending reset: got %+v found %t", pending, found)
+			}
+			if _, found, _ := db.GetPasswordReset("first"); found {
+				t.Error("replaced reset is found")
+			}
+			_, err = db.ResetPassword("first", []byte("new hash"), now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("replaced reset: got %v, want ErrNotFound", err)
+			}
+
+			// during the cooldown the pending reset is kept
+			_, err = db.CreatePasswordReset(database.PasswordReset{UserId: user.Id, TokenHash: "too soon", CreatedAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)}, 5*time.Minute)
+			if !errors.Is(err, database.ErrResetPending) {
+				t.Errorf("reset during cooldown: got %v, want ErrResetPending", err)
+			}
+			if _, found, _ := db.GetPasswordReset("too soon"); found {
+				t.Error("reset during cooldown is found")
+			}
+
+			reset, err := db.ResetPassword("second", []byte("new hash"), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reset.Id != user.Id || string(reset.PasswordHash) != "new hash" {
+				t.Errorf("reset user: got %+v", reset)
+			}
+			stored, err = db.GetUser("a@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stored.PasswordHash) != "new hash" || stored.PendingEmail != "" {
+				t.Errorf("stored user: got hash %q pending email %q", stored.PasswordHash, stored.PendingEmail)
+			}
+			_, err = db.VerifyEmail("change", now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("email change after reset: got %v, want ErrNotFound", err)
+			}
+			sessions, err := db.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("sessions after reset: got %+v", sessions)
+			}
+
+			_, err = db.ResetPassword("second", []byte("another hash"), now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("reusing reset: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestSwapPasswordHash(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			created, err := db.CreateUser("a@example.com", []byte("old hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a change made after the hash was read is kept
+			user, _, err := db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.Suspended = true
+			err = db.UpdateUser(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			swapped, err := db.SwapPasswordHash(user.Id, []byte("stale hash"), []byte("new hash"))
+			if err != nil || swapped {
+				t.Errorf("swapping a stale hash: got %t %v", swapped, err)
+			}
+			swapped, err = db.SwapPasswordHash(user.Id, []byte("old hash"), []byte("new hash"))
+			if err != nil || !swapped {
+				t.Errorf("swapping: got %t %v", swapped, err)
+			}
+			swapped, err = db.SwapPasswordHash(99, []byte("old hash"), []byte("new hash"))
+			if err != nil || swapped {
+				t.Errorf("swapping for an unknown user: got %t %v", swapped, err)
+			}
+
+			user, _, err = db.GetUserById(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(user.PasswordHash) != "new hash" || !user.Suspended {
+				t.Errorf("swapped user: got %+v", user)
+			}
+		})
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := db.CreateUser("a@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.EmailVerified {
+				t.Errorf("new user is verified")
+			}
+			other, err := db.CreateUser("b@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			newVerification := func(userId int, email, hash string) {
+				t.Helper()
+				_, err := db.CreateEmailVerification(database.EmailVerification{UserId: userId, Email: email, TokenHash: hash, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = db.CreateEmailVerification(database.EmailVerification{UserId: 99, Email: "x@example.com", TokenHash: "nobody", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("verification of unknown user: got %v, want ErrNotFound", err)
+			}
+
+			newVerification(user.Id, "a@example.com", "first")
+			newVerification(user.Id, "a@example.com", "second")
+			_, err = db.VerifyEmail("first", now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("replaced verification: got %v, want ErrNotFound", err)
+			}
+			_, err = db.VerifyEmail("second", now.Add(2*time.Hour))
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("expired verification: got %v, want ErrNotFound", err)
+			}
+			verified, err := db.VerifyEmail("second", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !verified.EmailVerified || verified.Email != "a@example.com" {
+				t.Errorf("verified user: got %+v", verified)
+			}
+			_, err = db.VerifyEmail("second", now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("reusing verification: got %v, want ErrNotFound", err)
+			}
+
+			// a pending email replaces the email once it is verified
+			stored, _, err := db.GetUserById(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored.PendingEmail = "c@example.com"
+			err = db.UpdateUser(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newVerification(user.Id, "c@example.com", "change")
+			changed, err := db.VerifyEmail("change", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed.Email != "c@example.com" || changed.PendingEmail != "" || !changed.EmailVerified {
+				t.Errorf("changed user: got %+v", changed)
+			}
+			found, err := db.UserExist("a@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Errorf("old email still belongs to a user")
+			}
+
+			// a verification for an address the user dropped stops working
+			newVerification(user.Id, "old@example.com", "stale")
+			_, err = db.VerifyEmail("stale", now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("stale verification: got %v, want ErrNotFound", err)
+			}
+
+			// and one for an email someone took in the meantime fails
+			stored, _, err = db.GetUserById(other.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored.PendingEmail = "c@example.com"
+			err = db.UpdateUser(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			newVerification(other.Id, "c@example.com", "taken")
+			_, err = db.VerifyEmail("taken", now)
+			if !errors.Is(err, database.ErrEmailTaken) {
+				t.Errorf("taken email: got %v, want ErrEmailTaken", err)
+			}
+		})
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	for name, db := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			created, err := db.CreateUser("a@example.com", []byte("hash"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+
+			err = db.EnableTOTP(created.Id, 10, []string{"one"}, now)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("enabling without a secret: got %v, want ErrNotFound", err)
+			}
+
+			user, _, err := db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user.TOTPSecret = "SECRET"
+			err = db.UpdateUser(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.EnableTOTP(created.Id, 10, []string{"one", "two", "three"}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _, err = db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.TOTPEnabled || user.TOTPSecret != "SECRET" || user.TOTPLastStep != 10 || !user.Account().TOTPEnabled {
+				t.Errorf("enabled user: got %+v", user)
+			}
+
+			// the step the code to enable was for and earlier ones are used up
+			for _, step := range []int64{9, 10} {
+				err = db.UseTOTPStep(created.Id, step)
+				if !errors.Is(err, database.ErrCodeUsed) {
+					t.Errorf("step %d: got %v, want ErrCodeUsed", step, err)
+				}
+			}
+			err = db.UseTOTPStep(created.Id, 11)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.UseTOTPStep(created.Id, 11)
+			if !errors.Is(err, database.ErrCodeUsed) {
+				t.Errorf("step 11 again: got %v, want ErrCodeUsed", err)
+			}
+
+			left, err := db.UseRecoveryCode(created.Id, "two")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left != 2 {
+				t.Errorf("codes left: got %d, want 2", left)
+			}
+			_, err = db.UseRecoveryCode(created.Id, "two")
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("used recovery code: got %v, want ErrNotFound", err)
+			}
+			_, err = db.UseRecoveryCode(created.Id+1, "one")
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("code of another user: got %v, want ErrNotFound", err)
+			}
+
+			err = db.SetRecoveryCodes(created.Id, []string{"four"}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.UseRecoveryCode(created.Id, "one")
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("replaced recovery code: got %v, want ErrNotFound", err)
+			}
+			left, err = db.RecoveryCodesLeft(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left != 1 {
+				t.Errorf("codes left after replacing: got %d, want 1", left)
+			}
+
+			err = db.DisableTOTP(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _, err = db.GetUserById(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.TOTPEnabled || user.TOTPSecret != "" || user.TOTPLastStep != 0 {
+				t.Errorf("disabled user: got %+v", user)
+			}
+			left, err = db.RecoveryCodesLeft(created.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left != 0 {
+				t.Errorf("codes left after disabling: got %d, want 0", left)
+			}
+		})
+	}
+}
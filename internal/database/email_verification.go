@@ -0,0 +1,116 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrEmailTaken is returned when a user is given an email another user has.
+var ErrEmailTaken = errors.New("email taken")
+
+// EmailVerification lets whoever holds its token confirm they can read the
+// mail sent to Email, once, until it expires. Email is either the address
+// of the user, which is then verified, or the one they asked to change it
+// to, which then replaces it. Only the hash of the token is stored.
+type EmailVerification struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateEmailVerification stores verification. Verifications sent to the
+// user before stop working, only the newest one does.
+func (tx *Tx) CreateEmailVerification(verification EmailVerification) (EmailVerification, error) {
+	if _, found := tx.User(verification.UserId); !found {
+		return EmailVerification{}, fmt.Errorf("user %d: %w", verification.UserId, ErrNotFound)
+	}
+	err := tx.removeEmailVerifications(verification.UserId)
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	return insert(tx, emailVerificationsTable, verification)
+}
+
+// VerifyEmail uses the verification whose token hashes to tokenHash. When it
+// was sent to the email of the user that email is now verified, when it was
+// sent to their pending email that becomes their email. An unknown, used or
+// expired token, or one sent to an address the user no longer has or wants,
+// is ErrNotFound. A pending email someone else took in the meantime is
+// ErrEmailTaken.
+func (tx *Tx) VerifyEmail(tokenHash string, at time.Time) (UserDatabase, error) {
+	id, found := tx.db.index.verificationsByToken[tokenHash]
+	if !found || tokenHash == "" {
+		return UserDatabase{}, fmt.Errorf("email verification: %w", ErrNotFound)
+	}
+	verification := tx.db.data.EmailVerifications[id]
+	if !verification.ExpiresAt.After(at) {
+		return UserDatabase{}, fmt.Errorf("email verification %d expired: %w", verification.Id, ErrNotFound)
+	}
+	user, found := tx.User(verification.UserId)
+	if !found {
+		return UserDatabase{}, fmt.Errorf("user %d: %w", verification.UserId, ErrNotFound)
+	}
+
+	switch verification.Email {
+	case user.Email:
+	case user.PendingEmail:
+		if other, taken := tx.UserByEmail(user.PendingEmail); taken && other.Id != user.Id {
+			return UserDatabase{}, ErrEmailTaken
+		}
+		user.Email = user.PendingEmail
+		user.PendingEmail = ""
+	default:
+		return UserDatabase{}, fmt.Errorf("email verification %d is for an old address: %w", verification.Id, ErrNotFound)
+	}
+	user.EmailVerified = true
+
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	err = tx.removeEmailVerifications(user.Id)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
+
+func (tx *Tx) removeEmailVerifications(userId int) error {
+	for _, id := range slices.Clone(tx.db.index.verificationsByUser[userId]) {
+		err := remove(tx, emailVerificationsTable, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) CreateEmailVerification(verification EmailVerification) (EmailVerification, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		verification, err = tx.CreateEmailVerification(verification)
+		return err
+	})
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	return verification, nil
+}
+
+func (db *Database) VerifyEmail(tokenHash string, at time.Time) (UserDatabase, error) {
+	var user UserDatabase
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		user, err = tx.VerifyEmail(tokenHash, at)
+		return err
+	})
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Follow is one user following another, FollowerId sees the chirps of
+// FolloweeId on their timeline.
+type Follow struct {
+	Id         int       `json:"id"`
+	FollowerId int       `json:"follower_id"`
+	FolloweeId int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Follow makes followerId follow followeeId. Following someone twice is not an
+// error, the existing Follow is returned.
+func (tx *Tx) Follow(followerId int, followeeId int, at time.Time) (Follow, error) {
+	if id, found := tx.db.index.follows[followKey{followerId, followeeId}]; found {
+		return tx.db.data.Follows[id], nil
+	}
+	if _, found := tx.User(followeeId); !found {
+		return Follow{}, fmt.Errorf("user %d: %w", followeeId, ErrNotFound)
+	}
+
+	follow, err := insert(tx, followsTable, Follow{FollowerId: followerId, FolloweeId: followeeId, CreatedAt: at})
+	if err != nil {
+		return Follow{}, err
+	}
+	err = tx.notify(Notification{UserId: followeeId, Kind: NotificationFollow, ActorId: followerId, CreatedAt: at})
+	if err != nil {
+		return Follow{}, err
+	}
+	return follow, nil
+}
+
+// Unfollow undoes Follow, unfollowing someone that isn't followed is not an error.
+func (tx *Tx) Unfollow(followerId int, followeeId int) error {
+	id, found := tx.db.index.follows[followKey{followerId, followeeId}]
+	if !found {
+		return nil
+	}
+	return remove(tx, followsTable, id)
+}
+
+// Followers returns who follows the user, oldest follow first.
+func (tx *Tx) Followers(userId int) []Follow {
+	return tx.followsById(tx.db.index.followers[userId])
+}
+
+// Following returns who the user follows, oldest follow first.
+func (tx *Tx) Following(userId int) []Follow {
+	return tx.followsById(tx.db.index.following[userId])
+}
+
+func (tx *Tx) followsById(ids []int) []Follow {
+	var result []Follow
+	for _, id := range ids {
+		result = append(result, tx.db.data.Follows[id])
+	}
+	return result
+}
+
+func (db *Database) Follow(followerId int, followeeId int, at time.Time) (Follow, error) {
+	var follow Follow
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		follow, err = tx.Follow(followerId, followeeId, at)
+		return err
+	})
+	return follow, err
+}
+
+func (db *Database) Unfollow(followerId int, followeeId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.Unfollow(followerId, followeeId)
+	})
+}
+
+func (db *Database) GetFollowers(userId int) ([]Follow, error) {
+	var result []Follow
+	err := db.View(func(tx *Tx) error {
+		result = tx.Followers(userId)
+		return nil
+	})
+	return result, err
+}
+
+func (db *Database) GetFollowing(userId int) ([]Follow, error) {
+	var result []Follow
+	err := db.View(func(tx *Tx) error {
+		result = tx.Following(userId)
+		return nil
+	})
+	return result, err
+}
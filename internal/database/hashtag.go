@@ -0,0 +1,142 @@
+package database
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+)
+
+// maxHashtagLength is the longest tag, in runes, that is picked out of a body.
+const maxHashtagLength = 100
+
+// Hashtag is a #tag in the body of a chirp. Start and End are the rune offsets
+// of the tag in the body, # included.
+type Hashtag struct {
+	// Tag is the tag without the #, case folded so #Go and #GO are the same tag.
+	Tag   string `json:"tag"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// HashtagUse is a chirp being tagged, what trending is worked out from.
+type HashtagUse struct {
+	Tag       string
+	ChirpId   int
+	CreatedAt time.Time
+}
+
+// TrendingTag is a tag and how much it is trending.
+type TrendingTag struct {
+	Tag string `json:"tag"`
+	// Score is the uses of the tag each weighted by how recent it is, a use
+	// counts half as much every half life.
+	Score float64 `json:"score"`
+	// Count is how many chirps used the tag in the window.
+	Count int `json:"count"`
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// NormalizeHashtag returns tag the way Hashtag.Tag holds it.
+func NormalizeHashtag(tag string) string {
+	return cases.Fold().String(strings.TrimPrefix(tag, "#"))
+}
+
+// ParseHashtags finds the hashtags in body. A hashtag is a # that doesn't come
+// right after a letter or number, followed by letters, numbers and
+// underscores, at least one of them a letter.
+func ParseHashtags(body string) []Hashtag {
+	var result []Hashtag
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '#' || i > 0 && isTagRune(runes[i-1]) {
+			continue
+		}
+
+		end := i + 1
+		hasLetter := false
+		for end < len(runes) && isTagRune(runes[end]) {
+			hasLetter = hasLetter || unicode.IsLetter(runes[end])
+			end++
+		}
+		if hasLetter && end-i-1 <= maxHashtagLength {
+			result = append(result, Hashtag{Tag: NormalizeHashtag(string(runes[i+1 : end])), Start: i, End: end})
+		}
+		i = end - 1
+	}
+	return result
+}
+
+// tagsOf returns each tag of the chirp once.
+func tagsOf(chirp Chirp) []string {
+	var tags []string
+	for _, hashtag := range chirp.Hashtags {
+		if !slices.Contains(tags, hashtag.Tag) {
+			tags = append(tags, hashtag.Tag)
+		}
+	}
+	return tags
+}
+
+// TrendingOptions are the knobs of Trending, zero values get the defaults.
+type TrendingOptions struct {
+	// Window is how far back uses of a tag count, 24 hours by default.
+	Window time.Duration
+	// HalfLife is how long it takes a use to count half as much, a twelfth
+	// of the window by default.
+	HalfLife time.Duration
+	// Limit is how many tags to return, 10 by default.
+	Limit int
+}
+
+// Trending ranks the tags used in the window before now.
+func Trending(store Store, now time.Time, opts TrendingOptions) ([]TrendingTag, error) {
+	if opts.Window <= 0 {
+		opts.Window = 24 * time.Hour
+	}
+	if opts.HalfLife <= 0 {
+		opts.HalfLife = opts.Window / 12
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 10
+	}
+
+	uses, err := store.GetHashtagUses(now.Add(-opts.Window))
+	if err != nil {
+		return nil, err
+	}
+
+	byTag := make(map[string]*TrendingTag)
+	for _, use := range uses {
+		trending, ok := byTag[use.Tag]
+		if !ok {
+			trending = &TrendingTag{Tag: use.Tag}
+			byTag[use.Tag] = trending
+		}
+		age := max(now.Sub(use.CreatedAt), 0)
+		trending.Score += math.Exp2(-float64(age) / float64(opts.HalfLife))
+		trending.Count++
+	}
+
+	result := make([]TrendingTag, 0, len(byTag))
+	for _, trending := range byTag {
+		result = append(result, *trending)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Tag < result[j].Tag
+	})
+	if len(result) > opts.Limit {
+		result = result[:opts.Limit]
+	}
+	return result, nil
+}
@@ -0,0 +1,438 @@
+package database
+
+import "sort"
+
+// indexes are the lookups the json database keeps next to its in memory copy
+// of the data. Rows only change through a Tx, which calls the index and
+// unindex funcs of the table, so they always agree with DBStructure.
+type indexes struct {
+	chirps         chirpList
+	chirpsByAuthor map[int]*chirpList
+	usersByEmail   map[string]int
+	// usersByHandle is keyed by handleKey so handles are unique ignoring case
+	usersByHandle    map[string]int
+	revisionsByChirp map[int][]int
+	repliesByChirp   map[int][]int
+	// follows are found by who follows whom, followers and following hold
+	// follow ids for each user
+	follows   map[followKey]int
+	followers map[int][]int
+	following map[int][]int
+	// likes and rechirps are found by user and chirp, the ByChirp lists hold
+	// like ids and the ids of the rechirps
+	likes           map[userChirpKey]int
+	likesByChirp    map[int][]int
+	rechirps        map[userChirpKey]int
+	rechirpsByChirp map[int][]int
+	search          *searchIndex
+	chirpsByTag     map[string]*chirpList
+	// notifications are listed for the user they are for and the chirp they
+	// are about
+	notificationsByUser  map[int][]int
+	notificationsByChirp map[int][]int
+	// mediaByChirp holds the attachments on each chirp, avatarsByUser the
+	// avatars of each user
+	mediaByChirp  map[int][]int
+	avatarsByUser map[int][]int
+	// reports holds every report id, openReports the ones still open, and
+	// moderationLog the ids of the audit log
+	reports       []int
+	openReports   []int
+	moderationLog []int
+	// sessions are found by the hash of their refresh token and listed for
+	// their user, rotated tokens are found by hash and listed for their session
+	sessionsByToken  map[string]int
+	sessionsByUser   map[int][]int
+	rotatedTokens    map[string]int
+	rotatedBySession map[int][]int
+	// password resets are found by the hash of their token and listed for
+	// their user
+	resetsByToken map[string]int
+	resetsByUser  map[int][]int
+	// email verifications are found the same way
+	verificationsByToken map[string]int
+	verificationsByUser  map[int][]int
+	// recoveryCodesByUser are the recovery codes of each user
+	recoveryCodesByUser map[int][]int
+}
+
+type userChirpKey struct {
+	userId  int
+	chirpId int
+}
+
+type followKey struct {
+	followerId int
+	followeeId int
+}
+
+func newIndexes(data *DBStructure) *indexes {
+	idx := &indexes{
+		chirpsByAuthor:       make(map[int]*chirpList),
+		usersByEmail:         make(map[string]int),
+		usersByHandle:        make(map[string]int),
+		revisionsByChirp:     make(map[int][]int),
+		repliesByChirp:       make(map[int][]int),
+		follows:              make(map[followKey]int),
+		followers:            make(map[int][]int),
+		following:            make(map[int][]int),
+		likes:                make(map[userChirpKey]int),
+		likesByChirp:         make(map[int][]int),
+		rechirps:             make(map[userChirpKey]int),
+		rechirpsByChirp:      make(map[int][]int),
+		search:               newSearchIndex(),
+		chirpsByTag:          make(map[string]*chirpList),
+		notificationsByUser:  make(map[int][]int),
+		notificationsByChirp: make(map[int][]int),
+		mediaByChirp:         make(map[int][]int),
+		avatarsByUser:        make(map[int][]int),
+		sessionsByToken:      make(map[string]int),
+		sessionsByUser:       make(map[int][]int),
+		rotatedTokens:        make(map[string]int),
+		rotatedBySession:     make(map[int][]int),
+		resetsByToken:        make(map[string]int),
+		resetsByUser:         make(map[int][]int),
+		verificationsByToken: make(map[string]int),
+		verificationsByUser:  make(map[int][]int),
+		recoveryCodesByUser:  make(map[int][]int),
+	}
+
+	for _, t := range tables {
+		t.indexAll(idx, data)
+	}
+
+	return idx
+}
+
+func (idx *indexes) addChirp(chirp Chirp) {
+	idx.search.add(chirp)
+	if chirp.InReplyTo != 0 {
+		idx.repliesByChirp[chirp.InReplyTo] = insertSorted(idx.repliesByChirp[chirp.InReplyTo], chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		idx.rechirps[userChirpKey{chirp.AuthorId, chirp.RechirpOf}] = chirp.Id
+		idx.rechirpsByChirp[chirp.RechirpOf] = insertSorted(idx.rechirpsByChirp[chirp.RechirpOf], chirp.Id)
+	}
+
+	// tombstones and hidden chirps are only reachable through the thread
+	// they are part of
+	if chirp.Deleted || chirp.Hidden {
+		return
+	}
+
+	key := keyOf(chirp)
+	idx.chirps.add(key)
+
+	byAuthor, ok := idx.chirpsByAuthor[chirp.AuthorId]
+	if !ok {
+		byAuthor = &chirpList{}
+		idx.chirpsByAuthor[chirp.AuthorId] = byAuthor
+	}
+	byAuthor.add(key)
+
+	for _, tag := range tagsOf(chirp) {
+		byTag, ok := idx.chirpsByTag[tag]
+		if !ok {
+			byTag = &chirpList{}
+			idx.chirpsByTag[tag] = byTag
+		}
+		byTag.add(key)
+	}
+}
+
+func (idx *indexes) removeChirp(chirp Chirp) {
+	idx.search.remove(chirp.Id)
+	if chirp.InReplyTo != 0 {
+		removeFromList(idx.repliesByChirp, chirp.InReplyTo, chirp.Id)
+	}
+	if chirp.RechirpOf != 0 {
+		rechirpKey := userChirpKey{chirp.AuthorId, chirp.RechirpOf}
+		if idx.rechirps[rechirpKey] == chirp.Id {
+			delete(idx.rechirps, rechirpKey)
+		}
+		removeFromList(idx.rechirpsByChirp, chirp.RechirpOf, chirp.Id)
+	}
+
+	key := keyOf(chirp)
+	idx.chirps.remove(key)
+
+	if byAuthor, ok := idx.chirpsByAuthor[chirp.AuthorId]; ok {
+		byAuthor.remove(key)
+		if len(byAuthor.byId) == 0 {
+			delete(idx.chirpsByAuthor, chirp.AuthorId)
+		}
+	}
+
+	for _, tag := range tagsOf(chirp) {
+		if byTag, ok := idx.chirpsByTag[tag]; ok {
+			byTag.remove(key)
+			if len(byTag.byId) == 0 {
+				delete(idx.chirpsByTag, tag)
+			}
+		}
+	}
+}
+
+func (idx *indexes) addRevision(revision ChirpRevision) {
+	idx.revisionsByChirp[revision.ChirpId] = insertSorted(idx.revisionsByChirp[revision.ChirpId], revision.Id)
+}
+
+func (idx *indexes) removeRevision(revision ChirpRevision) {
+	removeFromList(idx.revisionsByChirp, revision.ChirpId, revision.Id)
+}
+
+func (idx *indexes) addFollow(follow Follow) {
+	idx.follows[followKey{follow.FollowerId, follow.FolloweeId}] = follow.Id
+	idx.followers[follow.FolloweeId] = insertSorted(idx.followers[follow.FolloweeId], follow.Id)
+	idx.following[follow.FollowerId] = insertSorted(idx.following[follow.FollowerId], follow.Id)
+}
+
+func (idx *indexes) removeFollow(follow Follow) {
+	key := followKey{follow.FollowerId, follow.FolloweeId}
+	if idx.follows[key] == follow.Id {
+		delete(idx.follows, key)
+	}
+	removeFromList(idx.followers, follow.FolloweeId, follow.Id)
+	removeFromList(idx.following, follow.FollowerId, follow.Id)
+}
+
+func (idx *indexes) addLike(like Like) {
+	idx.likes[userChirpKey{like.UserId, like.ChirpId}] = like.Id
+	idx.likesByChirp[like.ChirpId] = insertSorted(idx.likesByChirp[like.ChirpId], like.Id)
+}
+
+func (idx *indexes) removeLike(like Like) {
+	key := userChirpKey{like.UserId, like.ChirpId}
+	if idx.likes[key] == like.Id {
+		delete(idx.likes, key)
+	}
+	removeFromList(idx.likesByChirp, like.ChirpId, like.Id)
+}
+
+func (idx *indexes) addNotification(notification Notification) {
+	idx.notificationsByUser[notification.UserId] = insertSorted(idx.notificationsByUser[notification.UserId], notification.Id)
+	if notification.ChirpId != 0 {
+		idx.notificationsByChirp[notification.ChirpId] = insertSorted(idx.notificationsByChirp[notification.ChirpId], notification.Id)
+	}
+}
+
+func (idx *indexes) removeNotification(notification Notification) {
+	removeFromList(idx.notificationsByUser, notification.UserId, notification.Id)
+	if notification.ChirpId != 0 {
+		removeFromList(idx.notificationsByChirp, notification.ChirpId, notification.Id)
+	}
+}
+
+func (idx *indexes) addMedia(media Media) {
+	if media.ChirpId != 0 {
+		idx.mediaByChirp[media.ChirpId] = insertSorted(idx.mediaByChirp[media.ChirpId], media.Id)
+	}
+	if media.Kind == MediaAvatar {
+		idx.avatarsByUser[media.OwnerId] = insertSorted(idx.avatarsByUser[media.OwnerId], media.Id)
+	}
+}
+
+func (idx *indexes) removeMedia(media Media) {
+	if media.ChirpId != 0 {
+		removeFromList(idx.mediaByChirp, media.ChirpId, media.Id)
+	}
+	if media.Kind == MediaAvatar {
+		removeFromList(idx.avatarsByUser, media.OwnerId, media.Id)
+	}
+}
+
+func (idx *indexes) addReport(report Report) {
+	idx.reports = insertSorted(idx.reports, report.Id)
+	if report.Status == ReportOpen {
+		idx.openReports = insertSorted(idx.openReports, report.Id)
+	}
+}
+
+func (idx *indexes) removeReport(report Report) {
+	idx.reports = removeSorted(idx.reports, report.Id)
+	idx.openReports = removeSorted(idx.openReports, report.Id)
+}
+
+func (idx *indexes) addModerationAction(action ModerationAction) {
+	idx.moderationLog = insertSorted(idx.moderationLog, action.Id)
+}
+
+func (idx *indexes) removeModerationAction(action ModerationAction) {
+	idx.moderationLog = removeSorted(idx.moderationLog, action.Id)
+}
+
+func (idx *indexes) addSession(session Session) {
+	idx.sessionsByToken[session.TokenHash] = session.Id
+	idx.sessionsByUser[session.UserId] = insertSorted(idx.sessionsByUser[session.UserId], session.Id)
+}
+
+func (idx *indexes) removeSession(session Session) {
+	if idx.sessionsByToken[session.TokenHash] == session.Id {
+		delete(idx.sessionsByToken, session.TokenHash)
+	}
+	removeFromList(idx.sessionsByUser, session.UserId, session.Id)
+}
+
+func (idx *indexes) addRotatedToken(rotated RotatedToken) {
+	idx.rotatedTokens[rotated.TokenHash] = rotated.Id
+	idx.rotatedBySession[rotated.SessionId] = insertSorted(idx.rotatedBySession[rotated.SessionId], rotated.Id)
+}
+
+func (idx *indexes) removeRotatedToken(rotated RotatedToken) {
+	if idx.rotatedTokens[rotated.TokenHash] == rotated.Id {
+		delete(idx.rotatedTokens, rotated.TokenHash)
+	}
+	removeFromList(idx.rotatedBySession, rotated.SessionId, rotated.Id)
+}
+
+func (idx *indexes) addPasswordReset(reset PasswordReset) {
+	idx.resetsByToken[reset.TokenHash] = reset.Id
+	idx.resetsByUser[reset.UserId] = insertSorted(idx.resetsByUser[reset.UserId], reset.Id)
+}
+
+func (idx *indexes) removePasswordReset(reset PasswordReset) {
+	if idx.resetsByToken[reset.TokenHash] == reset.Id {
+		delete(idx.resetsByToken, reset.TokenHash)
+	}
+	removeFromList(idx.resetsByUser, reset.UserId, reset.Id)
+}
+
+func (idx *indexes) addEmailVerification(verification EmailVerification) {
+	idx.verificationsByToken[verification.TokenHash] = verification.Id
+	idx.verificationsByUser[verification.UserId] = insertSorted(idx.verificationsByUser[verification.UserId], verification.Id)
+}
+
+func (idx *indexes) removeEmailVerification(verification EmailVerification) {
+	if idx.verificationsByToken[verification.TokenHash] == verification.Id {
+		delete(idx.verificationsByToken, verification.TokenHash)
+	}
+	removeFromList(idx.verificationsByUser, verification.UserId, verification.Id)
+}
+
+func (idx *indexes) addRecoveryCode(code RecoveryCode) {
+	idx.recoveryCodesByUser[code.UserId] = insertSorted(idx.recoveryCodesByUser[code.UserId], code.Id)
+}
+
+func (idx *indexes) removeRecoveryCode(code RecoveryCode) {
+	removeFromList(idx.recoveryCodesByUser, code.UserId, code.Id)
+}
+
+func (idx *indexes) addUser(user UserDatabase) {
+	idx.usersByEmail[user.Email] = user.Id
+	if user.Handle != "" {
+		idx.usersByHandle[handleKey(user.Handle)] = user.Id
+	}
+}
+
+func (idx *indexes) removeUser(user UserDatabase) {
+	if idx.usersByEmail[user.Email] == user.Id {
+		delete(idx.usersByEmail, user.Email)
+	}
+	if user.Handle != "" && idx.usersByHandle[handleKey(user.Handle)] == user.Id {
+		delete(idx.usersByHandle, handleKey(user.Handle))
+	}
+}
+
+// insertSorted adds id to the sorted slice ids. New ids are always the
+// biggest so this is nearly always an append.
+func insertSorted(ids []int, id int) []int {
+	if len(ids) == 0 || ids[len(ids)-1] < id {
+		return append(ids, id)
+	}
+
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// removeFromList removes id from lists[key], dropping the list once it is empty.
+func removeFromList(lists map[int][]int, key int, id int) {
+	ids := removeSorted(lists[key], id)
+	if len(ids) == 0 {
+		delete(lists, key)
+	} else {
+		lists[key] = ids
+	}
+}
+
+func removeSorted(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return ids
+	}
+	return append(ids[:i], ids[i+1:]...)
+}
+
+// chirpKey is where a chirp sorts, either by creation time or by id. Ids break
+// ties between chirps created at the same time.
+type chirpKey struct {
+	CreatedAt int64
+	Id        int
+}
+
+func keyOf(chirp Chirp) chirpKey {
+	return chirpKey{CreatedAt: toUnix(chirp.CreatedAt), Id: chirp.Id}
+}
+
+func (key chirpKey) less(other chirpKey, byTime bool) bool {
+	if byTime && key.CreatedAt != other.CreatedAt {
+		return key.CreatedAt < other.CreatedAt
+	}
+	return key.Id < other.Id
+}
+
+// chirpList is a set of chirps kept sorted both by id and by time.
+type chirpList struct {
+	byId   []chirpKey
+	byTime []chirpKey
+}
+
+func (list *chirpList) sorted(byTime bool) []chirpKey {
+	if byTime {
+		return list.byTime
+	}
+	return list.byId
+}
+
+func (list *chirpList) add(key chirpKey) {
+	list.byId = insertKey(list.byId, key, false)
+	list.byTime = insertKey(list.byTime, key, true)
+}
+
+func (list *chirpList) remove(key chirpKey) {
+	list.byId = removeKey(list.byId, key, false)
+	list.byTime = removeKey(list.byTime, key, true)
+}
+
+// searchKeys returns the first position in keys that doesn't sort before key.
+func searchKeys(keys []chirpKey, key chirpKey, byTime bool) int {
+	return sort.Search(len(keys), func(i int) bool { return !keys[i].less(key, byTime) })
+}
+
+func insertKey(keys []chirpKey, key chirpKey, byTime bool) []chirpKey {
+	if len(keys) == 0 || keys[len(keys)-1].less(key, byTime) {
+		return append(keys, key)
+	}
+
+	i := searchKeys(keys, key, byTime)
+	if i < len(keys) && keys[i] == key {
+		return keys
+	}
+	keys = append(keys, chirpKey{})
+	copy(keys[i+1:], keys[i:])
+	keys[i] = key
+	return keys
+}
+
+func removeKey(keys []chirpKey, key chirpKey, byTime bool) []chirpKey {
+	i := searchKeys(keys, key, byTime)
+	if i == len(keys) || keys[i] != key {
+		return keys
+	}
+	return append(keys[:i], keys[i+1:]...)
+}
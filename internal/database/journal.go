@@ -0,0 +1,180 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const defaultCompactEvery = 1000
+
+// journalEntry is one change to the database. The journal is a file of these,
+// one json object per line, that gets replayed on top of the last snapshot.
+type journalEntry struct {
+	Op    string          `json:"op"`
+	Table string          `json:"table"`
+	Key   int             `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+const (
+	tableChirps             = "chirps"
+	tableUsers              = "users"
+	tableRevisions          = "revisions"
+	tableFollows            = "follows"
+	tableLikes              = "likes"
+	tableNotifications      = "notifications"
+	tableMedia              = "media"
+	tableReports            = "reports"
+	tableModeration         = "moderation"
+	tableSessions           = "sessions"
+	tableRotatedTokens      = "rotated_tokens"
+	tablePasswordResets     = "password_resets"
+	tableEmailVerifications = "email_verifications"
+	tableRecoveryCodes      = "recovery_codes"
+)
+
+func putEntry(table string, key int, value any) (journalEntry, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	return journalEntry{Op: opPut, Table: table, Key: key, Value: data}, nil
+}
+
+func deleteEntry(table string, key int) journalEntry {
+	return journalEntry{Op: opDelete, Table: table, Key: key}
+}
+
+func (entry journalEntry) apply(data *DBStructure) error {
+	t, ok := tables[entry.Table]
+	if !ok {
+		return fmt.Errorf("journal: unknown table %q", entry.Table)
+	}
+	return t.apply(entry, data)
+}
+
+// readJournal returns the entries in the journal at path. A missing journal is
+// empty. Every entry ends in a newline, anything after the last newline is an
+// append that a crash cut short and is dropped.
+func readJournal(path string) ([]journalEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	lines = lines[:len(lines)-1]
+
+	entries := make([]journalEntry, 0, len(lines))
+	for index, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		entry := journalEntry{}
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("journal: corrupt entry on line %d: %s", index+1, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// appendJournal writes entries to the end of the journal and syncs it to disk.
+func appendJournal(path string, entries []journalEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		// don't leave half an entry for the next append to be glued onto
+		f.Truncate(info.Size())
+		f.Close()
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeFileAtomic replaces the file at path with data. The data is written to
+// a temp file in the same directory, synced and then renamed over path, so
+// after a crash path holds either the old or the new contents, never half of
+// each.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Like is a user liking a chirp.
+type Like struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	ChirpId   int       `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// likeable returns the chirp with id if it can be liked or rechirped, only
+// chirps that are there, not deleted or hidden and not rechirps themselves can.
+func (tx *Tx) likeable(id int) (Chirp, error) {
+	chirp, found := tx.Chirp(id)
+	if !found || chirp.Deleted || chirp.Hidden || chirp.RechirpOf != 0 {
+		return Chirp{}, fmt.Errorf("chirp %d: %w", id, ErrNotFound)
+	}
+	return chirp, nil
+}
+
+// Like makes the user like the chirp and returns the chirp with its new like
+// count. Liking a chirp twice is not an error.
+func (tx *Tx) Like(userId int, chirpId int, at time.Time) (Chirp, error) {
+	chirp, err := tx.likeable(chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if _, found := tx.db.index.likes[userChirpKey{userId, chirpId}]; found {
+		return chirp, nil
+	}
+
+	_, err = insert(tx, likesTable, Like{UserId: userId, ChirpId: chirpId, CreatedAt: at})
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.notify(Notification{UserId: chirp.AuthorId, Kind: NotificationLike, ActorId: userId, ChirpId: chirpId, CreatedAt: at})
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.LikeCount++
+	return chirp, tx.UpdateChirp(chirp)
+}
+
+// Unlike undoes Like, unliking a chirp that isn't liked is not an error.
+func (tx *Tx) Unlike(userId int, chirpId int) (Chirp, error) {
+	chirp, err := tx.likeable(chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, found := tx.db.index.likes[userChirpKey{userId, chirpId}]
+	if !found {
+		return chirp, nil
+	}
+
+	err = remove(tx, likesTable, id)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.LikeCount--
+	return chirp, tx.UpdateChirp(chirp)
+}
+
+// Rechirp reposts the chirp as the user, the rechirp is a chirp of its own
+// with RechirpOf set so it shows up wherever the user's chirps do. It returns
+// the original chirp with its new rechirp count. Rechirping a chirp twice is
+// not an error.
+func (tx *Tx) Rechirp(userId int, chirpId int, at time.Time) (Chirp, error) {
+	chirp, err := tx.likeable(chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if _, found := tx.db.index.rechirps[userChirpKey{userId, chirpId}]; found {
+		return chirp, nil
+	}
+
+	_, err = insert(tx, chirpsTable, Chirp{AuthorId: userId, RechirpOf: chirpId, CreatedAt: at, UpdatedAt: at})
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.RechirpCount++
+	return chirp, tx.UpdateChirp(chirp)
+}
+
+// Unrechirp undoes Rechirp, unrechirping a chirp that isn't rechirped is not an error.
+func (tx *Tx) Unrechirp(userId int, chirpId int) (Chirp, error) {
+	_, err := tx.likeable(chirpId)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if id, found := tx.db.index.rechirps[userChirpKey{userId, chirpId}]; found {
+		err = tx.DeleteChirp(id)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+
+	chirp, _ := tx.Chirp(chirpId)
+	return chirp, nil
+}
+
+func (db *Database) LikeChirp(userId int, chirpId int, at time.Time) (Chirp, error) {
+	return db.updateChirp(func(tx *Tx) (Chirp, error) { return tx.Like(userId, chirpId, at) })
+}
+
+func (db *Database) UnlikeChirp(userId int, chirpId int) (Chirp, error) {
+	return db.updateChirp(func(tx *Tx) (Chirp, error) { return tx.Unlike(userId, chirpId) })
+}
+
+func (db *Database) Rechirp(userId int, chirpId int, at time.Time) (Chirp, error) {
+	return db.updateChirp(func(tx *Tx) (Chirp, error) { return tx.Rechirp(userId, chirpId, at) })
+}
+
+func (db *Database) Unrechirp(userId int, chirpId int) (Chirp, error) {
+	return db.updateChirp(func(tx *Tx) (Chirp, error) { return tx.Unrechirp(userId, chirpId) })
+}
+
+// updateChirp runs fn in an Update and returns the chirp it returns.
+func (db *Database) updateChirp(fn func(tx *Tx) (Chirp, error)) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		chirp, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
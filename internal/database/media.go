@@ -0,0 +1,221 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// MaxAttachments is the most attachments a chirp can have.
+const MaxAttachments = 4
+
+// ErrBadAttachment is returned when a chirp is posted with an attachment that
+// doesn't exist, belongs to someone else or is already on another chirp.
+var ErrBadAttachment = errors.New("bad attachment")
+
+const (
+	MediaAvatar     = "avatar"
+	MediaAttachment = "attachment"
+)
+
+// Media is an uploaded image. The image and its thumbnail are kept in a blob
+// store under Key and ThumbnailKey, the database only keeps track of them.
+type Media struct {
+	Id      int    `json:"id"`
+	OwnerId int    `json:"owner_id"`
+	Kind    string `json:"kind"`
+	// ChirpId is the chirp an attachment is on, 0 until it is posted.
+	ChirpId      int       `json:"chirp_id"`
+	ContentType  string    `json:"content_type"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Key          string    `json:"key"`
+	ThumbnailKey string    `json:"thumbnail_key"`
+	Url          string    `json:"url"`
+	ThumbnailUrl string    `json:"thumbnail_url"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Attachment is media on a chirp, as it is shown with the chirp.
+type Attachment struct {
+	Id           int    `json:"id"`
+	Url          string `json:"url"`
+	ThumbnailUrl string `json:"thumbnail_url"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+func (media Media) Attachment() Attachment {
+	return Attachment{
+		Id:           media.Id,
+		Url:          media.Url,
+		ThumbnailUrl: media.ThumbnailUrl,
+		ContentType:  media.ContentType,
+		Width:        media.Width,
+		Height:       media.Height,
+	}
+}
+
+// checkAttachments makes sure the attachments of a chirp being posted are
+// there to be used.
+func checkAttachments(chirp Chirp) error {
+	if len(chirp.Attachments) > MaxAttachments {
+		return fmt.Errorf("%d attachments: %w", len(chirp.Attachments), ErrBadAttachment)
+	}
+	for i, attachment := range chirp.Attachments {
+		if slices.ContainsFunc(chirp.Attachments[:i], func(other Attachment) bool { return other.Id == attachment.Id }) {
+			return fmt.Errorf("attachment %d twice: %w", attachment.Id, ErrBadAttachment)
+		}
+	}
+	return nil
+}
+
+// attachable reports whether media can be attached to a chirp by authorId.
+func attachable(media Media, authorId int) bool {
+	return media.Kind == MediaAttachment && media.OwnerId == authorId && media.ChirpId == 0
+}
+
+func (tx *Tx) Media(id int) (Media, bool) {
+	media, found := tx.db.data.Media[id]
+	return media, found
+}
+
+// CreateMedia stores media under a newly allocated id.
+func (tx *Tx) CreateMedia(media Media) (Media, error) {
+	return insert(tx, mediaTable, media)
+}
+
+// ChirpMedia returns the media attached to the chirp.
+func (tx *Tx) ChirpMedia(chirpId int) []Media {
+	var result []Media
+	for _, id := range tx.db.index.mediaByChirp[chirpId] {
+		result = append(result, tx.db.data.Media[id])
+	}
+	return result
+}
+
+// SetAvatar stores avatar as the avatar of the user and points their
+// AvatarUrl at it. It returns the avatar and the avatars it replaced, whose
+// blobs are no longer needed.
+func (tx *Tx) SetAvatar(userId int, avatar Media) (Media, []Media, error) {
+	user, found := tx.User(userId)
+	if !found {
+		return Media{}, nil, fmt.Errorf("user %d: %w", userId, ErrNotFound)
+	}
+
+	var replaced []Media
+	for _, id := range slices.Clone(tx.db.index.avatarsByUser[userId]) {
+		replaced = append(replaced, tx.db.data.Media[id])
+		err := remove(tx, mediaTable, id)
+		if err != nil {
+			return Media{}, nil, err
+		}
+	}
+
+	avatar.OwnerId = userId
+	avatar.Kind = MediaAvatar
+	avatar, err := insert(tx, mediaTable, avatar)
+	if err != nil {
+		return Media{}, nil, err
+	}
+	user.AvatarUrl = avatar.Url
+	return avatar, replaced, tx.UpdateUser(user)
+}
+
+// RemoveUnattachedMedia removes the attachments uploaded before cutoff that
+// were never posted on a chirp and returns them, their blobs are no longer
+// needed.
+func (tx *Tx) RemoveUnattachedMedia(cutoff time.Time) ([]Media, error) {
+	var ids []int
+	for id, media := range tx.db.data.Media {
+		if media.Kind == MediaAttachment && media.ChirpId == 0 && media.CreatedAt.Before(cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	var removed []Media
+	for _, id := range ids {
+		removed = append(removed, tx.db.data.Media[id])
+		err := remove(tx, mediaTable, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// attachments checks the attachments of chirp, which is being posted, can be
+// used and returns them filled in from their media.
+func (tx *Tx) attachments(chirp Chirp) ([]Attachment, error) {
+	err := checkAttachments(chirp)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Attachment
+	for _, attachment := range chirp.Attachments {
+		media, found := tx.Media(attachment.Id)
+		if !found || !attachable(media, chirp.AuthorId) {
+			return nil, fmt.Errorf("attachment %d: %w", attachment.Id, ErrBadAttachment)
+		}
+		result = append(result, media.Attachment())
+	}
+	return result, nil
+}
+
+// claimMedia marks the media attached to chirp as being on it.
+func (tx *Tx) claimMedia(chirp Chirp) error {
+	for _, attachment := range chirp.Attachments {
+		media, _ := tx.Media(attachment.Id)
+		media.ChirpId = chirp.Id
+		err := update(tx, mediaTable, media)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) CreateMedia(media Media) (Media, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		media, err = tx.CreateMedia(media)
+		return err
+	})
+	return media, err
+}
+
+func (db *Database) GetChirpMedia(chirpId int) ([]Media, error) {
+	var result []Media
+	err := db.View(func(tx *Tx) error {
+		result = tx.ChirpMedia(chirpId)
+		return nil
+	})
+	return result, err
+}
+
+func (db *Database) SetAvatar(userId int, avatar Media) (Media, []Media, error) {
+	var replaced []Media
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		avatar, replaced, err = tx.SetAvatar(userId, avatar)
+		return err
+	})
+	if err != nil {
+		return Media{}, nil, err
+	}
+	return avatar, replaced, nil
+}
+
+func (db *Database) RemoveUnattachedMedia(cutoff time.Time) ([]Media, error) {
+	var removed []Media
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		removed, err = tx.RemoveUnattachedMedia(cutoff)
+		return err
+	})
+	return removed, err
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Mention is an @user in the body of a chirp that was resolved to a user.
+// Start and End are the rune offsets of the mention in the body, @ included.
+type Mention struct {
+	UserId int `json:"user_id"`
+	Start  int `json:"start"`
+	End    int `json:"end"`
+}
+
+// mentionCandidate is an @name in a body that may or may not be a user.
+type mentionCandidate struct {
+	name  string
+	start int
+	end   int
+}
+
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || strings.ContainsRune("._%+-@", r)
+}
+
+// parseMentions finds the @names in body. An @name is an @ that doesn't come
+// right after a letter or number, so email addresses in the text aren't
+// mentions, followed by an email address or handle.
+func parseMentions(body string) []mentionCandidate {
+	var result []mentionCandidate
+	runes := []rune(body)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || i > 0 && (unicode.IsLetter(runes[i-1]) || unicode.IsNumber(runes[i-1])) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && isMentionRune(runes[end]) {
+			end++
+		}
+		next := end
+		// punctuation ending a sentence isn't part of the name
+		for end > i+1 && strings.ContainsRune(".-@", runes[end-1]) {
+			end--
+		}
+		if end > i+1 {
+			result = append(result, mentionCandidate{name: string(runes[i+1 : end]), start: i, end: end})
+		}
+		i = next - 1
+	}
+	return result
+}
+
+// resolveMentions returns the mentions in body of users that lookup finds.
+func resolveMentions(body string, lookup func(name string) (int, bool, error)) ([]Mention, error) {
+	var result []Mention
+	for _, candidate := range parseMentions(body) {
+		userId, found, err := lookup(candidate.name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result = append(result, Mention{UserId: userId, Start: candidate.start, End: candidate.end})
+		}
+	}
+	return result, nil
+}
+
+// chirpNotifications are the notifications chirp being posted, or edited
+// when it was already posted with oldMentions, sends out. parentAuthorId is
+// the author of the chirp it replies to, 0 for an edit or a chirp that isn't
+// a reply. Each user gets one notification, a mention beats a reply.
+func chirpNotifications(chirp Chirp, oldMentions []Mention, parentAuthorId int, at time.Time) []Notification {
+	var result []Notification
+	notified := []int{chirp.AuthorId}
+	for _, mention := range chirp.Mentions {
+		alreadyMentioned := slices.ContainsFunc(oldMentions, func(old Mention) bool { return old.UserId == mention.UserId })
+		if alreadyMentioned || slices.Contains(notified, mention.UserId) {
+			continue
+		}
+		notified = append(notified, mention.UserId)
+		result = append(result, Notification{UserId: mention.UserId, Kind: NotificationMention, ActorId: chirp.AuthorId, ChirpId: chirp.Id, CreatedAt: at})
+	}
+
+	if parentAuthorId != 0 && !slices.Contains(notified, parentAuthorId) {
+		result = append(result, Notification{UserId: parentAuthorId, Kind: NotificationReply, ActorId: chirp.AuthorId, ChirpId: chirp.Id, CreatedAt: at})
+	}
+	return result
+}
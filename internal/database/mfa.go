@@ -0,0 +1,163 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrCodeUsed is returned when a one time password for a time step that was
+// already used, or an earlier one, is used again.
+var ErrCodeUsed = errors.New("one time password already used")
+
+// RecoveryCode lets the user log in once without their authenticator. Only
+// the hash of the code is stored.
+type RecoveryCode struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	CodeHash  string    `json:"code_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EnableTOTP turns two factor login on for the user, with the secret they
+// enrolled and proved they have with a code for step. Their recovery codes
+// are replaced by the ones codeHashes are the hashes of.
+func (tx *Tx) EnableTOTP(userId int, step int64, codeHashes []string, at time.Time) error {
+	user, found := tx.User(userId)
+	if !found {
+		return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+	}
+	if user.TOTPSecret == "" {
+		return fmt.Errorf("user %d has no totp secret: %w", userId, ErrNotFound)
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+	return tx.SetRecoveryCodes(userId, codeHashes, at)
+}
+
+// DisableTOTP turns two factor login off for the user, forgetting their
+// secret and recovery codes.
+func (tx *Tx) DisableTOTP(userId int) error {
+	user, found := tx.User(userId)
+	if !found {
+		return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return err
+	}
+	return tx.SetRecoveryCodes(userId, nil, time.Time{})
+}
+
+// UseTOTPStep records that the user logged in with the code for step, so
+// neither it nor the code of an earlier step works again. Those are
+// ErrCodeUsed.
+func (tx *Tx) UseTOTPStep(userId int, step int64) error {
+	user, found := tx.User(userId)
+	if !found {
+		return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+	}
+	if step <= user.TOTPLastStep {
+		return ErrCodeUsed
+	}
+	user.TOTPLastStep = step
+	return tx.UpdateUser(user)
+}
+
+// SetRecoveryCodes replaces the recovery codes of the user with the ones
+// codeHashes are the hashes of.
+func (tx *Tx) SetRecoveryCodes(userId int, codeHashes []string, at time.Time) error {
+	if _, found := tx.User(userId); !found {
+		return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+	}
+	for _, id := range slices.Clone(tx.db.index.recoveryCodesByUser[userId]) {
+		err := remove(tx, recoveryCodesTable, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, hash := range codeHashes {
+		_, err := insert(tx, recoveryCodesTable, RecoveryCode{UserId: userId, CodeHash: hash, CreatedAt: at})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up the recovery code of the user that hashes to
+// codeHash and returns how many they have left. A code they don't have is
+// ErrNotFound.
+func (tx *Tx) UseRecoveryCode(userId int, codeHash string) (int, error) {
+	ids := tx.db.index.recoveryCodesByUser[userId]
+	for _, id := range ids {
+		if tx.db.data.RecoveryCodes[id].CodeHash != codeHash {
+			continue
+		}
+		err := remove(tx, recoveryCodesTable, id)
+		if err != nil {
+			return 0, err
+		}
+		return len(ids) - 1, nil
+	}
+	return 0, fmt.Errorf("recovery code: %w", ErrNotFound)
+}
+
+// RecoveryCodesLeft returns how many recovery codes the user has left.
+func (tx *Tx) RecoveryCodesLeft(userId int) int {
+	return len(tx.db.index.recoveryCodesByUser[userId])
+}
+
+func (db *Database) EnableTOTP(userId int, step int64, codeHashes []string, at time.Time) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.EnableTOTP(userId, step, codeHashes, at)
+	})
+}
+
+func (db *Database) DisableTOTP(userId int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.DisableTOTP(userId)
+	})
+}
+
+func (db *Database) UseTOTPStep(userId int, step int64) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.UseTOTPStep(userId, step)
+	})
+}
+
+func (db *Database) SetRecoveryCodes(userId int, codeHashes []string, at time.Time) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.SetRecoveryCodes(userId, codeHashes, at)
+	})
+}
+
+func (db *Database) UseRecoveryCode(userId int, codeHash string) (int, error) {
+	var left int
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		left, err = tx.UseRecoveryCode(userId, codeHash)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return left, nil
+}
+
+func (db *Database) RecoveryCodesLeft(userId int) (int, error) {
+	var left int
+	err := db.View(func(tx *Tx) error {
+		left = tx.RecoveryCodesLeft(userId)
+		return nil
+	})
+	return left, err
+}
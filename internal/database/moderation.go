@@ -0,0 +1,404 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// MaxReports is the most reports or moderation actions a query returns at once.
+const MaxReports = 100
+
+var (
+	// ErrAlreadyReported is returned when a user reports something they
+	// already have an open report about.
+	ErrAlreadyReported = errors.New("already reported")
+	// ErrReportClosed is returned when a moderator acts on a report that was
+	// already dealt with.
+	ErrReportClosed = errors.New("report already closed")
+	// ErrBadAction is returned for a moderation action that doesn't exist or
+	// doesn't fit the report, like hiding the chirp of an account report.
+	ErrBadAction = errors.New("bad moderation action")
+	// ErrOutranked is returned when a moderator tries to suspend a user whose
+	// role is as high as theirs.
+	ErrOutranked = errors.New("user's role is as high as the moderator's")
+)
+
+const (
+	ReportOpen      = "open"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+// ReasonProfanity is the reason given on the reports the profanity filter
+// files about the chirps it flags.
+const ReasonProfanity = "flagged by the profanity filter"
+
+const (
+	ActionHideChirp   = "hide_chirp"
+	ActionSuspendUser = "suspend_user"
+	ActionDismiss     = "dismiss"
+	// ActionUnsuspendUser is taken by an admin on an account, not on a
+	// report, see Unsuspend.
+	ActionUnsuspendUser = "unsuspend_user"
+	// ActionLockLogin is logged by chirpy itself when too many failed logins
+	// lock an account or an address out for a while.
+	ActionLockLogin = "lock_login"
+)
+
+// Report asks the moderators to look at a chirp or an account. Reports are
+// the moderation queue, open ones wait for a moderator to act on them.
+type Report struct {
+	Id int `json:"id"`
+	// ReporterId is who filed the report, 0 when the profanity filter flagged
+	// the chirp.
+	ReporterId int `json:"reporter_id"`
+	// ChirpId is the reported chirp, 0 when an account is reported.
+	ChirpId int `json:"chirp_id,omitempty"`
+	// UserId is the reported account, for a chirp it is the author.
+	UserId    int       `json:"user_id"`
+	Reason    string    `json:"reason"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	// ActionId is the moderation action that closed the report, 0 while it is
+	// open or when the report went away with the chirp's profanity.
+	ActionId int `json:"action_id,omitempty"`
+}
+
+// sameTarget reports whether report and other are about the same chirp, or
+// both about the same account.
+func (report Report) sameTarget(other Report) bool {
+	if report.ChirpId != 0 {
+		return report.ChirpId == other.ChirpId
+	}
+	return other.ChirpId == 0 && report.UserId == other.UserId
+}
+
+// ModerationAction is an entry in the audit log, ModeratorId took Action on
+// the report with ReportId. Actions chirpy takes by itself, see LogAction,
+// have neither and unsuspending has no report.
+type ModerationAction struct {
+	Id          int    `json:"id"`
+	ModeratorId int    `json:"moderator_id"`
+	Action      string `json:"action"`
+	ReportId    int    `json:"report_id"`
+	// ChirpId and UserId are what the report was about.
+	ChirpId   int       `json:"chirp_id,omitempty"`
+	UserId    int       `json:"user_id"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkAction makes sure action is one a moderator can take on report.
+func checkAction(action ModerationAction, report Report) error {
+	switch action.Action {
+	case ActionDismiss, ActionSuspendUser:
+		return nil
+	case ActionHideChirp:
+		if report.ChirpId == 0 {
+			return fmt.Errorf("%s on account report %d: %w", action.Action, report.Id, ErrBadAction)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%q: %w", action.Action, ErrBadAction)
+	}
+}
+
+// resolution is the status reports are closed with by action.
+func resolution(action string) string {
+	if action == ActionDismiss {
+		return ReportDismissed
+	}
+	return ReportActioned
+}
+
+// filterReport is the report the profanity filter files about a chirp it flagged.
+func filterReport(chirp Chirp) Report {
+	return Report{ChirpId: chirp.Id, UserId: chirp.AuthorId, Reason: ReasonProfanity, Status: ReportOpen, CreatedAt: chirp.UpdatedAt}
+}
+
+// ReportQuery selects a page of reports, oldest first so the queue is worked
+// through in the order things were reported.
+type ReportQuery struct {
+	// Status only returns reports with this status, "" returns all of them.
+	Status string
+	// After only returns reports newer than the one with this id.
+	After int
+	// Limit is the page size, 0 is MaxReports.
+	Limit int
+}
+
+func (query ReportQuery) limit() int {
+	if query.Limit <= 0 || query.Limit > MaxReports {
+		return MaxReports
+	}
+	return query.Limit
+}
+
+// ModerationLogQuery selects a page of the audit log, newest first.
+type ModerationLogQuery struct {
+	// Before only returns actions older than the one with this id, 0 starts
+	// at the newest.
+	Before int
+	// Limit is the page size, 0 is MaxReports.
+	Limit int
+}
+
+func (query ModerationLogQuery) limit() int {
+	if query.Limit <= 0 || query.Limit > MaxReports {
+		return MaxReports
+	}
+	return query.Limit
+}
+
+// CreateReport files report, which must be about a user or chirp that
+// exists. A user can only have one open report about the same thing.
+func (tx *Tx) CreateReport(report Report) (Report, error) {
+	if report.ChirpId != 0 {
+		chirp, found := tx.Chirp(report.ChirpId)
+		if !found || chirp.Deleted {
+			return Report{}, fmt.Errorf("chirp %d: %w", report.ChirpId, ErrNotFound)
+		}
+		report.UserId = chirp.AuthorId
+	}
+	if _, found := tx.User(report.UserId); !found {
+		return Report{}, fmt.Errorf("user %d: %w", report.UserId, ErrNotFound)
+	}
+
+	for _, id := range tx.db.index.openReports {
+		open := tx.db.data.Reports[id]
+		if open.ReporterId == report.ReporterId && open.sameTarget(report) {
+			return Report{}, ErrAlreadyReported
+		}
+	}
+
+	report.Status = ReportOpen
+	report.ActionId = 0
+	return insert(tx, reportsTable, report)
+}
+
+func (tx *Tx) Report(id int) (Report, bool) {
+	report, found := tx.db.data.Reports[id]
+	return report, found
+}
+
+// Reports returns the page of reports query asks for.
+func (tx *Tx) Reports(query ReportQuery) []Report {
+	ids := tx.db.index.reports
+	if query.Status == ReportOpen {
+		ids = tx.db.index.openReports
+	}
+	var result []Report
+	for _, id := range ids[searchAfter(ids, query.After):] {
+		if len(result) == query.limit() {
+			break
+		}
+		report := tx.db.data.Reports[id]
+		if query.Status != "" && report.Status != query.Status {
+			continue
+		}
+		result = append(result, report)
+	}
+	return result
+}
+
+// searchAfter returns the position of the first id in the sorted ids that is
+// bigger than after.
+func searchAfter(ids []int, after int) int {
+	i, found := slices.BinarySearch(ids, after)
+	if found {
+		i++
+	}
+	return i
+}
+
+// Moderate takes action on the report with action.ReportId and records it in
+// the audit log. Every open report about the same chirp or account is closed
+// along with it. It returns the logged action and the reports it closed.
+// Only users the moderator outranks can be suspended, otherwise it is
+// ErrOutranked.
+func (tx *Tx) Moderate(action ModerationAction) (ModerationAction, []Report, error) {
+	report, found := tx.Report(action.ReportId)
+	if !found {
+		return ModerationAction{}, nil, fmt.Errorf("report %d: %w", action.ReportId, ErrNotFound)
+	}
+	if report.Status != ReportOpen {
+		return ModerationAction{}, nil, fmt.Errorf("report %d: %w", report.Id, ErrReportClosed)
+	}
+	err := checkAction(action, report)
+	if err != nil {
+		return ModerationAction{}, nil, err
+	}
+	if action.Action == ActionSuspendUser {
+		moderator, _ := tx.User(action.ModeratorId)
+		target, _ := tx.User(report.UserId)
+		if !Outranks(moderator.RoleOf(), target.RoleOf()) {
+			return ModerationAction{}, nil, fmt.Errorf("suspending user %d: %w", report.UserId, ErrOutranked)
+		}
+	}
+
+	action.ChirpId = report.ChirpId
+	action.UserId = report.UserId
+	action, err = insert(tx, moderationTable, action)
+	if err != nil {
+		return ModerationAction{}, nil, err
+	}
+
+	if chirp, found := tx.Chirp(report.ChirpId); found && !chirp.Deleted {
+		chirp.NeedsReview = false
+		chirp.Hidden = chirp.Hidden || action.Action == ActionHideChirp
+		err = tx.UpdateChirp(chirp)
+		if err != nil {
+			return ModerationAction{}, nil, err
+		}
+	}
+	if action.Action == ActionSuspendUser {
+		user, found := tx.User(report.UserId)
+		if found {
+			user.Suspended = true
+			err = tx.UpdateUser(user)
+			if err != nil {
+				return ModerationAction{}, nil, err
+			}
+			_, err = tx.RevokeSessions(user.Id)
+			if err != nil {
+				return ModerationAction{}, nil, err
+			}
+		}
+	}
+
+	closed, err := tx.closeReports(report, resolution(action.Action), action.Id, nil)
+	if err != nil {
+		return ModerationAction{}, nil, err
+	}
+	return action, closed, nil
+}
+
+// Unsuspend lifts the suspension of the user with action.UserId and records
+// it in the audit log as ActionUnsuspendUser taken by action.ModeratorId.
+func (tx *Tx) Unsuspend(action ModerationAction) (ModerationAction, error) {
+	user, found := tx.User(action.UserId)
+	if !found {
+		return ModerationAction{}, fmt.Errorf("user %d: %w", action.UserId, ErrNotFound)
+	}
+	user.Suspended = false
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return ModerationAction{}, err
+	}
+
+	action.Action = ActionUnsuspendUser
+	action.ReportId = 0
+	action.ChirpId = 0
+	return insert(tx, moderationTable, action)
+}
+
+// LogAction adds an action chirpy took by itself, not a moderator on a
+// report, to the audit log.
+func (tx *Tx) LogAction(action ModerationAction) (ModerationAction, error) {
+	action.ModeratorId = 0
+	action.ReportId = 0
+	action.ChirpId = 0
+	return insert(tx, moderationTable, action)
+}
+
+// closeReports closes the open reports about the same thing as report that
+// match, or all of them when match is nil.
+func (tx *Tx) closeReports(report Report, status string, actionId int, match func(Report) bool) ([]Report, error) {
+	var closed []Report
+	for _, id := range slices.Clone(tx.db.index.openReports) {
+		open := tx.db.data.Reports[id]
+		if !open.sameTarget(report) || match != nil && !match(open) {
+			continue
+		}
+		open.Status = status
+		open.ActionId = actionId
+		err := update(tx, reportsTable, open)
+		if err != nil {
+			return nil, err
+		}
+		closed = append(closed, open)
+	}
+	return closed, nil
+}
+
+// ModerationLog returns the page of the audit log query asks for.
+func (tx *Tx) ModerationLog(query ModerationLogQuery) []ModerationAction {
+	ids := tx.db.index.moderationLog
+	var result []ModerationAction
+	for i := len(ids) - 1; i >= 0 && len(result) < query.limit(); i-- {
+		if query.Before != 0 && ids[i] >= query.Before {
+			continue
+		}
+		result = append(result, tx.db.data.Moderation[ids[i]])
+	}
+	return result
+}
+
+func (db *Database) CreateReport(report Report) (Report, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		report, err = tx.CreateReport(report)
+		return err
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+func (db *Database) GetReports(query ReportQuery) ([]Report, error) {
+	var result []Report
+	err := db.View(func(tx *Tx) error {
+		result = tx.Reports(query)
+		return nil
+	})
+	return result, err
+}
+
+func (db *Database) Moderate(action ModerationAction) (ModerationAction, []Report, error) {
+	var closed []Report
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		action, closed, err = tx.Moderate(action)
+		return err
+	})
+	if err != nil {
+		return ModerationAction{}, nil, err
+	}
+	return action, closed, nil
+}
+
+func (db *Database) Unsuspend(action ModerationAction) (ModerationAction, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		action, err = tx.Unsuspend(action)
+		return err
+	})
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	return action, nil
+}
+
+func (db *Database) LogAction(action ModerationAction) (ModerationAction, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		action, err = tx.LogAction(action)
+		return err
+	})
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	return action, nil
+}
+
+func (db *Database) GetModerationLog(query ModerationLogQuery) ([]ModerationAction, error) {
+	var result []ModerationAction
+	err := db.View(func(tx *Tx) error {
+		result = tx.ModerationLog(query)
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// MaxNotifications is the most notifications a NotificationQuery returns at once.
+const MaxNotifications = 100
+
+const (
+	NotificationMention = "mention"
+	NotificationReply   = "reply"
+	NotificationLike    = "like"
+	NotificationFollow  = "follow"
+)
+
+// Notification tells UserId that ActorId did something that involves them,
+// Kind says what. ChirpId is the chirp it happened on, 0 for a follow.
+type Notification struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Kind      string    `json:"kind"`
+	ActorId   int       `json:"actor_id"`
+	ChirpId   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// NotificationQuery selects a page of a user's notifications, newest first.
+type NotificationQuery struct {
+	UserId int
+	// Before only returns notifications older than the one with this id, 0
+	// starts at the newest.
+	Before     int
+	UnreadOnly bool
+	// Limit is the page size, 0 is MaxNotifications.
+	Limit int
+}
+
+func (query NotificationQuery) limit() int {
+	if query.Limit <= 0 || query.Limit > MaxNotifications {
+		return MaxNotifications
+	}
+	return query.Limit
+}
+
+// notify stores notification, users aren't told about their own doings.
+func (tx *Tx) notify(notification Notification) error {
+	if notification.UserId == 0 || notification.UserId == notification.ActorId {
+		return nil
+	}
+	_, err := insert(tx, notificationsTable, notification)
+	return err
+}
+
+// Notifications returns the page of notifications query asks for.
+func (tx *Tx) Notifications(query NotificationQuery) []Notification {
+	ids := tx.db.index.notificationsByUser[query.UserId]
+	var result []Notification
+	for i := len(ids) - 1; i >= 0 && len(result) < query.limit(); i-- {
+		notification := tx.db.data.Notifications[ids[i]]
+		if query.Before != 0 && notification.Id >= query.Before || query.UnreadOnly && notification.Read {
+			continue
+		}
+		result = append(result, notification)
+	}
+	return result
+}
+
+// UnreadNotifications counts the user's unread notifications.
+func (tx *Tx) UnreadNotifications(userId int) int {
+	count := 0
+	for _, id := range tx.db.index.notificationsByUser[userId] {
+		if !tx.db.data.Notifications[id].Read {
+			count++
+		}
+	}
+	return count
+}
+
+// MarkNotificationsRead marks the user's notifications with ids read, or all
+// of them when ids is empty. Ids of someone else's notifications are ignored.
+func (tx *Tx) MarkNotificationsRead(userId int, ids []int) error {
+	for _, id := range slices.Clone(tx.db.index.notificationsByUser[userId]) {
+		notification := tx.db.data.Notifications[id]
+		if notification.Read || len(ids) != 0 && !slices.Contains(ids, id) {
+			continue
+		}
+		notification.Read = true
+		err := update(tx, notificationsTable, notification)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) GetNotifications(query NotificationQuery) ([]Notification, error) {
+	var result []Notification
+	err := db.View(func(tx *Tx) error {
+		result = tx.Notifications(query)
+		return nil
+	})
+	return result, err
+}
+
+func (db *Database) CountUnreadNotifications(userId int) (int, error) {
+	var count int
+	err := db.View(func(tx *Tx) error {
+		count = tx.UnreadNotifications(userId)
+		return nil
+	})
+	return count, err
+}
+
+func (db *Database) MarkNotificationsRead(userId int, ids []int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.MarkNotificationsRead(userId, ids)
+	})
+}
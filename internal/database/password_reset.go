@@ -0,0 +1,164 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrResetPending is returned for a password reset asked for too soon after
+// the last one, which is kept.
+var ErrResetPending = errors.New("password reset pending")
+
+// PasswordReset lets whoever holds its token set a new password for the
+// user, once, until it expires. Only the hash of the token is stored.
+type PasswordReset struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreatePasswordReset stores reset. Resets the user asked for before stop
+// working, only the newest one does, except that one made less than cooldown
+// before reset that hasn't expired is kept and reset is ErrResetPending. So
+// asking again and again can't keep making the link the user has useless.
+func (tx *Tx) CreatePasswordReset(reset PasswordReset, cooldown time.Duration) (PasswordReset, error) {
+	if _, found := tx.User(reset.UserId); !found {
+		return PasswordReset{}, fmt.Errorf("user %d: %w", reset.UserId, ErrNotFound)
+	}
+	for _, id := range tx.db.index.resetsByUser[reset.UserId] {
+		pending := tx.db.data.PasswordResets[id]
+		if pending.ExpiresAt.After(reset.CreatedAt) && reset.CreatedAt.Before(pending.CreatedAt.Add(cooldown)) {
+			return PasswordReset{}, ErrResetPending
+		}
+	}
+	err := tx.removePasswordResets(reset.UserId)
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return insert(tx, passwordResetsTable, reset)
+}
+
+// PasswordReset returns the reset whose token hashes to tokenHash, found is
+// false when there is none. It may have expired.
+func (tx *Tx) PasswordReset(tokenHash string) (PasswordReset, bool) {
+	id, found := tx.db.index.resetsByToken[tokenHash]
+	if !found || tokenHash == "" {
+		return PasswordReset{}, false
+	}
+	return tx.db.data.PasswordResets[id], true
+}
+
+// ResetPassword uses the reset whose token hashes to tokenHash to set the
+// password hash of its user. Every reset of the user is used up and every
+// session revoked, so whoever had the old password is logged out, and a
+// pending email change is dropped with its verifications, so whoever asked
+// for it can't finish it. An unknown, used or expired token is ErrNotFound.
+func (tx *Tx) ResetPassword(tokenHash string, passwordHash []byte, at time.Time) (UserDatabase, error) {
+	reset, found := tx.PasswordReset(tokenHash)
+	if !found {
+		return UserDatabase{}, fmt.Errorf("password reset: %w", ErrNotFound)
+	}
+	if !reset.ExpiresAt.After(at) {
+		return UserDatabase{}, fmt.Errorf("password reset %d expired: %w", reset.Id, ErrNotFound)
+	}
+	user, found := tx.User(reset.UserId)
+	if !found {
+		return UserDatabase{}, fmt.Errorf("user %d: %w", reset.UserId, ErrNotFound)
+	}
+
+	user.PasswordHash = passwordHash
+	user.PendingEmail = ""
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	err = tx.removeEmailVerifications(user.Id)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	err = tx.removePasswordResets(user.Id)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	_, err = tx.RevokeSessions(user.Id)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
+
+// SwapPasswordHash replaces the password hash of the user with newHash, but
+// only while it still is oldHash, so a hash computed from a user loaded
+// earlier doesn't undo changes made since. It reports whether it did.
+func (tx *Tx) SwapPasswordHash(userId int, oldHash []byte, newHash []byte) (bool, error) {
+	user, found := tx.User(userId)
+	if !found || !bytes.Equal(user.PasswordHash, oldHash) {
+		return false, nil
+	}
+	user.PasswordHash = newHash
+	err := tx.UpdateUser(user)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (tx *Tx) removePasswordResets(userId int) error {
+	for _, id := range slices.Clone(tx.db.index.resetsByUser[userId]) {
+		err := remove(tx, passwordResetsTable, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Database) CreatePasswordReset(reset PasswordReset, cooldown time.Duration) (PasswordReset, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		reset, err = tx.CreatePasswordReset(reset, cooldown)
+		return err
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+func (db *Database) SwapPasswordHash(userId int, oldHash []byte, newHash []byte) (bool, error) {
+	var swapped bool
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		swapped, err = tx.SwapPasswordHash(userId, oldHash, newHash)
+		return err
+	})
+	return swapped, err
+}
+
+func (db *Database) GetPasswordReset(tokenHash string) (PasswordReset, bool, error) {
+	var reset PasswordReset
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		reset, found = tx.PasswordReset(tokenHash)
+		return nil
+	})
+	return reset, found, err
+}
+
+func (db *Database) ResetPassword(tokenHash string, passwordHash []byte, at time.Time) (UserDatabase, error) {
+	var user UserDatabase
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		user, err = tx.ResetPassword(tokenHash, passwordHash, at)
+		return err
+	})
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
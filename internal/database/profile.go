@@ -0,0 +1,114 @@
+package database
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrHandleTaken is returned when a user is given a handle another user has.
+var ErrHandleTaken = errors.New("handle taken")
+
+// Profile is the public view of a user, what anyone can see without being
+// that user. It leaves out the email.
+type Profile struct {
+	Id             int    `json:"id"`
+	Handle         string `json:"handle"`
+	DisplayName    string `json:"display_name"`
+	Bio            string `json:"bio"`
+	AvatarUrl      string `json:"avatar_url"`
+	FollowerCount  int    `json:"follower_count"`
+	FollowingCount int    `json:"following_count"`
+}
+
+// Account is the view of a user that the user themselves gets back.
+func (user UserDatabase) Account() User {
+	return User{
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		Handle:        user.Handle,
+		DisplayName:   user.DisplayName,
+		Bio:           user.Bio,
+		AvatarUrl:     user.AvatarUrl,
+		Role:          user.RoleOf(),
+		EmailVerified: user.EmailVerified,
+		PendingEmail:  user.PendingEmail,
+		TOTPEnabled:   user.TOTPEnabled,
+	}
+}
+
+// handleKey is what handles are compared by, they are ascii so lower casing
+// is enough to ignore case.
+func handleKey(handle string) string {
+	return strings.ToLower(handle)
+}
+
+// GetProfile returns the profile of the user with handle, found is false if
+// there is no such user.
+func GetProfile(store Store, handle string) (Profile, bool, error) {
+	user, found, err := store.GetUserByHandle(handle)
+	if err != nil || !found {
+		return Profile{}, false, err
+	}
+
+	followers, err := store.GetFollowers(user.Id)
+	if err != nil {
+		return Profile{}, false, err
+	}
+	following, err := store.GetFollowing(user.Id)
+	if err != nil {
+		return Profile{}, false, err
+	}
+
+	return Profile{
+		Id:             user.Id,
+		Handle:         user.Handle,
+		DisplayName:    user.DisplayName,
+		Bio:            user.Bio,
+		AvatarUrl:      user.AvatarUrl,
+		FollowerCount:  len(followers),
+		FollowingCount: len(following),
+	}, true, nil
+}
+
+func (tx *Tx) UserByHandle(handle string) (UserDatabase, bool) {
+	if handle == "" {
+		return UserDatabase{}, false
+	}
+	id, found := tx.db.index.usersByHandle[handleKey(handle)]
+	if !found {
+		return UserDatabase{}, false
+	}
+	return tx.db.data.Users[id], true
+}
+
+// UserHandles returns the handle of each of the users with userIds that has
+// one.
+func (tx *Tx) UserHandles(userIds []int) map[int]string {
+	result := make(map[int]string)
+	for _, id := range userIds {
+		if user, found := tx.User(id); found && user.Handle != "" {
+			result[id] = user.Handle
+		}
+	}
+	return result
+}
+
+func (db *Database) GetUserByHandle(handle string) (UserDatabase, bool, error) {
+	var user UserDatabase
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		user, found = tx.UserByHandle(handle)
+		return nil
+	})
+	return user, found, err
+}
+
+func (db *Database) GetUserHandles(userIds []int) (map[int]string, error) {
+	var result map[int]string
+	err := db.View(func(tx *Tx) error {
+		result = tx.UserHandles(userIds)
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,299 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// MaxPageSize is the most chirps a ChirpQuery returns at once.
+const MaxPageSize = 1000
+
+var ErrBadCursor = errors.New("bad cursor")
+var ErrBadOrder = errors.New("bad order")
+
+const (
+	OrderById        = "id"
+	OrderByCreatedAt = "created_at"
+)
+
+// ChirpQuery selects one page of chirps. After and Before are cursors from an
+// earlier ChirpPage. After returns the page that follows the cursor, Before
+// returns the page that comes just before it, both in the order asked for.
+type ChirpQuery struct {
+	// AuthorId limits the chirps to one author, 0 is every author.
+	AuthorId int
+	// AuthorIds limits the chirps to any of several authors. It is only used
+	// when AuthorId is 0, and empty is every author.
+	AuthorIds []int
+	// Hashtag limits the chirps to ones tagged with it, as NormalizeHashtag
+	// returns it. Empty is every chirp.
+	Hashtag string
+	// OrderBy is OrderById or OrderByCreatedAt, the default is by id.
+	OrderBy string
+	// Desc orders the chirps newest first.
+	Desc bool
+	// Limit is the page size, 0 is MaxPageSize.
+	Limit  int
+	After  string
+	Before string
+}
+
+// ChirpPage is a page of chirps. NextCursor and PrevCursor are empty when
+// there is nothing more in that direction.
+type ChirpPage struct {
+	Chirps     []Chirp
+	NextCursor string
+	PrevCursor string
+}
+
+// cursor is the position of a chirp in the ordering. It is handed out base64
+// encoded so clients treat it as opaque.
+type cursor struct {
+	Id        int   `json:"id"`
+	CreatedAt int64 `json:"t"`
+}
+
+func cursorOf(chirp Chirp) *cursor {
+	return &cursor{Id: chirp.Id, CreatedAt: toUnix(chirp.CreatedAt)}
+}
+
+func encodeCursor(chirp Chirp) string {
+	data, _ := json.Marshal(cursorOf(chirp))
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (c *cursor) key() chirpKey {
+	return chirpKey{CreatedAt: c.CreatedAt, Id: c.Id}
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	c := cursor{}
+	err = json.Unmarshal(data, &c)
+	if err != nil || c.Id <= 0 {
+		return nil, ErrBadCursor
+	}
+	return &c, nil
+}
+
+func (query ChirpQuery) byTime() (bool, error) {
+	switch query.OrderBy {
+	case "", OrderById:
+		return false, nil
+	case OrderByCreatedAt:
+		return true, nil
+	default:
+		return false, ErrBadOrder
+	}
+}
+
+func (query ChirpQuery) limit() int {
+	if query.Limit <= 0 || query.Limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return query.Limit
+}
+
+// backward is true when only Before is set, the page is then the one that
+// ends right at the cursor, so it is filled walking back from it.
+func (query ChirpQuery) backward() bool {
+	return query.Before != "" && query.After == ""
+}
+
+func (tx *Tx) QueryChirps(query ChirpQuery) (ChirpPage, error) {
+	after, err := decodeCursor(query.After)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	before, err := decodeCursor(query.Before)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	byTime, err := query.byTime()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	keys := tx.queryKeys(query, byTime)
+
+	// lowerBound is the position of the first key at or after c, upperBound
+	// of the first key strictly after it.
+	lowerBound := func(c *cursor) int { return searchKeys(keys, c.key(), byTime) }
+	upperBound := func(c *cursor) int {
+		return sort.Search(len(keys), func(i int) bool { return c.key().less(keys[i], byTime) })
+	}
+
+	// [lo, hi) is the part of keys, which are in ascending order, that falls
+	// between the cursors.
+	lo, hi := 0, len(keys)
+	if query.Desc {
+		if after != nil {
+			hi = lowerBound(after)
+		}
+		if before != nil {
+			lo = upperBound(before)
+		}
+	} else {
+		if after != nil {
+			lo = upperBound(after)
+		}
+		if before != nil {
+			hi = lowerBound(before)
+		}
+	}
+	if lo >= hi {
+		return ChirpPage{}, nil
+	}
+
+	// walk from whichever end of the window the page starts at
+	start, step := lo, 1
+	if query.Desc != query.backward() {
+		start, step = hi-1, -1
+	}
+
+	limit := query.limit()
+	page := ChirpPage{}
+	first, last := start, start
+	for i := start; i >= lo && i < hi && len(page.Chirps) < limit; i += step {
+		page.Chirps = append(page.Chirps, tx.db.data.Chirps[keys[i].Id])
+		last = i
+	}
+	if query.backward() {
+		slices.Reverse(page.Chirps)
+		first, last = last, first
+	}
+
+	// first and last are positions in keys of the first and last chirp of the page
+	hasPrev, hasNext := first > 0, last < len(keys)-1
+	if query.Desc {
+		hasPrev, hasNext = first < len(keys)-1, last > 0
+	}
+	if hasPrev {
+		page.PrevCursor = encodeCursor(page.Chirps[0])
+	}
+	if hasNext {
+		page.NextCursor = encodeCursor(page.Chirps[len(page.Chirps)-1])
+	}
+
+	return page, nil
+}
+
+// queryKeys returns the keys of every chirp the query matches, in order.
+func (tx *Tx) queryKeys(query ChirpQuery, byTime bool) []chirpKey {
+	authorIds := query.AuthorIds
+	if query.AuthorId != 0 {
+		authorIds = []int{query.AuthorId}
+	}
+	if query.Hashtag == "" {
+		if len(authorIds) == 0 {
+			return tx.db.index.chirps.sorted(byTime)
+		}
+		return tx.authorKeys(authorIds, byTime)
+	}
+
+	byTag := tx.db.index.chirpsByTag[query.Hashtag]
+	if byTag == nil {
+		return nil
+	}
+	keys := byTag.sorted(byTime)
+	if len(authorIds) == 0 {
+		return keys
+	}
+	var result []chirpKey
+	for _, key := range keys {
+		if slices.Contains(authorIds, tx.db.data.Chirps[key.Id].AuthorId) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// authorKeys returns the keys of every chirp by the authors, in order.
+func (tx *Tx) authorKeys(authorIds []int, byTime bool) []chirpKey {
+	if len(authorIds) == 1 {
+		if list := tx.db.index.chirpsByAuthor[authorIds[0]]; list != nil {
+			return list.sorted(byTime)
+		}
+		return nil
+	}
+
+	authorIds = slices.Clone(authorIds)
+	slices.Sort(authorIds)
+
+	var keys []chirpKey
+	for _, authorId := range slices.Compact(authorIds) {
+		if list := tx.db.index.chirpsByAuthor[authorId]; list != nil {
+			keys = append(keys, list.sorted(byTime)...)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j], byTime) })
+	return keys
+}
+
+func (db *Database) QueryChirps(query ChirpQuery) (ChirpPage, error) {
+	var page ChirpPage
+	err := db.View(func(tx *Tx) error {
+		var err error
+		page, err = tx.QueryChirps(query)
+		return err
+	})
+	return page, err
+}
+
+func (tx *Tx) SearchChirps(query SearchQuery) (SearchResult, error) {
+	ids, total, err := tx.db.index.search.search(query)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	result := SearchResult{Total: total}
+	for _, id := range ids {
+		result.Chirps = append(result.Chirps, tx.db.data.Chirps[id])
+	}
+	return result, nil
+}
+
+func (db *Database) SearchChirps(query SearchQuery) (SearchResult, error) {
+	var result SearchResult
+	err := db.View(func(tx *Tx) error {
+		var err error
+		result, err = tx.SearchChirps(query)
+		return err
+	})
+	return result, err
+}
+
+// HashtagUses returns a use for every tag of every chirp created since then.
+func (tx *Tx) HashtagUses(since time.Time) []HashtagUse {
+	var result []HashtagUse
+	from := toUnix(since)
+	for tag, byTag := range tx.db.index.chirpsByTag {
+		keys := byTag.byTime
+		start := sort.Search(len(keys), func(i int) bool { return keys[i].CreatedAt >= from })
+		for _, key := range keys[start:] {
+			result = append(result, HashtagUse{Tag: tag, ChirpId: key.Id, CreatedAt: fromUnix(key.CreatedAt)})
+		}
+	}
+	return result
+}
+
+func (db *Database) GetHashtagUses(since time.Time) ([]HashtagUse, error) {
+	var result []HashtagUse
+	err := db.View(func(tx *Tx) error {
+		result = tx.HashtagUses(since)
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,33 @@
+package database
+
+import "slices"
+
+// Roles say what a user is allowed to do. Each role can do everything the
+// roles before it in Roles can.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Roles are the roles from least to most privileged.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// ValidRole reports whether role is one of Roles.
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// Outranks reports whether role is more privileged than other.
+func Outranks(role string, other string) bool {
+	return slices.Index(Roles, role) > slices.Index(Roles, other)
+}
+
+// RoleOf returns the role of user, users from before roles existed have
+// none stored and are RoleUser.
+func (user UserDatabase) RoleOf() string {
+	if user.Role == "" {
+		return RoleUser
+	}
+	return user.Role
+}
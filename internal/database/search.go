@@ -0,0 +1,303 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+)
+
+// MaxSearchResults is the most chirps a SearchQuery returns at once.
+const MaxSearchResults = 100
+
+// MaxSearchLength is the longest the text of a SearchQuery can be in bytes,
+// and MaxSearchTerms the most terms it can have, each term is a lookup in the
+// index.
+const (
+	MaxSearchLength = 256
+	MaxSearchTerms  = 10
+)
+
+var (
+	ErrBadSearch      = errors.New("bad search")
+	ErrSearchTooLarge = errors.New("search is too large")
+)
+
+// SearchQuery finds chirps by the words in their body. Text is a list of
+// terms that must all match, a term is a word, a word ending in * that matches
+// every word starting with it, or a "quoted phrase" whose words must come one
+// after the other. Matching ignores case and punctuation.
+type SearchQuery struct {
+	Text string
+	// AuthorId limits the chirps to one author, 0 is every author.
+	AuthorId int
+	// Since and Until limit the chirps to ones created in [Since, Until), a zero
+	// time leaves that end open.
+	Since time.Time
+	Until time.Time
+	// Limit is the page size, 0 is MaxSearchResults. Offset is how many of the
+	// best matches to skip.
+	Limit  int
+	Offset int
+}
+
+// SearchResult is a page of chirps, best match first, and how many chirps
+// matched in all.
+type SearchResult struct {
+	Chirps []Chirp
+	Total  int
+}
+
+func (query SearchQuery) limit() int {
+	if query.Limit <= 0 || query.Limit > MaxSearchResults {
+		return MaxSearchResults
+	}
+	return query.Limit
+}
+
+// searchTerm is one term of a search, a single word or a phrase.
+type searchTerm struct {
+	words  []string
+	prefix bool
+}
+
+// parseSearch splits the text of a search into terms.
+func parseSearch(text string) ([]searchTerm, error) {
+	if len(text) > MaxSearchLength {
+		return nil, fmt.Errorf("%d bytes: %w", len(text), ErrSearchTooLarge)
+	}
+
+	var terms []searchTerm
+	for i, part := range strings.Split(text, `"`) {
+		// every odd part was between quotes
+		if i%2 == 1 {
+			words := tokenize(part)
+			if len(words) != 0 {
+				terms = append(terms, searchTerm{words: words})
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			words := tokenize(field)
+			for _, word := range words {
+				terms = append(terms, searchTerm{words: []string{word}})
+			}
+			// the * belongs to the last word of the field, "e-mail*" is e and mail*
+			if len(words) != 0 && strings.HasSuffix(field, "*") {
+				terms[len(terms)-1].prefix = true
+			}
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, ErrBadSearch
+	}
+	if len(terms) > MaxSearchTerms {
+		return nil, fmt.Errorf("%d terms: %w", len(terms), ErrSearchTooLarge)
+	}
+	return terms, nil
+}
+
+// tokenize splits text into case folded words, anything that isn't a letter,
+// a number or an apostrophe inside a word separates words.
+func tokenize(text string) []string {
+	// a Caser keeps state so each call needs its own
+	words := strings.FieldsFunc(cases.Fold().String(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+	})
+
+	result := words[:0]
+	for _, word := range words {
+		word = strings.Trim(word, "'")
+		if word != "" {
+			result = append(result, word)
+		}
+	}
+	return result
+}
+
+// searchIndex is an inverted index of chirp bodies. It isn't safe for
+// concurrent use, the store it belongs to guards it.
+type searchIndex struct {
+	// postings holds, for every word, the positions it has in each chirp
+	postings map[string]map[int][]int
+	docs     map[int]searchDoc
+	totalLen int
+}
+
+// searchDoc is what the index keeps about an indexed chirp.
+type searchDoc struct {
+	authorId  int
+	createdAt time.Time
+	words     []string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{postings: make(map[string]map[int][]int), docs: make(map[int]searchDoc)}
+}
+
+// add indexes chirp, replacing what was indexed for it before. Tombstones and
+// rechirps have no words of their own and hidden chirps can't be found, so
+// none of them are indexed.
+func (idx *searchIndex) add(chirp Chirp) {
+	idx.remove(chirp.Id)
+	if chirp.Deleted || chirp.Hidden || chirp.RechirpOf != 0 {
+		return
+	}
+
+	words := tokenize(chirp.Body)
+	if len(words) == 0 {
+		return
+	}
+	for position, word := range words {
+		docs, ok := idx.postings[word]
+		if !ok {
+			docs = make(map[int][]int)
+			idx.postings[word] = docs
+		}
+		docs[chirp.Id] = append(docs[chirp.Id], position)
+	}
+	idx.docs[chirp.Id] = searchDoc{authorId: chirp.AuthorId, createdAt: chirp.CreatedAt, words: words}
+	idx.totalLen += len(words)
+}
+
+func (idx *searchIndex) remove(id int) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, word := range doc.words {
+		docs := idx.postings[word]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, word)
+		}
+	}
+	delete(idx.docs, id)
+	idx.totalLen -= len(doc.words)
+}
+
+// BM25 parameters
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+type searchHit struct {
+	id    int
+	score float64
+}
+
+// search returns the ids of the chirps that match query, best match first
+// with newer chirps winning ties, and how many matched in all.
+func (idx *searchIndex) search(query SearchQuery) ([]int, int, error) {
+	terms, err := parseSearch(query.Text)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// counts holds how often each term occurs in each chirp it occurs in
+	counts := make([]map[int]int, len(terms))
+	for i, term := range terms {
+		counts[i] = idx.match(term)
+	}
+
+	avgLen := float64(idx.totalLen) / math.Max(float64(len(idx.docs)), 1)
+	var hits []searchHit
+	for id := range counts[0] {
+		if !matchesAll(counts, id) {
+			continue
+		}
+		doc := idx.docs[id]
+		if query.AuthorId != 0 && doc.authorId != query.AuthorId ||
+			!query.Since.IsZero() && doc.createdAt.Before(query.Since) ||
+			!query.Until.IsZero() && !doc.createdAt.Before(query.Until) {
+			continue
+		}
+
+		score := 0.0
+		for _, matches := range counts {
+			tf := float64(matches[id])
+			idf := math.Log(1 + (float64(len(idx.docs))-float64(len(matches))+0.5)/(float64(len(matches))+0.5))
+			score += idf * tf * (searchK1 + 1) / (tf + searchK1*(1-searchB+searchB*float64(len(doc.words))/avgLen))
+		}
+		hits = append(hits, searchHit{id: id, score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id > hits[j].id
+	})
+
+	total := len(hits)
+	if query.Offset >= total {
+		return nil, total, nil
+	}
+	hits = hits[query.Offset:min(total, query.Offset+query.limit())]
+	ids := make([]int, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.id
+	}
+	return ids, total, nil
+}
+
+func matchesAll(counts []map[int]int, id int) bool {
+	for _, matches := range counts {
+		if _, ok := matches[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns how many times term occurs in each chirp it occurs in.
+func (idx *searchIndex) match(term searchTerm) map[int]int {
+	result := make(map[int]int)
+	if term.prefix {
+		for word, docs := range idx.postings {
+			if strings.HasPrefix(word, term.words[0]) {
+				for id, positions := range docs {
+					result[id] += len(positions)
+				}
+			}
+		}
+		return result
+	}
+
+	first := idx.postings[term.words[0]]
+	for id, positions := range first {
+		count := 0
+		for _, start := range positions {
+			if idx.phraseAt(id, term.words, start) {
+				count++
+			}
+		}
+		if count != 0 {
+			result[id] = count
+		}
+	}
+	return result
+}
+
+// phraseAt reports whether words occur one after the other in the chirp
+// starting at position start.
+func (idx *searchIndex) phraseAt(id int, words []string, start int) bool {
+	doc := idx.docs[id]
+	if start+len(words) > len(doc.words) {
+		return false
+	}
+	for i, word := range words {
+		if doc.words[start+i] != word {
+			return false
+		}
+	}
+	return true
+}
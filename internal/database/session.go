@@ -0,0 +1,216 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrTokenReused is returned when a refresh token that was already rotated
+// is used again. Only one of the holders of the token can be the device it
+// was issued to, so the session is revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
+// Session is a device a user is logged in on. The device holds a refresh
+// token, which is swapped for a new one every time it is used. Every token
+// a session had is in the same family, reusing one of the old ones revokes
+// the session.
+type Session struct {
+	Id     int `json:"id"`
+	UserId int `json:"user_id"`
+	// TokenHash is the hash of the refresh token the device holds now, the
+	// token itself is never stored.
+	TokenHash string `json:"token_hash"`
+	// Device is what the device called itself when it logged in.
+	Device     string    `json:"device"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the refresh token of the session no longer works at now.
+func (session Session) Expired(now time.Time) bool {
+	return !session.ExpiresAt.After(now)
+}
+
+// RotatedToken is the hash of a refresh token a session used to have, kept
+// to notice when it is used again.
+type RotatedToken struct {
+	Id        int       `json:"id"`
+	SessionId int       `json:"session_id"`
+	TokenHash string    `json:"token_hash"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+func (tx *Tx) Session(id int) (Session, bool) {
+	session, found := tx.db.data.Sessions[id]
+	return session, found
+}
+
+// SessionByToken returns the session whose refresh token hashes to tokenHash.
+func (tx *Tx) SessionByToken(tokenHash string) (Session, bool) {
+	id, found := tx.db.index.sessionsByToken[tokenHash]
+	if !found || tokenHash == "" {
+		return Session{}, false
+	}
+	return tx.db.data.Sessions[id], true
+}
+
+// CreateSession stores session, which logs its user in on another device.
+// The user's expired sessions are cleared out along the way.
+func (tx *Tx) CreateSession(session Session) (Session, error) {
+	if _, found := tx.User(session.UserId); !found {
+		return Session{}, fmt.Errorf("user %d: %w", session.UserId, ErrNotFound)
+	}
+	for _, other := range tx.UserSessions(session.UserId) {
+		if other.Expired(session.CreatedAt) {
+			err := tx.RevokeSession(other.Id)
+			if err != nil {
+				return Session{}, err
+			}
+		}
+	}
+	session.LastUsedAt = session.CreatedAt
+	return insert(tx, sessionsTable, session)
+}
+
+// RotateSession swaps the refresh token hashing to tokenHash for the one
+// hashing to newHash. An unknown or expired token is ErrNotFound. A token
+// the session had before is ErrTokenReused and revokes the session.
+func (tx *Tx) RotateSession(tokenHash string, newHash string, at time.Time) (Session, error) {
+	if id, found := tx.db.index.rotatedTokens[tokenHash]; found && tokenHash != "" {
+		rotated := tx.db.data.RotatedTokens[id]
+		err := tx.RevokeSession(rotated.SessionId)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, fmt.Errorf("session %d: %w", rotated.SessionId, ErrTokenReused)
+	}
+
+	session, found := tx.SessionByToken(tokenHash)
+	if !found {
+		return Session{}, fmt.Errorf("refresh token: %w", ErrNotFound)
+	}
+	if session.Expired(at) {
+		return Session{}, fmt.Errorf("session %d expired: %w", session.Id, ErrNotFound)
+	}
+
+	_, err := insert(tx, rotatedTokensTable, RotatedToken{SessionId: session.Id, TokenHash: tokenHash, RotatedAt: at})
+	if err != nil {
+		return Session{}, err
+	}
+	session.TokenHash = newHash
+	session.LastUsedAt = at
+	err = update(tx, sessionsTable, session)
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// UserSessions returns the sessions of the user, oldest first.
+func (tx *Tx) UserSessions(userId int) []Session {
+	var result []Session
+	for _, id := range tx.db.index.sessionsByUser[userId] {
+		result = append(result, tx.db.data.Sessions[id])
+	}
+	return result
+}
+
+// RevokeSession logs the device of the session out, along with every refresh
+// token it ever had.
+func (tx *Tx) RevokeSession(id int) error {
+	if _, found := tx.Session(id); !found {
+		return fmt.Errorf("session %d: %w", id, ErrNotFound)
+	}
+	for _, rotated := range slices.Clone(tx.db.index.rotatedBySession[id]) {
+		err := remove(tx, rotatedTokensTable, rotated)
+		if err != nil {
+			return err
+		}
+	}
+	return remove(tx, sessionsTable, id)
+}
+
+// RevokeSessions logs the user out everywhere and returns how many sessions
+// that ended.
+func (tx *Tx) RevokeSessions(userId int) (int, error) {
+	sessions := tx.UserSessions(userId)
+	for _, session := range sessions {
+		err := tx.RevokeSession(session.Id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+func (db *Database) CreateSession(session Session) (Session, error) {
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		session, err = tx.CreateSession(session)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (db *Database) RotateSession(tokenHash string, newHash string, at time.Time) (Session, error) {
+	var session Session
+	var reused error
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		session, err = tx.RotateSession(tokenHash, newHash, at)
+		if errors.Is(err, ErrTokenReused) {
+			// the session still has to be revoked, so commit
+			reused = err
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = reused
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (db *Database) GetSessions(userId int) ([]Session, error) {
+	var result []Session
+	err := db.View(func(tx *Tx) error {
+		result = tx.UserSessions(userId)
+		return nil
+	})
+	return result, err
+}
+
+func (db *Database) GetSessionByToken(tokenHash string) (Session, bool, error) {
+	var session Session
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		session, found = tx.SessionByToken(tokenHash)
+		return nil
+	})
+	return session, found, err
+}
+
+func (db *Database) RevokeSession(id int) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.RevokeSession(id)
+	})
+}
+
+func (db *Database) RevokeSessions(userId int) (int, error) {
+	var count int
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		count, err = tx.RevokeSessions(userId)
+		return err
+	})
+	return count, err
+}
@@ -0,0 +1,2294 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteDB is a Store backed by an embedded sqlite database.
+type SQLiteDB struct {
+	db *sql.DB
+
+	// search indexes the chirps in memory, it is built when the database is
+	// opened. Writes to chirps hold mu until search has caught up with them so
+	// it sees changes in the order they were committed.
+	mu     *sync.RWMutex
+	search *searchIndex
+}
+
+// migrations are applied in order, migrations[i] takes the schema from
+// user_version i to i+1. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL UNIQUE,
+		password_hash BLOB NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0,
+		refresh_token TEXT NOT NULL DEFAULT '',
+		token_expires_at INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE chirps (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		body TEXT NOT NULL,
+		author_id INTEGER NOT NULL
+	);
+	CREATE INDEX chirps_author_id ON chirps(author_id);`,
+
+	`CREATE INDEX users_refresh_token ON users(refresh_token) WHERE refresh_token != '';`,
+
+	`ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_created_at ON chirps(created_at, id);
+	CREATE INDEX chirps_author_id_created_at ON chirps(author_id, created_at, id);
+	CREATE TABLE chirp_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		replaced_at INTEGER NOT NULL
+	);
+	CREATE INDEX chirp_revisions_chirp_id ON chirp_revisions(chirp_id, id);`,
+
+	`ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_in_reply_to ON chirps(in_reply_to, id) WHERE in_reply_to != 0;`,
+
+	`CREATE TABLE follows (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		follower_id INTEGER NOT NULL,
+		followee_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		UNIQUE (follower_id, followee_id)
+	);
+	CREATE INDEX follows_followee_id ON follows(followee_id, id);`,
+
+	`ALTER TABLE chirps ADD COLUMN rechirp_of INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+	CREATE UNIQUE INDEX chirps_rechirp_of ON chirps(rechirp_of, author_id) WHERE rechirp_of != 0;
+	CREATE TABLE likes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		chirp_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		UNIQUE (user_id, chirp_id)
+	);
+	CREATE INDEX likes_chirp_id ON likes(chirp_id);`,
+
+	`ALTER TABLE chirps ADD COLUMN hashtags TEXT NOT NULL DEFAULT '';
+	CREATE TABLE chirp_hashtags (
+		tag TEXT NOT NULL,
+		chirp_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (tag, chirp_id)
+	);
+	CREATE INDEX chirp_hashtags_chirp_id ON chirp_hashtags(chirp_id);
+	CREATE INDEX chirp_hashtags_created_at ON chirp_hashtags(created_at);`,
+
+	`ALTER TABLE chirps ADD COLUMN mentions TEXT NOT NULL DEFAULT '';
+	CREATE TABLE notifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		actor_id INTEGER NOT NULL,
+		chirp_id INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		read INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX notifications_user_id ON notifications(user_id, id);
+	CREATE INDEX notifications_chirp_id ON notifications(chirp_id) WHERE chirp_id != 0;`,
+
+	`ALTER TABLE users ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN avatar_url TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX users_handle ON users(handle COLLATE NOCASE) WHERE handle != '';`,
+
+	`ALTER TABLE chirps ADD COLUMN attachments TEXT NOT NULL DEFAULT '';
+	CREATE TABLE media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		chirp_id INTEGER NOT NULL DEFAULT 0,
+		content_type TEXT NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		thumbnail_key TEXT NOT NULL,
+		url TEXT NOT NULL,
+		thumbnail_url TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX media_chirp_id ON media(chirp_id, id) WHERE chirp_id != 0;
+	CREATE INDEX media_owner_id ON media(owner_id, kind);`,
+
+	`ALTER TABLE chirps ADD COLUMN needs_review INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_needs_review ON chirps(id) WHERE needs_review != 0;`,
+
+	`ALTER TABLE chirps ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN suspended INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_hidden ON chirps(id) WHERE hidden != 0;
+	CREATE TABLE reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id INTEGER NOT NULL,
+		chirp_id INTEGER NOT NULL DEFAULT 0,
+		user_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		action_id INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX reports_status ON reports(status, id);
+	CREATE INDEX reports_chirp_id ON reports(chirp_id, user_id) WHERE status = 'open';
+	CREATE TABLE moderation_actions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		moderator_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		report_id INTEGER NOT NULL,
+		chirp_id INTEGER NOT NULL DEFAULT 0,
+		user_id INTEGER NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	);`,
+
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+
+	`DROP INDEX users_refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_token;
+	ALTER TABLE users DROP COLUMN token_expires_at;
+	CREATE TABLE sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		device TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions(user_id, id);
+	CREATE TABLE rotated_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		rotated_at INTEGER NOT NULL
+	);
+	CREATE INDEX rotated_tokens_session_id ON rotated_tokens(session_id);`,
+
+	`CREATE TABLE password_resets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX password_resets_user_id ON password_resets(user_id);`,
+
+	`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN pending_email TEXT NOT NULL DEFAULT '';
+	CREATE TABLE email_verifications (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX email_verifications_user_id ON email_verifications(user_id);`,
+
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX recovery_codes_user_id ON recovery_codes(user_id);`,
+
+	`-- chirps from before hashtags were parsed get theirs, see backfills`,
+}
+
+// backfills are run after the migration with the same index, in the same
+// transaction, for data changes SQL can't make by itself.
+var backfills = map[int]func(tx *sql.Tx) error{
+	17: backfillHashtags,
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite database. path: %s, error: %s", path, err)
+	}
+	// NOTE(Mark): sqlite only allows one writer, one connection keeps us clear of SQLITE_BUSY
+	conn.SetMaxOpenConns(1)
+
+	_, err = conn.Exec("PRAGMA journal_mode = WAL; PRAGMA busy_timeout = 5000;")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	db := &SQLiteDB{db: conn, mu: &sync.RWMutex{}, search: newSearchIndex()}
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	chirps, err := db.queryChirps("SELECT " + chirpColumns + " FROM chirps WHERE deleted = 0 AND hidden = 0 AND rechirp_of = 0")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, chirp := range chirps {
+		db.search.add(chirp)
+	}
+
+	return db, nil
+}
+
+func (db *SQLiteDB) migrate() error {
+	var version int
+	err := db.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err == nil && backfills[version] != nil {
+			err = backfills[version](tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", version+1, err)
+		}
+		// PRAGMA doesn't take bind parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.db.Close()
+}
+
+// inTx runs fn in a sql transaction, committing if it returns nil.
+func (db *SQLiteDB) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const chirpColumns = "id, body, author_id, created_at, updated_at, in_reply_to, reply_count, deleted, rechirp_of, like_count, rechirp_count, hashtags, mentions, attachments, needs_review, hidden"
+
+func scanChirp(row scanner) (Chirp, error) {
+	chirp := Chirp{}
+	var createdAt, updatedAt int64
+	var hashtags, mentions, attachments string
+	err := row.Scan(&chirp.Id, &chirp.Body, &chirp.AuthorId, &createdAt, &updatedAt, &chirp.InReplyTo, &chirp.ReplyCount, &chirp.Deleted,
+		&chirp.RechirpOf, &chirp.LikeCount, &chirp.RechirpCount, &hashtags, &mentions, &attachments, &chirp.NeedsReview, &chirp.Hidden)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = decodeList(attachments, &chirp.Attachments)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = decodeList(hashtags, &chirp.Hashtags)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = decodeList(mentions, &chirp.Mentions)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.CreatedAt = fromUnix(createdAt)
+	chirp.UpdatedAt = fromUnix(updatedAt)
+	return chirp, nil
+}
+
+func (db *SQLiteDB) CreateChirp(chirp Chirp) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	chirp.ReplyCount = 0
+	chirp.Deleted = false
+	chirp.LikeCount = 0
+	chirp.RechirpCount = 0
+	chirp.Hidden = false
+	chirp.Hashtags = ParseHashtags(chirp.Body)
+	chirp.AuthorHandle = ""
+	chirp.Attachments = slices.Clone(chirp.Attachments)
+	err := checkAttachments(chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	err = db.inTx(func(tx *sql.Tx) error {
+		parentAuthorId := 0
+		if chirp.InReplyTo != 0 {
+			err := tx.QueryRow("UPDATE chirps SET reply_count = reply_count + 1 WHERE id = ? AND deleted = 0 AND hidden = 0 AND rechirp_of = 0 RETURNING author_id",
+				chirp.InReplyTo).Scan(&parentAuthorId)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("reply to chirp %d: %w", chirp.InReplyTo, ErrNotFound)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		chirp.Mentions, err = resolveMentions(chirp.Body, userByName(tx))
+		if err != nil {
+			return err
+		}
+		hashtags, err := encodeList(chirp.Hashtags)
+		if err != nil {
+			return err
+		}
+		mentions, err := encodeList(chirp.Mentions)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec("INSERT INTO chirps (body, author_id, created_at, updated_at, in_reply_to, rechirp_of, hashtags, mentions, needs_review) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			chirp.Body, chirp.AuthorId, toUnix(chirp.CreatedAt), toUnix(chirp.UpdatedAt), chirp.InReplyTo, chirp.RechirpOf, hashtags, mentions, chirp.NeedsReview)
+		if err != nil {
+			return err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		chirp.Id = int(id)
+		err = setHashtags(tx, chirp)
+		if err != nil {
+			return err
+		}
+		err = claimMedia(tx, &chirp)
+		if err != nil {
+			return err
+		}
+		if chirp.NeedsReview {
+			_, err = insertReport(tx, filterReport(chirp))
+			if err != nil {
+				return err
+			}
+		}
+		return notifyAll(tx, chirpNotifications(chirp, nil, parentAuthorId, chirp.CreatedAt))
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	db.search.add(chirp)
+	return chirp, nil
+}
+
+func (db *SQLiteDB) EditChirp(chirpId int, body string, editedAt time.Time) (Chirp, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var chirp Chirp
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		chirp, err = scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("chirp %d: %w", chirpId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		revision := revisionOf(chirp, editedAt)
+		_, err = tx.Exec("INSERT INTO chirp_revisions (chirp_id, body, created_at, replaced_at) VALUES (?, ?, ?, ?)",
+			revision.ChirpId, revision.Body, toUnix(revision.CreatedAt), toUnix(revision.ReplacedAt))
+		if err != nil {
+			return err
+		}
+
+		oldMentions := chirp.Mentions
+		chirp.Body = body
+		chirp.Hashtags = ParseHashtags(body)
+		chirp.UpdatedAt = editedAt
+		chirp.Mentions, err = resolveMentions(body, userByName(tx))
+		if err != nil {
+			return err
+		}
+		hashtags, err := encodeList(chirp.Hashtags)
+		if err != nil {
+			return err
+		}
+		mentions, err := encodeList(chirp.Mentions)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE chirps SET body = ?, hashtags = ?, mentions = ?, updated_at = ? WHERE id = ?",
+			chirp.Body, hashtags, mentions, toUnix(chirp.UpdatedAt), chirp.Id)
+		if err != nil {
+			return err
+		}
+		err = setHashtags(tx, chirp)
+		if err != nil {
+			return err
+		}
+		return notifyAll(tx, chirpNotifications(chirp, oldMentions, 0, editedAt))
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	db.search.add(chirp)
+	return chirp, nil
+}
+
+// SetNeedsReview flags a chirp for review or clears the flag, see Tx.SetNeedsReview.
+func (db *SQLiteDB) SetNeedsReview(chirpId int, needsReview bool) (Chirp, error) {
+	var chirp Chirp
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		chirp, err = scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("chirp %d: %w", chirpId, ErrNotFound)
+		}
+		if err != nil || chirp.NeedsReview == needsReview {
+			return err
+		}
+
+		chirp.NeedsReview = needsReview
+		_, err = tx.Exec("UPDATE chirps SET needs_review = ? WHERE id = ?", needsReview, chirpId)
+		if err != nil {
+			return err
+		}
+		if needsReview {
+			_, err = insertReport(tx, filterReport(chirp))
+			return err
+		}
+		_, err = tx.Exec("UPDATE reports SET status = ? WHERE chirp_id = ? AND reporter_id = 0 AND status = ?", ReportDismissed, chirpId, ReportOpen)
+		return err
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (db *SQLiteDB) GetChirpHistory(chirpId int) ([]ChirpRevision, error) {
+	rows, err := db.db.Query("SELECT id, chirp_id, body, created_at, replaced_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY id", chirpId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ChirpRevision
+	for rows.Next() {
+		revision := ChirpRevision{}
+		var createdAt, replacedAt int64
+		err = rows.Scan(&revision.Id, &revision.ChirpId, &revision.Body, &createdAt, &replacedAt)
+		if err != nil {
+			return nil, err
+		}
+		revision.CreatedAt = fromUnix(createdAt)
+		revision.ReplacedAt = fromUnix(replacedAt)
+		result = append(result, revision)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return db.queryChirps("SELECT " + chirpColumns + " FROM chirps WHERE deleted = 0 AND hidden = 0 ORDER BY id")
+}
+
+func (db *SQLiteDB) GetChirpsByAuthor(authorId int) ([]Chirp, error) {
+	return db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE author_id = ? AND deleted = 0 AND hidden = 0 ORDER BY id", authorId)
+}
+
+func (db *SQLiteDB) QueryChirps(query ChirpQuery) (ChirpPage, error) {
+	after, err := decodeCursor(query.After)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	before, err := decodeCursor(query.Before)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	byTime, err := query.byTime()
+	if err != nil {
+		return ChirpPage{}, err
+	}
+
+	// key is what the chirps are ordered by, a cursor is compared against it as a row value
+	key, keyOf := "id", func(c *cursor) []any { return []any{c.Id} }
+	if byTime {
+		key, keyOf = "(created_at, id)", func(c *cursor) []any { return []any{c.CreatedAt, c.Id} }
+	}
+	placeholder := "?"
+	if byTime {
+		placeholder = "(?, ?)"
+	}
+
+	// "later" is the comparison for chirps that come after a cursor in the asked for order
+	later, earlier := ">", "<"
+	if query.Desc {
+		later, earlier = "<", ">"
+	}
+
+	filter := "deleted = 0 AND hidden = 0"
+	var filterArgs []any
+	if query.AuthorId != 0 {
+		filter += " AND author_id = ?"
+		filterArgs = append(filterArgs, query.AuthorId)
+	} else if len(query.AuthorIds) != 0 {
+		filter += " AND author_id IN (?" + strings.Repeat(", ?", len(query.AuthorIds)-1) + ")"
+		for _, authorId := range query.AuthorIds {
+			filterArgs = append(filterArgs, authorId)
+		}
+	}
+	if query.Hashtag != "" {
+		filter += " AND id IN (SELECT chirp_id FROM chirp_hashtags WHERE tag = ?)"
+		filterArgs = append(filterArgs, query.Hashtag)
+	}
+
+	where := filter
+	args := append([]any{}, filterArgs...)
+	if after != nil {
+		where += " AND " + key + " " + later + " " + placeholder
+		args = append(args, keyOf(after)...)
+	}
+	if before != nil {
+		where += " AND " + key + " " + earlier + " " + placeholder
+		args = append(args, keyOf(before)...)
+	}
+
+	ascending := !query.Desc
+	if query.backward() {
+		ascending = !ascending
+	}
+	order := "id ASC"
+	if byTime {
+		order = "created_at ASC, id ASC"
+	}
+	if !ascending {
+		order = strings.ReplaceAll(order, "ASC", "DESC")
+	}
+
+	args = append(args, query.limit())
+	chirps, err := db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE "+where+" ORDER BY "+order+" LIMIT ?", args...)
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	if query.backward() {
+		slices.Reverse(chirps)
+	}
+
+	page := ChirpPage{Chirps: chirps}
+	if len(chirps) == 0 {
+		return page, nil
+	}
+
+	exists := func(comparison string, chirp Chirp) (bool, error) {
+		var found bool
+		err := db.db.QueryRow("SELECT EXISTS (SELECT 1 FROM chirps WHERE "+filter+" AND "+key+" "+comparison+" "+placeholder+")",
+			append(append([]any{}, filterArgs...), keyOf(cursorOf(chirp))...)...).Scan(&found)
+		return found, err
+	}
+
+	hasPrev, err := exists(earlier, chirps[0])
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	if hasPrev {
+		page.PrevCursor = encodeCursor(chirps[0])
+	}
+
+	hasNext, err := exists(later, chirps[len(chirps)-1])
+	if err != nil {
+		return ChirpPage{}, err
+	}
+	if hasNext {
+		page.NextCursor = encodeCursor(chirps[len(chirps)-1])
+	}
+
+	return page, nil
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	var result []Chirp
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		result = append(result, chirp)
+	}
+
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirpById(id int) (Chirp, error) {
+	chirp, err := scanChirp(db.db.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, nil
+	}
+
+	return chirp, err
+}
+
+// GetDescendants returns every reply to the chirp, the replies to those
+// replies and so on, ordered by id.
+func (db *SQLiteDB) GetDescendants(chirpId int) ([]Chirp, error) {
+	return db.queryChirps(`WITH RECURSIVE thread(id) AS (
+			SELECT id FROM chirps WHERE in_reply_to = ?
+			UNION ALL
+			SELECT chirps.id FROM chirps JOIN thread ON chirps.in_reply_to = thread.id
+		)
+		SELECT `+chirpColumns+` FROM chirps WHERE id IN (SELECT id FROM thread) ORDER BY id`, chirpId)
+}
+
+// DeleteChirp deletes the chirp along with its edit history, likes and
+// rechirps. A chirp with replies is turned into a tombstone instead, see
+// Tx.DeleteChirp.
+func (db *SQLiteDB) DeleteChirp(chirpId int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.inTx(func(tx *sql.Tx) error {
+		return deleteChirp(tx, chirpId)
+	})
+	if err != nil {
+		return err
+	}
+
+	// nothing else deleteChirp touches is in the index
+	db.search.remove(chirpId)
+	return nil
+}
+
+func (db *SQLiteDB) SearchChirps(query SearchQuery) (SearchResult, error) {
+	db.mu.RLock()
+	ids, total, err := db.search.search(query)
+	db.mu.RUnlock()
+	if err != nil || len(ids) == 0 {
+		return SearchResult{Total: total}, err
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	chirps, err := db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	byId := make(map[int]Chirp, len(chirps))
+	for _, chirp := range chirps {
+		byId[chirp.Id] = chirp
+	}
+	result := SearchResult{Total: total}
+	for _, id := range ids {
+		// a chirp deleted since the search is left out
+		if chirp, ok := byId[id]; ok {
+			result.Chirps = append(result.Chirps, chirp)
+		}
+	}
+	return result, nil
+}
+
+func deleteChirp(tx *sql.Tx, chirpId int) error {
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM chirp_revisions WHERE chirp_id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM likes WHERE chirp_id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM notifications WHERE chirp_id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM media WHERE chirp_id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	rechirpIds, err := queryIds(tx, "SELECT id FROM chirps WHERE rechirp_of = ?", chirpId)
+	if err != nil {
+		return err
+	}
+	for _, rechirpId := range rechirpIds {
+		err = deleteChirp(tx, rechirpId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if chirp.ReplyCount > 0 {
+		tombstone := tombstoneOf(chirp)
+		_, err = tx.Exec("UPDATE chirps SET body = ?, hashtags = '', mentions = '', attachments = '', needs_review = 0, deleted = ?, like_count = 0 WHERE id = ?", tombstone.Body, tombstone.Deleted, chirpId)
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM chirps WHERE id = ?", chirpId)
+	if err != nil {
+		return err
+	}
+
+	if chirp.RechirpOf != 0 {
+		_, err = tx.Exec("UPDATE chirps SET rechirp_count = rechirp_count - 1 WHERE id = ?", chirp.RechirpOf)
+		return err
+	}
+	if chirp.InReplyTo == 0 {
+		return nil
+	}
+
+	var deleted bool
+	var replyCount int
+	err = tx.QueryRow("UPDATE chirps SET reply_count = reply_count - 1 WHERE id = ? RETURNING deleted, reply_count", chirp.InReplyTo).
+		Scan(&deleted, &replyCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if deleted && replyCount <= 0 {
+		return deleteChirp(tx, chirp.InReplyTo)
+	}
+	return nil
+}
+
+// encodeList stores a list of entities, like Chirp.Hashtags, in a TEXT column.
+func encodeList[T any](list []T) (string, error) {
+	if len(list) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(list)
+	return string(data), err
+}
+
+func decodeList[T any](data string, list *[]T) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), list)
+}
+
+// userByName looks up a mentioned user by email or handle.
+func userByName(tx *sql.Tx) func(name string) (int, bool, error) {
+	return func(name string) (int, bool, error) {
+		var id int
+		err := tx.QueryRow("SELECT id FROM users WHERE email = ? OR handle = ? COLLATE NOCASE ORDER BY email = ? DESC LIMIT 1", name, name, name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, false, nil
+		}
+		return id, err == nil, err
+	}
+}
+
+// claimMedia marks the media attached to chirp, which was just inserted, as
+// being on it and fills its attachments in.
+func claimMedia(tx *sql.Tx, chirp *Chirp) error {
+	if len(chirp.Attachments) == 0 {
+		return nil
+	}
+
+	for i, attachment := range chirp.Attachments {
+		media, err := scanMedia(tx.QueryRow("UPDATE media SET chirp_id = ? WHERE id = ? AND owner_id = ? AND kind = ? AND chirp_id = 0 RETURNING "+mediaColumns,
+			chirp.Id, attachment.Id, chirp.AuthorId, MediaAttachment))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("attachment %d: %w", attachment.Id, ErrBadAttachment)
+		}
+		if err != nil {
+			return err
+		}
+		chirp.Attachments[i] = media.Attachment()
+	}
+
+	attachments, err := encodeList(chirp.Attachments)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE chirps SET attachments = ? WHERE id = ?", attachments, chirp.Id)
+	return err
+}
+
+// backfillHashtags parses the hashtags of chirps written before the hashtags
+// column was added, which were left with none.
+func backfillHashtags(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, body, created_at FROM chirps WHERE deleted = 0 AND hashtags = ''")
+	if err != nil {
+		return err
+	}
+	var chirps []Chirp
+	for rows.Next() {
+		var chirp Chirp
+		var createdAt int64
+		err = rows.Scan(&chirp.Id, &chirp.Body, &createdAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		chirp.CreatedAt = fromUnix(createdAt)
+		chirp.Hashtags = ParseHashtags(chirp.Body)
+		if chirp.Hashtags != nil {
+			chirps = append(chirps, chirp)
+		}
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for _, chirp := range chirps {
+		hashtags, err := encodeList(chirp.Hashtags)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE chirps SET hashtags = ? WHERE id = ?", hashtags, chirp.Id)
+		if err != nil {
+			return err
+		}
+		err = setHashtags(tx, chirp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setHashtags makes chirp_hashtags hold the tags of chirp.
+func setHashtags(tx *sql.Tx, chirp Chirp) error {
+	_, err := tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", chirp.Id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tagsOf(chirp) {
+		_, err = tx.Exec("INSERT INTO chirp_hashtags (tag, chirp_id, created_at) VALUES (?, ?, ?)", tag, chirp.Id, toUnix(chirp.CreatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) GetHashtagUses(since time.Time) ([]HashtagUse, error) {
+	rows, err := db.db.Query(`SELECT tag, chirp_id, created_at FROM chirp_hashtags
+		WHERE created_at >= ? AND chirp_id NOT IN (SELECT id FROM chirps WHERE hidden != 0)`, toUnix(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []HashtagUse
+	for rows.Next() {
+		use := HashtagUse{}
+		var createdAt int64
+		err = rows.Scan(&use.Tag, &use.ChirpId, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		use.CreatedAt = fromUnix(createdAt)
+		result = append(result, use)
+	}
+	return result, rows.Err()
+}
+
+func queryIds(tx *sql.Tx, query string, args ...any) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+	return result, rows.Err()
+}
+
+// likeableChirp returns the chirp with id if it can be liked or rechirped, see Tx.likeable.
+func likeableChirp(tx *sql.Tx, id int) (Chirp, error) {
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) || err == nil && (chirp.Deleted || chirp.Hidden || chirp.RechirpOf != 0) {
+		return Chirp{}, fmt.Errorf("chirp %d: %w", id, ErrNotFound)
+	}
+	return chirp, err
+}
+
+// changeCount runs statement, and when it changed a row adds delta to the
+// column of the chirp with id and to count, the same counter in memory. It
+// reports whether anything changed.
+func changeCount(tx *sql.Tx, id int, column string, count *int, delta int, statement string, args ...any) (bool, error) {
+	result, err := tx.Exec(statement, args...)
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil || changed == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec("UPDATE chirps SET "+column+" = "+column+" + ? WHERE id = ?", delta, id)
+	if err != nil {
+		return false, err
+	}
+	*count += delta
+	return true, nil
+}
+
+func (db *SQLiteDB) LikeChirp(userId int, chirpId int, at time.Time) (Chirp, error) {
+	return db.changeChirp(chirpId, func(tx *sql.Tx, chirp *Chirp) error {
+		liked, err := changeCount(tx, chirp.Id, "like_count", &chirp.LikeCount, 1,
+			"INSERT INTO likes (user_id, chirp_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", userId, chirpId, toUnix(at))
+		if err != nil || !liked {
+			return err
+		}
+		return notify(tx, Notification{UserId: chirp.AuthorId, Kind: NotificationLike, ActorId: userId, ChirpId: chirpId, CreatedAt: at})
+	})
+}
+
+func (db *SQLiteDB) UnlikeChirp(userId int, chirpId int) (Chirp, error) {
+	return db.changeChirp(chirpId, func(tx *sql.Tx, chirp *Chirp) error {
+		_, err := changeCount(tx, chirp.Id, "like_count", &chirp.LikeCount, -1,
+			"DELETE FROM likes WHERE user_id = ? AND chirp_id = ?", userId, chirpId)
+		return err
+	})
+}
+
+// Rechirp reposts the chirp as the user, see Tx.Rechirp.
+func (db *SQLiteDB) Rechirp(userId int, chirpId int, at time.Time) (Chirp, error) {
+	return db.changeChirp(chirpId, func(tx *sql.Tx, chirp *Chirp) error {
+		_, err := changeCount(tx, chirp.Id, "rechirp_count", &chirp.RechirpCount, 1,
+			"INSERT INTO chirps (body, author_id, created_at, updated_at, rechirp_of) VALUES ('', ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			userId, toUnix(at), toUnix(at), chirpId)
+		return err
+	})
+}
+
+func (db *SQLiteDB) Unrechirp(userId int, chirpId int) (Chirp, error) {
+	return db.changeChirp(chirpId, func(tx *sql.Tx, chirp *Chirp) error {
+		rechirpIds, err := queryIds(tx, "SELECT id FROM chirps WHERE rechirp_of = ? AND author_id = ?", chirpId, userId)
+		if err != nil || len(rechirpIds) == 0 {
+			return err
+		}
+		err = deleteChirp(tx, rechirpIds[0])
+		if err != nil {
+			return err
+		}
+		chirp.RechirpCount--
+		return nil
+	})
+}
+
+// changeChirp runs fn on a chirp that can be liked or rechirped in a
+// transaction and returns the chirp as fn left it.
+func (db *SQLiteDB) changeChirp(chirpId int, fn func(tx *sql.Tx, chirp *Chirp) error) (Chirp, error) {
+	var chirp Chirp
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		chirp, err = likeableChirp(tx, chirpId)
+		if err != nil {
+			return err
+		}
+		return fn(tx, &chirp)
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+const followColumns = "id, follower_id, followee_id, created_at"
+
+func scanFollow(row scanner) (Follow, error) {
+	follow := Follow{}
+	var createdAt int64
+	err := row.Scan(&follow.Id, &follow.FollowerId, &follow.FolloweeId, &createdAt)
+	if err != nil {
+		return Follow{}, err
+	}
+	follow.CreatedAt = fromUnix(createdAt)
+	return follow, nil
+}
+
+func (db *SQLiteDB) Follow(followerId int, followeeId int, at time.Time) (Follow, error) {
+	var follow Follow
+	err := db.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", followeeId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", followeeId, ErrNotFound)
+		}
+
+		result, err := tx.Exec("INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+			followerId, followeeId, toUnix(at))
+		if err != nil {
+			return err
+		}
+		followed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if followed != 0 {
+			err = notify(tx, Notification{UserId: followeeId, Kind: NotificationFollow, ActorId: followerId, CreatedAt: at})
+			if err != nil {
+				return err
+			}
+		}
+		follow, err = scanFollow(tx.QueryRow("SELECT "+followColumns+" FROM follows WHERE follower_id = ? AND followee_id = ?", followerId, followeeId))
+		return err
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+	return follow, nil
+}
+
+func (db *SQLiteDB) Unfollow(followerId int, followeeId int) error {
+	_, err := db.db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerId, followeeId)
+	return err
+}
+
+func (db *SQLiteDB) GetFollowers(userId int) ([]Follow, error) {
+	return db.queryFollows("SELECT "+followColumns+" FROM follows WHERE followee_id = ? ORDER BY id", userId)
+}
+
+func (db *SQLiteDB) GetFollowing(userId int) ([]Follow, error) {
+	return db.queryFollows("SELECT "+followColumns+" FROM follows WHERE follower_id = ? ORDER BY id", userId)
+}
+
+func (db *SQLiteDB) queryFollows(query string, args ...any) ([]Follow, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Follow
+	for rows.Next() {
+		follow, err := scanFollow(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, follow)
+	}
+	return result, rows.Err()
+}
+
+// notify stores notification, see Tx.notify.
+func notify(tx *sql.Tx, notification Notification) error {
+	if notification.UserId == 0 || notification.UserId == notification.ActorId {
+		return nil
+	}
+	_, err := tx.Exec("INSERT INTO notifications (user_id, kind, actor_id, chirp_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		notification.UserId, notification.Kind, notification.ActorId, notification.ChirpId, toUnix(notification.CreatedAt))
+	return err
+}
+
+func notifyAll(tx *sql.Tx, notifications []Notification) error {
+	for _, notification := range notifications {
+		err := notify(tx, notification)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) GetNotifications(query NotificationQuery) ([]Notification, error) {
+	where := "user_id = ?"
+	args := []any{query.UserId}
+	if query.Before != 0 {
+		where += " AND id < ?"
+		args = append(args, query.Before)
+	}
+	if query.UnreadOnly {
+		where += " AND read = 0"
+	}
+	args = append(args, query.limit())
+
+	rows, err := db.db.Query("SELECT id, user_id, kind, actor_id, chirp_id, created_at, read FROM notifications WHERE "+where+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Notification
+	for rows.Next() {
+		notification := Notification{}
+		var createdAt int64
+		err = rows.Scan(&notification.Id, &notification.UserId, &notification.Kind, &notification.ActorId, &notification.ChirpId, &createdAt, &notification.Read)
+		if err != nil {
+			return nil, err
+		}
+		notification.CreatedAt = fromUnix(createdAt)
+		result = append(result, notification)
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) CountUnreadNotifications(userId int) (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read = 0", userId).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationsRead marks the user's notifications with ids read, see
+// Tx.MarkNotificationsRead.
+func (db *SQLiteDB) MarkNotificationsRead(userId int, ids []int) error {
+	if len(ids) == 0 {
+		_, err := db.db.Exec("UPDATE notifications SET read = 1 WHERE user_id = ? AND read = 0", userId)
+		return err
+	}
+
+	args := []any{userId}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := db.db.Exec("UPDATE notifications SET read = 1 WHERE user_id = ? AND id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	return err
+}
+
+const mediaColumns = "id, owner_id, kind, chirp_id, content_type, width, height, key, thumbnail_key, url, thumbnail_url, created_at"
+
+func scanMedia(row scanner) (Media, error) {
+	media := Media{}
+	var createdAt int64
+	err := row.Scan(&media.Id, &media.OwnerId, &media.Kind, &media.ChirpId, &media.ContentType, &media.Width, &media.Height,
+		&media.Key, &media.ThumbnailKey, &media.Url, &media.ThumbnailUrl, &createdAt)
+	if err != nil {
+		return Media{}, err
+	}
+	media.CreatedAt = fromUnix(createdAt)
+	return media, nil
+}
+
+func insertMedia(tx *sql.Tx, media Media) (Media, error) {
+	result, err := tx.Exec(`INSERT INTO media (owner_id, kind, chirp_id, content_type, width, height, key, thumbnail_key, url, thumbnail_url, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		media.OwnerId, media.Kind, media.ChirpId, media.ContentType, media.Width, media.Height, media.Key, media.ThumbnailKey,
+		media.Url, media.ThumbnailUrl, toUnix(media.CreatedAt))
+	if err != nil {
+		return Media{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Media{}, err
+	}
+	media.Id = int(id)
+	return media, nil
+}
+
+func (db *SQLiteDB) CreateMedia(media Media) (Media, error) {
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		media, err = insertMedia(tx, media)
+		return err
+	})
+	return media, err
+}
+
+func (db *SQLiteDB) GetChirpMedia(chirpId int) ([]Media, error) {
+	rows, err := db.db.Query("SELECT "+mediaColumns+" FROM media WHERE chirp_id = ? ORDER BY id", chirpId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Media
+	for rows.Next() {
+		media, err := scanMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, media)
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) RemoveUnattachedMedia(cutoff time.Time) ([]Media, error) {
+	rows, err := db.db.Query("DELETE FROM media WHERE kind = ? AND chirp_id = 0 AND created_at < ? RETURNING "+mediaColumns,
+		MediaAttachment, toUnix(cutoff))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removed []Media
+	for rows.Next() {
+		media, err := scanMedia(rows)
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, media)
+	}
+	return removed, rows.Err()
+}
+
+func (db *SQLiteDB) SetAvatar(userId int, avatar Media) (Media, []Media, error) {
+	var replaced []Media
+	err := db.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query("DELETE FROM media WHERE owner_id = ? AND kind = ? RETURNING "+mediaColumns, userId, MediaAvatar)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			media, err := scanMedia(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			replaced = append(replaced, media)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		avatar.OwnerId = userId
+		avatar.Kind = MediaAvatar
+		avatar, err = insertMedia(tx, avatar)
+		if err != nil {
+			return err
+		}
+		result, err := tx.Exec("UPDATE users SET avatar_url = ? WHERE id = ?", avatar.Url, userId)
+		if err != nil {
+			return err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		return Media{}, nil, err
+	}
+	return avatar, replaced, nil
+}
+
+const reportColumns = "id, reporter_id, chirp_id, user_id, reason, status, created_at, action_id"
+
+func scanReport(row scanner) (Report, error) {
+	report := Report{}
+	var createdAt int64
+	err := row.Scan(&report.Id, &report.ReporterId, &report.ChirpId, &report.UserId, &report.Reason, &report.Status, &createdAt, &report.ActionId)
+	if err != nil {
+		return Report{}, err
+	}
+	report.CreatedAt = fromUnix(createdAt)
+	return report, nil
+}
+
+func insertReport(tx *sql.Tx, report Report) (Report, error) {
+	result, err := tx.Exec("INSERT INTO reports (reporter_id, chirp_id, user_id, reason, status, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		report.ReporterId, report.ChirpId, report.UserId, report.Reason, report.Status, toUnix(report.CreatedAt))
+	if err != nil {
+		return Report{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Report{}, err
+	}
+	report.Id = int(id)
+	return report, nil
+}
+
+// CreateReport files report, see Tx.CreateReport.
+func (db *SQLiteDB) CreateReport(report Report) (Report, error) {
+	err := db.inTx(func(tx *sql.Tx) error {
+		if report.ChirpId != 0 {
+			err := tx.QueryRow("SELECT author_id FROM chirps WHERE id = ? AND deleted = 0", report.ChirpId).Scan(&report.UserId)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("chirp %d: %w", report.ChirpId, ErrNotFound)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", report.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", report.UserId, ErrNotFound)
+		}
+
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM reports WHERE status = ? AND reporter_id = ? AND chirp_id = ? AND user_id = ?)",
+			ReportOpen, report.ReporterId, report.ChirpId, report.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrAlreadyReported
+		}
+
+		report.Status = ReportOpen
+		report.ActionId = 0
+		report, err = insertReport(tx, report)
+		return err
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+func (db *SQLiteDB) GetReports(query ReportQuery) ([]Report, error) {
+	where := "id > ?"
+	args := []any{query.After}
+	if query.Status != "" {
+		where += " AND status = ?"
+		args = append(args, query.Status)
+	}
+	args = append(args, query.limit())
+
+	rows, err := db.db.Query("SELECT "+reportColumns+" FROM reports WHERE "+where+" ORDER BY id LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, report)
+	}
+	return result, rows.Err()
+}
+
+// LogAction adds an action chirpy took by itself to the audit log, see
+// Tx.LogAction.
+func (db *SQLiteDB) LogAction(action ModerationAction) (ModerationAction, error) {
+	action.ModeratorId = 0
+	action.ReportId = 0
+	action.ChirpId = 0
+	result, err := db.db.Exec("INSERT INTO moderation_actions (moderator_id, action, report_id, chirp_id, user_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		action.ModeratorId, action.Action, action.ReportId, action.ChirpId, action.UserId, action.Note, toUnix(action.CreatedAt))
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	action.Id = int(id)
+	return action, nil
+}
+
+// roleOf returns the role of the user with userId, RoleUser when there is no
+// such user.
+func roleOf(tx *sql.Tx, userId int) (string, error) {
+	var user UserDatabase
+	err := tx.QueryRow("SELECT role FROM users WHERE id = ?", userId).Scan(&user.Role)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	return user.RoleOf(), nil
+}
+
+// Unsuspend lifts a suspension, see Tx.Unsuspend.
+func (db *SQLiteDB) Unsuspend(action ModerationAction) (ModerationAction, error) {
+	action.Action = ActionUnsuspendUser
+	action.ReportId = 0
+	action.ChirpId = 0
+	err := db.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE users SET suspended = 0 WHERE id = ?", action.UserId)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("user %d: %w", action.UserId, ErrNotFound)
+		}
+
+		result, err = tx.Exec("INSERT INTO moderation_actions (moderator_id, action, report_id, chirp_id, user_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			action.ModeratorId, action.Action, action.ReportId, action.ChirpId, action.UserId, action.Note, toUnix(action.CreatedAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		action.Id = int(id)
+		return nil
+	})
+	if err != nil {
+		return ModerationAction{}, err
+	}
+	return action, nil
+}
+
+// Moderate takes action on a report, see Tx.Moderate.
+func (db *SQLiteDB) Moderate(action ModerationAction) (ModerationAction, []Report, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var closed []Report
+	// moderated is the reported chirp after the action, search has to catch up with it
+	var moderated *Chirp
+	err := db.inTx(func(tx *sql.Tx) error {
+		report, err := scanReport(tx.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", action.ReportId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("report %d: %w", action.ReportId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if report.Status != ReportOpen {
+			return fmt.Errorf("report %d: %w", report.Id, ErrReportClosed)
+		}
+		err = checkAction(action, report)
+		if err != nil {
+			return err
+		}
+		if action.Action == ActionSuspendUser {
+			moderatorRole, err := roleOf(tx, action.ModeratorId)
+			if err != nil {
+				return err
+			}
+			targetRole, err := roleOf(tx, report.UserId)
+			if err != nil {
+				return err
+			}
+			if !Outranks(moderatorRole, targetRole) {
+				return fmt.Errorf("suspending user %d: %w", report.UserId, ErrOutranked)
+			}
+		}
+
+		action.ChirpId = report.ChirpId
+		action.UserId = report.UserId
+		result, err := tx.Exec("INSERT INTO moderation_actions (moderator_id, action, report_id, chirp_id, user_id, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			action.ModeratorId, action.Action, action.ReportId, action.ChirpId, action.UserId, action.Note, toUnix(action.CreatedAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		action.Id = int(id)
+
+		if report.ChirpId != 0 {
+			chirp, err := scanChirp(tx.QueryRow("UPDATE chirps SET needs_review = 0, hidden = hidden OR ? WHERE id = ? AND deleted = 0 RETURNING "+chirpColumns,
+				action.Action == ActionHideChirp, report.ChirpId))
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if err == nil {
+				moderated = &chirp
+			}
+		}
+		if action.Action == ActionSuspendUser {
+			_, err = tx.Exec("UPDATE users SET suspended = 1 WHERE id = ?", report.UserId)
+			if err != nil {
+				return err
+			}
+			_, err = revokeSessions(tx, "user_id = ?", report.UserId)
+			if err != nil {
+				return err
+			}
+		}
+
+		target := "chirp_id = ?"
+		args := []any{report.ChirpId}
+		if report.ChirpId == 0 {
+			target = "chirp_id = 0 AND user_id = ?"
+			args = []any{report.UserId}
+		}
+		rows, err := tx.Query("UPDATE reports SET status = ?, action_id = ? WHERE status = ? AND "+target+" RETURNING "+reportColumns,
+			append([]any{resolution(action.Action), action.Id, ReportOpen}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			report, err := scanReport(rows)
+			if err != nil {
+				return err
+			}
+			closed = append(closed, report)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return ModerationAction{}, nil, err
+	}
+
+	if moderated != nil {
+		db.search.add(*moderated)
+	}
+	slices.SortFunc(closed, func(a, b Report) int { return a.Id - b.Id })
+	return action, closed, nil
+}
+
+func (db *SQLiteDB) GetModerationLog(query ModerationLogQuery) ([]ModerationAction, error) {
+	where := ""
+	var args []any
+	if query.Before != 0 {
+		where = " WHERE id < ?"
+		args = append(args, query.Before)
+	}
+	args = append(args, query.limit())
+
+	rows, err := db.db.Query("SELECT id, moderator_id, action, report_id, chirp_id, user_id, note, created_at FROM moderation_actions"+where+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ModerationAction
+	for rows.Next() {
+		action := ModerationAction{}
+		var createdAt int64
+		err = rows.Scan(&action.Id, &action.ModeratorId, &action.Action, &action.ReportId, &action.ChirpId, &action.UserId, &action.Note, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		action.CreatedAt = fromUnix(createdAt)
+		result = append(result, action)
+	}
+	return result, rows.Err()
+}
+
+const sessionColumns = "id, user_id, token_hash, device, created_at, last_used_at, expires_at"
+
+func scanSession(row scanner) (Session, error) {
+	session := Session{}
+	var createdAt, lastUsedAt, expiresAt int64
+	err := row.Scan(&session.Id, &session.UserId, &session.TokenHash, &session.Device, &createdAt, &lastUsedAt, &expiresAt)
+	if err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt = fromUnix(createdAt)
+	session.LastUsedAt = fromUnix(lastUsedAt)
+	session.ExpiresAt = fromUnix(expiresAt)
+	return session, nil
+}
+
+// CreateSession stores session, see Tx.CreateSession.
+func (db *SQLiteDB) CreateSession(session Session) (Session, error) {
+	err := db.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", session.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", session.UserId, ErrNotFound)
+		}
+		_, err = revokeSessions(tx, "user_id = ? AND expires_at <= ?", session.UserId, toUnix(session.CreatedAt))
+		if err != nil {
+			return err
+		}
+
+		session.LastUsedAt = session.CreatedAt
+		result, err := tx.Exec("INSERT INTO sessions (user_id, token_hash, device, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+			session.UserId, session.TokenHash, session.Device, toUnix(session.CreatedAt), toUnix(session.LastUsedAt), toUnix(session.ExpiresAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		session.Id = int(id)
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// RotateSession swaps a refresh token for a new one, see Tx.RotateSession.
+func (db *SQLiteDB) RotateSession(tokenHash string, newHash string, at time.Time) (Session, error) {
+	var session Session
+	var reused error
+	err := db.inTx(func(tx *sql.Tx) error {
+		var sessionId int
+		err := tx.QueryRow("SELECT session_id FROM rotated_tokens WHERE token_hash = ?", tokenHash).Scan(&sessionId)
+		if err == nil {
+			_, err = revokeSessions(tx, "id = ?", sessionId)
+			if err != nil {
+				return err
+			}
+			// the session still has to be revoked, so commit
+			reused = fmt.Errorf("session %d: %w", sessionId, ErrTokenReused)
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		session, err = scanSession(tx.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ?", tokenHash))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("refresh token: %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if session.Expired(at) {
+			return fmt.Errorf("session %d expired: %w", session.Id, ErrNotFound)
+		}
+
+		_, err = tx.Exec("INSERT INTO rotated_tokens (session_id, token_hash, rotated_at) VALUES (?, ?, ?)", session.Id, tokenHash, toUnix(at))
+		if err != nil {
+			return err
+		}
+		session.TokenHash = newHash
+		session.LastUsedAt = at
+		_, err = tx.Exec("UPDATE sessions SET token_hash = ?, last_used_at = ? WHERE id = ?", session.TokenHash, toUnix(session.LastUsedAt), session.Id)
+		return err
+	})
+	if err == nil {
+		err = reused
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+func (db *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := db.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? ORDER BY id", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, session)
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) GetSessionByToken(tokenHash string) (Session, bool, error) {
+	session, err := scanSession(db.db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE token_hash = ?", tokenHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, err
+	}
+	return session, true, nil
+}
+
+func (db *SQLiteDB) RevokeSession(id int) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		count, err := revokeSessions(tx, "id = ?", id)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("session %d: %w", id, ErrNotFound)
+		}
+		return nil
+	})
+}
+
+func (db *SQLiteDB) RevokeSessions(userId int) (int, error) {
+	var count int
+	err := db.inTx(func(tx *sql.Tx) error {
+		var err error
+		count, err = revokeSessions(tx, "user_id = ?", userId)
+		return err
+	})
+	return count, err
+}
+
+// revokeSessions deletes the sessions matching where along with their
+// rotated tokens, and returns how many there were.
+func revokeSessions(tx *sql.Tx, where string, args ...any) (int, error) {
+	_, err := tx.Exec("DELETE FROM rotated_tokens WHERE session_id IN (SELECT id FROM sessions WHERE "+where+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM sessions WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+// CreatePasswordReset stores reset, see Tx.CreatePasswordReset.
+func (db *SQLiteDB) CreatePasswordReset(reset PasswordReset, cooldown time.Duration) (PasswordReset, error) {
+	err := db.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", reset.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", reset.UserId, ErrNotFound)
+		}
+		var pending bool
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM password_resets WHERE user_id = ? AND expires_at > ? AND created_at > ?)",
+			reset.UserId, toUnix(reset.CreatedAt), toUnix(reset.CreatedAt.Add(-cooldown))).Scan(&pending)
+		if err != nil {
+			return err
+		}
+		if pending {
+			return ErrResetPending
+		}
+		_, err = tx.Exec("DELETE FROM password_resets WHERE user_id = ?", reset.UserId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+			reset.UserId, reset.TokenHash, toUnix(reset.CreatedAt), toUnix(reset.ExpiresAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		reset.Id = int(id)
+		return nil
+	})
+	if err != nil {
+		return PasswordReset{}, err
+	}
+	return reset, nil
+}
+
+// GetPasswordReset returns the reset whose token hashes to tokenHash.
+func (db *SQLiteDB) GetPasswordReset(tokenHash string) (PasswordReset, bool, error) {
+	var reset PasswordReset
+	var createdAt, expiresAt int64
+	err := db.db.QueryRow("SELECT id, user_id, token_hash, created_at, expires_at FROM password_resets WHERE token_hash = ?", tokenHash).
+		Scan(&reset.Id, &reset.UserId, &reset.TokenHash, &createdAt, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PasswordReset{}, false, nil
+	}
+	if err != nil {
+		return PasswordReset{}, false, err
+	}
+	reset.CreatedAt = fromUnix(createdAt)
+	reset.ExpiresAt = fromUnix(expiresAt)
+	return reset, true, nil
+}
+
+// SwapPasswordHash replaces a password hash that hasn't changed, see
+// Tx.SwapPasswordHash.
+func (db *SQLiteDB) SwapPasswordHash(userId int, oldHash []byte, newHash []byte) (bool, error) {
+	result, err := db.db.Exec("UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?", newHash, userId, oldHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// ResetPassword sets a new password with a reset, see Tx.ResetPassword.
+func (db *SQLiteDB) ResetPassword(tokenHash string, passwordHash []byte, at time.Time) (UserDatabase, error) {
+	var user UserDatabase
+	err := db.inTx(func(tx *sql.Tx) error {
+		var resetId, userId int
+		var expiresAt int64
+		err := tx.QueryRow("SELECT id, user_id, expires_at FROM password_resets WHERE token_hash = ?", tokenHash).Scan(&resetId, &userId, &expiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("password reset: %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if !fromUnix(expiresAt).After(at) {
+			return fmt.Errorf("password reset %d expired: %w", resetId, ErrNotFound)
+		}
+
+		user, err = scanUser(tx.QueryRow("UPDATE users SET password_hash = ?, pending_email = '' WHERE id = ? RETURNING "+userColumns, passwordHash, userId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM password_resets WHERE user_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		_, err = revokeSessions(tx, "user_id = ?", userId)
+		return err
+	})
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
+
+// CreateEmailVerification stores verification, see Tx.CreateEmailVerification.
+func (db *SQLiteDB) CreateEmailVerification(verification EmailVerification) (EmailVerification, error) {
+	err := db.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", verification.UserId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", verification.UserId, ErrNotFound)
+		}
+		_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", verification.UserId)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("INSERT INTO email_verifications (user_id, email, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+			verification.UserId, verification.Email, verification.TokenHash, toUnix(verification.CreatedAt), toUnix(verification.ExpiresAt))
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		verification.Id = int(id)
+		return nil
+	})
+	if err != nil {
+		return EmailVerification{}, err
+	}
+	return verification, nil
+}
+
+// VerifyEmail confirms an email with a verification, see Tx.VerifyEmail.
+func (db *SQLiteDB) VerifyEmail(tokenHash string, at time.Time) (UserDatabase, error) {
+	var user UserDatabase
+	err := db.inTx(func(tx *sql.Tx) error {
+		var verificationId, userId int
+		var email string
+		var expiresAt int64
+		err := tx.QueryRow("SELECT id, user_id, email, expires_at FROM email_verifications WHERE token_hash = ?", tokenHash).
+			Scan(&verificationId, &userId, &email, &expiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("email verification: %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if !fromUnix(expiresAt).After(at) {
+			return fmt.Errorf("email verification %d expired: %w", verificationId, ErrNotFound)
+		}
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		switch email {
+		case user.Email:
+		case user.PendingEmail:
+			var taken bool
+			err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ? AND id != ?)", email, user.Id).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrEmailTaken
+			}
+			user.Email = user.PendingEmail
+			user.PendingEmail = ""
+		default:
+			return fmt.Errorf("email verification %d is for an old address: %w", verificationId, ErrNotFound)
+		}
+		user.EmailVerified = true
+
+		_, err = tx.Exec("UPDATE users SET email = ?, pending_email = ?, email_verified = 1 WHERE id = ?", user.Email, user.PendingEmail, user.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", user.Id)
+		return err
+	})
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
+
+// EnableTOTP turns two factor login on, see Tx.EnableTOTP.
+func (db *SQLiteDB) EnableTOTP(userId int, step int64, codeHashes []string, at time.Time) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ? AND totp_secret != ''", step, userId)
+		if err != nil {
+			return err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("user %d with a totp secret: %w", userId, ErrNotFound)
+		}
+		return setRecoveryCodes(tx, userId, codeHashes, at)
+	})
+}
+
+// DisableTOTP turns two factor login off, see Tx.DisableTOTP.
+func (db *SQLiteDB) DisableTOTP(userId int) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userId)
+		if err != nil {
+			return err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		return setRecoveryCodes(tx, userId, nil, time.Time{})
+	})
+}
+
+// UseTOTPStep records the step of a code used, see Tx.UseTOTPStep.
+func (db *SQLiteDB) UseTOTPStep(userId int, step int64) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		var lastStep int64
+		err := tx.QueryRow("SELECT totp_last_step FROM users WHERE id = ?", userId).Scan(&lastStep)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if step <= lastStep {
+			return ErrCodeUsed
+		}
+		_, err = tx.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, userId)
+		return err
+	})
+}
+
+// SetRecoveryCodes replaces the recovery codes of a user, see
+// Tx.SetRecoveryCodes.
+func (db *SQLiteDB) SetRecoveryCodes(userId int, codeHashes []string, at time.Time) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("user %d: %w", userId, ErrNotFound)
+		}
+		return setRecoveryCodes(tx, userId, codeHashes, at)
+	})
+}
+
+func setRecoveryCodes(tx *sql.Tx, userId int, codeHashes []string, at time.Time) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES (?, ?, ?)", userId, hash, toUnix(at))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode uses up a recovery code, see Tx.UseRecoveryCode.
+func (db *SQLiteDB) UseRecoveryCode(userId int, codeHash string) (int, error) {
+	var left int
+	err := db.inTx(func(tx *sql.Tx) error {
+		var id int
+		err := tx.QueryRow("SELECT id FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userId, codeHash).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("recovery code: %w", ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userId).Scan(&left)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return left, nil
+}
+
+// RecoveryCodesLeft returns how many recovery codes the user has left.
+func (db *SQLiteDB) RecoveryCodesLeft(userId int) (int, error) {
+	var left int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?", userId).Scan(&left)
+	return left, err
+}
+
+func (db *SQLiteDB) CreateUser(email string, passwordHash []byte) (User, error) {
+	return db.CreateUserWithProfile(UserDatabase{Email: email, PasswordHash: passwordHash})
+}
+
+func (db *SQLiteDB) CreateUserWithProfile(user UserDatabase) (User, error) {
+	var created User
+	err := db.inTx(func(tx *sql.Tx) error {
+		if user.Handle != "" {
+			var taken bool
+			err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE handle = ? COLLATE NOCASE)", user.Handle).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrHandleTaken
+			}
+		}
+
+		stored, err := scanUser(tx.QueryRow(`INSERT INTO users (email, password_hash, handle, display_name, bio, avatar_url)
+			VALUES (?, ?, ?, ?, ?, ?) RETURNING `+userColumns,
+			user.Email, user.PasswordHash, user.Handle, user.DisplayName, user.Bio, user.AvatarUrl))
+		if err != nil {
+			return err
+		}
+		created = stored.Account()
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return created, nil
+}
+
+func (db *SQLiteDB) UpdateUser(userChange UserDatabase) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if userChange.Handle != "" {
+			var taken bool
+			err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE handle = ? COLLATE NOCASE AND id != ?)",
+				userChange.Handle, userChange.Id).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrHandleTaken
+			}
+		}
+
+		result, err := tx.Exec(`UPDATE users SET email = ?, password_hash = ?, is_chirpy_red = ?,
+			handle = ?, display_name = ?, bio = ?, avatar_url = ?, suspended = ?, role = ?,
+			email_verified = ?, pending_email = ?, totp_secret = ?, totp_enabled = ?, totp_last_step = ?
+			WHERE id = ?`,
+			userChange.Email, userChange.PasswordHash, userChange.IsChirpyRed, userChange.Handle,
+			userChange.DisplayName, userChange.Bio, userChange.AvatarUrl, userChange.Suspended,
+			userChange.RoleOf(), userChange.EmailVerified, userChange.PendingEmail,
+			userChange.TOTPSecret, userChange.TOTPEnabled, userChange.TOTPLastStep, userChange.Id)
+		if err != nil {
+			return err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (db *SQLiteDB) UserExist(email string) (bool, error) {
+	_, found, err := db.getUserWhere("email = ?", email)
+	return found, err
+}
+
+func (db *SQLiteDB) GetUser(email string) (UserDatabase, error) {
+	user, _, err := db.getUserWhere("email = ?", email)
+	if err != nil {
+		return UserDatabase{}, fmt.Errorf("failed to get users to check if a user exist. %s", err)
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) GetUserById(id int) (UserDatabase, bool, error) {
+	return db.getUserWhere("id = ?", id)
+}
+
+func (db *SQLiteDB) GetUserByHandle(handle string) (UserDatabase, bool, error) {
+	if handle == "" {
+		return UserDatabase{}, false, nil
+	}
+	return db.getUserWhere("handle = ? COLLATE NOCASE", handle)
+}
+
+func (db *SQLiteDB) GetUserHandles(userIds []int) (map[int]string, error) {
+	result := make(map[int]string)
+	if len(userIds) == 0 {
+		return result, nil
+	}
+
+	args := make([]any, len(userIds))
+	for i, id := range userIds {
+		args[i] = id
+	}
+	rows, err := db.db.Query("SELECT id, handle FROM users WHERE handle != '' AND id IN (?"+strings.Repeat(", ?", len(userIds)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var handle string
+		err = rows.Scan(&id, &handle)
+		if err != nil {
+			return nil, err
+		}
+		result[id] = handle
+	}
+	return result, rows.Err()
+}
+
+func (db *SQLiteDB) GetUsers() ([]UserDatabase, error) {
+	rows, err := db.db.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return []UserDatabase{}, err
+	}
+	defer rows.Close()
+
+	var result []UserDatabase
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return []UserDatabase{}, err
+		}
+		result = append(result, user)
+	}
+
+	return result, rows.Err()
+}
+
+const userColumns = "id, email, password_hash, is_chirpy_red, handle, display_name, bio, avatar_url, suspended, role, email_verified, pending_email, totp_secret, totp_enabled, totp_last_step"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (UserDatabase, error) {
+	user := UserDatabase{}
+	err := row.Scan(&user.Id, &user.Email, &user.PasswordHash, &user.IsChirpyRed,
+		&user.Handle, &user.DisplayName, &user.Bio, &user.AvatarUrl, &user.Suspended, &user.Role,
+		&user.EmailVerified, &user.PendingEmail, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep)
+	if err != nil {
+		return UserDatabase{}, err
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) getUserWhere(where string, args ...any) (UserDatabase, bool, error) {
+	user, err := scanUser(db.db.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserDatabase{}, false, nil
+	}
+	if err != nil {
+		return UserDatabase{}, false, err
+	}
+	return user, true, nil
+}
+
+// times are stored as unix nanoseconds so they sort correctly, 0 is the zero time.
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnix(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
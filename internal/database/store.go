@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned when a change is made to a row that doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is everything the http handlers need from a database. Database (the
+// json file) and SQLiteDB both implement it.
+type Store interface {
+	CreateChirp(chirp Chirp) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpById(id int) (Chirp, error)
+	GetChirpsByAuthor(authorId int) ([]Chirp, error)
+	QueryChirps(query ChirpQuery) (ChirpPage, error)
+	SearchChirps(query SearchQuery) (SearchResult, error)
+	GetHashtagUses(since time.Time) ([]HashtagUse, error)
+	DeleteChirp(chirpId int) error
+	EditChirp(chirpId int, body string, editedAt time.Time) (Chirp, error)
+	SetNeedsReview(chirpId int, needsReview bool) (Chirp, error)
+	GetChirpHistory(chirpId int) ([]ChirpRevision, error)
+	GetDescendants(chirpId int) ([]Chirp, error)
+	LikeChirp(userId int, chirpId int, at time.Time) (Chirp, error)
+	UnlikeChirp(userId int, chirpId int) (Chirp, error)
+	Rechirp(userId int, chirpId int, at time.Time) (Chirp, error)
+	Unrechirp(userId int, chirpId int) (Chirp, error)
+
+	CreateMedia(media Media) (Media, error)
+	GetChirpMedia(chirpId int) ([]Media, error)
+	SetAvatar(userId int, avatar Media) (Media, []Media, error)
+	RemoveUnattachedMedia(cutoff time.Time) ([]Media, error)
+
+	CreateReport(report Report) (Report, error)
+	GetReports(query ReportQuery) ([]Report, error)
+	Moderate(action ModerationAction) (ModerationAction, []Report, error)
+	GetModerationLog(query ModerationLogQuery) ([]ModerationAction, error)
+	// Unsuspend lifts a suspension, see Tx.Unsuspend.
+	Unsuspend(action ModerationAction) (ModerationAction, error)
+	// LogAction adds an action chirpy took by itself to the audit log.
+	LogAction(action ModerationAction) (ModerationAction, error)
+
+	CreateSession(session Session) (Session, error)
+	// RotateSession swaps a refresh token for a new one, see Tx.RotateSession.
+	RotateSession(tokenHash string, newHash string, at time.Time) (Session, error)
+	GetSessions(userId int) ([]Session, error)
+	GetSessionByToken(tokenHash string) (Session, bool, error)
+	RevokeSession(id int) error
+	RevokeSessions(userId int) (int, error)
+
+	// CreatePasswordReset stores a reset, see Tx.CreatePasswordReset.
+	CreatePasswordReset(reset PasswordReset, cooldown time.Duration) (PasswordReset, error)
+	GetPasswordReset(tokenHash string) (PasswordReset, bool, error)
+	// SwapPasswordHash replaces a password hash that hasn't changed, see
+	// Tx.SwapPasswordHash.
+	SwapPasswordHash(userId int, oldHash []byte, newHash []byte) (bool, error)
+	// ResetPassword sets a new password with a reset, see Tx.ResetPassword.
+	ResetPassword(tokenHash string, passwordHash []byte, at time.Time) (UserDatabase, error)
+
+	CreateEmailVerification(verification EmailVerification) (EmailVerification, error)
+	// VerifyEmail confirms an email with a verification, see Tx.VerifyEmail.
+	VerifyEmail(tokenHash string, at time.Time) (UserDatabase, error)
+
+	// The two factor methods are described on Tx.
+	EnableTOTP(userId int, step int64, codeHashes []string, at time.Time) error
+	DisableTOTP(userId int) error
+	UseTOTPStep(userId int, step int64) error
+	SetRecoveryCodes(userId int, codeHashes []string, at time.Time) error
+	UseRecoveryCode(userId int, codeHash string) (int, error)
+	RecoveryCodesLeft(userId int) (int, error)
+
+	CreateUser(email string, passwordHash []byte) (User, error)
+	// CreateUserWithProfile creates a user with the email, password hash,
+	// handle, display name, bio and avatar of user at once, so a taken
+	// handle, ErrHandleTaken, leaves no user behind.
+	CreateUserWithProfile(user UserDatabase) (User, error)
+	UpdateUser(userChange UserDatabase) error
+	UserExist(email string) (bool, error)
+	GetUser(email string) (UserDatabase, error)
+	GetUserById(id int) (UserDatabase, bool, error)
+	GetUserByHandle(handle string) (UserDatabase, bool, error)
+	// GetUserHandles returns the handles of the users with userIds, users
+	// without a handle are left out.
+	GetUserHandles(userIds []int) (map[int]string, error)
+	GetUsers() ([]UserDatabase, error)
+
+	Follow(followerId int, followeeId int, at time.Time) (Follow, error)
+	Unfollow(followerId int, followeeId int) error
+	GetFollowers(userId int) ([]Follow, error)
+	GetFollowing(userId int) ([]Follow, error)
+
+	GetNotifications(query NotificationQuery) ([]Notification, error)
+	CountUnreadNotifications(userId int) (int, error)
+	MarkNotificationsRead(userId int, ids []int) error
+
+	Close() error
+}
+
+var _ Store = (*Database)(nil)
+var _ Store = (*SQLiteDB)(nil)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Open returns the Store for driver backed by the file at path.
+func Open(driver string, path string) (Store, error) {
+	switch driver {
+	case DriverJSON:
+		return NewDB(path)
+	case DriverSQLite:
+		return NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown database driver: %q", driver)
+	}
+}
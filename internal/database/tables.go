@@ -0,0 +1,255 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// table describes one of the maps in DBStructure, so the journal, the repair
+// on load and Tx can all handle every table the same way.
+type table[T any] struct {
+	name  string
+	rows  func(data *DBStructure) map[int]T
+	getId func(row T) int
+	setId func(row *T, id int)
+	// index adds a row that joined the table to the indexes, unindex removes
+	// one that left. Either can be nil for a table without indexes.
+	index   func(idx *indexes, row T)
+	unindex func(idx *indexes, row T)
+}
+
+// anyTable is a table with its row type hidden, for code that walks all of them.
+type anyTable interface {
+	apply(entry journalEntry, data *DBStructure) error
+	rekey(data *DBStructure) bool
+	indexAll(idx *indexes, data *DBStructure)
+}
+
+var chirpsTable = table[Chirp]{
+	name:    tableChirps,
+	rows:    func(data *DBStructure) map[int]Chirp { return data.Chirps },
+	getId:   func(chirp Chirp) int { return chirp.Id },
+	setId:   func(chirp *Chirp, id int) { chirp.Id = id },
+	index:   (*indexes).addChirp,
+	unindex: (*indexes).removeChirp,
+}
+
+var usersTable = table[UserDatabase]{
+	name:    tableUsers,
+	rows:    func(data *DBStructure) map[int]UserDatabase { return data.Users },
+	getId:   func(user UserDatabase) int { return user.Id },
+	setId:   func(user *UserDatabase, id int) { user.Id = id },
+	index:   (*indexes).addUser,
+	unindex: (*indexes).removeUser,
+}
+
+var revisionsTable = table[ChirpRevision]{
+	name:    tableRevisions,
+	rows:    func(data *DBStructure) map[int]ChirpRevision { return data.Revisions },
+	getId:   func(revision ChirpRevision) int { return revision.Id },
+	setId:   func(revision *ChirpRevision, id int) { revision.Id = id },
+	index:   (*indexes).addRevision,
+	unindex: (*indexes).removeRevision,
+}
+
+var followsTable = table[Follow]{
+	name:    tableFollows,
+	rows:    func(data *DBStructure) map[int]Follow { return data.Follows },
+	getId:   func(follow Follow) int { return follow.Id },
+	setId:   func(follow *Follow, id int) { follow.Id = id },
+	index:   (*indexes).addFollow,
+	unindex: (*indexes).removeFollow,
+}
+
+var likesTable = table[Like]{
+	name:    tableLikes,
+	rows:    func(data *DBStructure) map[int]Like { return data.Likes },
+	getId:   func(like Like) int { return like.Id },
+	setId:   func(like *Like, id int) { like.Id = id },
+	index:   (*indexes).addLike,
+	unindex: (*indexes).removeLike,
+}
+
+var notificationsTable = table[Notification]{
+	name:    tableNotifications,
+	rows:    func(data *DBStructure) map[int]Notification { return data.Notifications },
+	getId:   func(notification Notification) int { return notification.Id },
+	setId:   func(notification *Notification, id int) { notification.Id = id },
+	index:   (*indexes).addNotification,
+	unindex: (*indexes).removeNotification,
+}
+
+var mediaTable = table[Media]{
+	name:    tableMedia,
+	rows:    func(data *DBStructure) map[int]Media { return data.Media },
+	getId:   func(media Media) int { return media.Id },
+	setId:   func(media *Media, id int) { media.Id = id },
+	index:   (*indexes).addMedia,
+	unindex: (*indexes).removeMedia,
+}
+
+var reportsTable = table[Report]{
+	name:    tableReports,
+	rows:    func(data *DBStructure) map[int]Report { return data.Reports },
+	getId:   func(report Report) int { return report.Id },
+	setId:   func(report *Report, id int) { report.Id = id },
+	index:   (*indexes).addReport,
+	unindex: (*indexes).removeReport,
+}
+
+var moderationTable = table[ModerationAction]{
+	name:    tableModeration,
+	rows:    func(data *DBStructure) map[int]ModerationAction { return data.Moderation },
+	getId:   func(action ModerationAction) int { return action.Id },
+	setId:   func(action *ModerationAction, id int) { action.Id = id },
+	index:   (*indexes).addModerationAction,
+	unindex: (*indexes).removeModerationAction,
+}
+
+var sessionsTable = table[Session]{
+	name:    tableSessions,
+	rows:    func(data *DBStructure) map[int]Session { return data.Sessions },
+	getId:   func(session Session) int { return session.Id },
+	setId:   func(session *Session, id int) { session.Id = id },
+	index:   (*indexes).addSession,
+	unindex: (*indexes).removeSession,
+}
+
+var rotatedTokensTable = table[RotatedToken]{
+	name:    tableRotatedTokens,
+	rows:    func(data *DBStructure) map[int]RotatedToken { return data.RotatedTokens },
+	getId:   func(rotated RotatedToken) int { return rotated.Id },
+	setId:   func(rotated *RotatedToken, id int) { rotated.Id = id },
+	index:   (*indexes).addRotatedToken,
+	unindex: (*indexes).removeRotatedToken,
+}
+
+var passwordResetsTable = table[PasswordReset]{
+	name:    tablePasswordResets,
+	rows:    func(data *DBStructure) map[int]PasswordReset { return data.PasswordResets },
+	getId:   func(reset PasswordReset) int { return reset.Id },
+	setId:   func(reset *PasswordReset, id int) { reset.Id = id },
+	index:   (*indexes).addPasswordReset,
+	unindex: (*indexes).removePasswordReset,
+}
+
+var emailVerificationsTable = table[EmailVerification]{
+	name:    tableEmailVerifications,
+	rows:    func(data *DBStructure) map[int]EmailVerification { return data.EmailVerifications },
+	getId:   func(verification EmailVerification) int { return verification.Id },
+	setId:   func(verification *EmailVerification, id int) { verification.Id = id },
+	index:   (*indexes).addEmailVerification,
+	unindex: (*indexes).removeEmailVerification,
+}
+
+var recoveryCodesTable = table[RecoveryCode]{
+	name:    tableRecoveryCodes,
+	rows:    func(data *DBStructure) map[int]RecoveryCode { return data.RecoveryCodes },
+	getId:   func(code RecoveryCode) int { return code.Id },
+	setId:   func(code *RecoveryCode, id int) { code.Id = id },
+	index:   (*indexes).addRecoveryCode,
+	unindex: (*indexes).removeRecoveryCode,
+}
+
+// tables maps a journal table name to its table.
+var tables = map[string]anyTable{
+	tableChirps:             chirpsTable,
+	tableUsers:              usersTable,
+	tableRevisions:          revisionsTable,
+	tableFollows:            followsTable,
+	tableLikes:              likesTable,
+	tableNotifications:      notificationsTable,
+	tableMedia:              mediaTable,
+	tableReports:            reportsTable,
+	tableModeration:         moderationTable,
+	tableSessions:           sessionsTable,
+	tableRotatedTokens:      rotatedTokensTable,
+	tablePasswordResets:     passwordResetsTable,
+	tableEmailVerifications: emailVerificationsTable,
+	tableRecoveryCodes:      recoveryCodesTable,
+}
+
+func (t table[T]) apply(entry journalEntry, data *DBStructure) error {
+	rows := t.rows(data)
+	switch entry.Op {
+	case opPut:
+		var value T
+		err := json.Unmarshal(entry.Value, &value)
+		if err != nil {
+			return fmt.Errorf("journal: bad %s value for key %d: %s", entry.Table, entry.Key, err)
+		}
+		rows[entry.Key] = value
+	case opDelete:
+		delete(rows, entry.Key)
+	default:
+		return fmt.Errorf("journal: unknown op %q", entry.Op)
+	}
+
+	// keys are ids, so the journal carries the sequences along with it
+	if entry.Key > data.Sequences[t.name] {
+		data.Sequences[t.name] = entry.Key
+	}
+	return nil
+}
+
+func (t table[T]) indexAll(idx *indexes, data *DBStructure) {
+	if t.index == nil {
+		return
+	}
+	for _, row := range t.rows(data) {
+		t.index(idx, row)
+	}
+}
+
+// rekey puts every row under its own id, gives rows that share an id a new
+// one, and moves the sequence past the biggest id. It reports whether anything
+// changed.
+func (t table[T]) rekey(data *DBStructure) bool {
+	rows := t.rows(data)
+	keys := make([]int, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+
+	changed := false
+	maxId := data.Sequences[t.name]
+	for _, key := range keys {
+		if id := t.getId(rows[key]); id > maxId {
+			maxId = id
+		}
+	}
+
+	rekeyed := make(map[int]T, len(rows))
+	var orphans []T
+	for _, key := range keys {
+		row := rows[key]
+		id := t.getId(row)
+		if key != id {
+			changed = true
+		}
+		if _, taken := rekeyed[id]; taken || id <= 0 {
+			orphans = append(orphans, row)
+			continue
+		}
+		rekeyed[id] = row
+	}
+	for _, row := range orphans {
+		maxId++
+		t.setId(&row, maxId)
+		rekeyed[maxId] = row
+	}
+
+	if data.Sequences[t.name] != maxId {
+		data.Sequences[t.name] = maxId
+		changed = true
+	}
+	if changed {
+		clear(rows)
+		for id, row := range rekeyed {
+			rows[id] = row
+		}
+	}
+	return changed
+}
@@ -0,0 +1,114 @@
+package database
+
+import "sort"
+
+// Thread is a chirp with the chain of chirps it replies to and the tree of
+// replies below it.
+type Thread struct {
+	// Ancestors runs from the start of the conversation down to the parent of Chirp.
+	Ancestors []Chirp       `json:"ancestors"`
+	Chirp     Chirp         `json:"chirp"`
+	Replies   []*ThreadNode `json:"replies"`
+}
+
+// ThreadNode is a reply in a Thread, Depth is 1 for direct replies to the
+// thread's chirp.
+type ThreadNode struct {
+	Chirp
+	Depth   int           `json:"depth"`
+	Replies []*ThreadNode `json:"replies,omitempty"`
+}
+
+// tombstoneOf is what is left of a deleted chirp that still has replies.
+func tombstoneOf(chirp Chirp) Chirp {
+	chirp.Body = ""
+	chirp.Hashtags = nil
+	chirp.Mentions = nil
+	chirp.Attachments = nil
+	chirp.NeedsReview = false
+	chirp.Deleted = true
+	return chirp
+}
+
+// withheld is what is shown of a chirp in a thread, a hidden chirp keeps its
+// place like a tombstone does but shows nothing.
+func withheld(chirp Chirp) Chirp {
+	if !chirp.Hidden {
+		return chirp
+	}
+	chirp = tombstoneOf(chirp)
+	chirp.Deleted = false
+	return chirp
+}
+
+// GetThread loads the thread around the chirp with id. found is false when
+// there is no such chirp or it is hidden.
+func GetThread(store Store, id int) (thread Thread, found bool, err error) {
+	chirp, err := store.GetChirpById(id)
+	if err != nil || chirp.Id == 0 || chirp.Hidden {
+		return Thread{}, false, err
+	}
+	thread.Chirp = chirp
+
+	seen := map[int]bool{chirp.Id: true}
+	for parentId := chirp.InReplyTo; parentId != 0 && !seen[parentId]; {
+		seen[parentId] = true
+		parent, err := store.GetChirpById(parentId)
+		if err != nil {
+			return Thread{}, false, err
+		}
+		if parent.Id == 0 {
+			break
+		}
+		thread.Ancestors = append([]Chirp{withheld(parent)}, thread.Ancestors...)
+		parentId = parent.InReplyTo
+	}
+
+	descendants, err := store.GetDescendants(chirp.Id)
+	if err != nil {
+		return Thread{}, false, err
+	}
+	sort.Slice(descendants, func(i, j int) bool { return descendants[i].Id < descendants[j].Id })
+
+	nodes := map[int]*ThreadNode{}
+	for _, descendant := range descendants {
+		nodes[descendant.Id] = &ThreadNode{Chirp: withheld(descendant)}
+	}
+	// ids only go up so a reply always comes after the chirp it replies to
+	for _, descendant := range descendants {
+		node := nodes[descendant.Id]
+		if descendant.InReplyTo == chirp.Id {
+			node.Depth = 1
+			thread.Replies = append(thread.Replies, node)
+			continue
+		}
+		parent := nodes[descendant.InReplyTo]
+		node.Depth = parent.Depth + 1
+		parent.Replies = append(parent.Replies, node)
+	}
+
+	if thread.Ancestors == nil {
+		thread.Ancestors = []Chirp{}
+	}
+	if thread.Replies == nil {
+		thread.Replies = []*ThreadNode{}
+	}
+	return thread, true, nil
+}
+
+// Flatten returns the replies of the thread depth first, in the order they
+// would be read top to bottom, without the nesting.
+func (thread Thread) Flatten() []ThreadNode {
+	result := []ThreadNode{}
+	var walk func(nodes []*ThreadNode)
+	walk = func(nodes []*ThreadNode) {
+		for _, node := range nodes {
+			flat := *node
+			flat.Replies = nil
+			result = append(result, flat)
+			walk(node.Replies)
+		}
+	}
+	walk(thread.Replies)
+	return result
+}
@@ -0,0 +1,456 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+var ErrReadOnlyTx = errors.New("database: write in a read only transaction")
+
+// Tx is a view of the database for the length of a View or Update call. The
+// database lock is held the whole time, so everything read and written
+// through a Tx happens as one step. Changes made in an Update are visible to
+// the rest of that Update straight away and are undone if it fails.
+type Tx struct {
+	db       *Database
+	writable bool
+	entries  []journalEntry
+	undo     []func()
+}
+
+// View runs fn with a read only Tx.
+func (db *Database) View(fn func(tx *Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return fn(&Tx{db: db})
+}
+
+// Update runs fn with a writable Tx and then persists its changes. If fn, or
+// persisting the changes, fails every change fn made is rolled back and the
+// error returned.
+func (db *Database) Update(fn func(tx *Tx) error) (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := &Tx{db: db, writable: true}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(tx)
+	if err == nil && len(tx.entries) != 0 {
+		err = db.writeDB(tx.entries...)
+	}
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.entries = nil
+	tx.undo = nil
+}
+
+func (tx *Tx) Chirp(id int) (Chirp, bool) {
+	chirp, found := tx.db.data.Chirps[id]
+	return chirp, found
+}
+
+// Chirps returns every chirp ordered by id.
+func (tx *Tx) Chirps() []Chirp {
+	return tx.chirpsByKey(tx.db.index.chirps.byId)
+}
+
+func (tx *Tx) ChirpsByAuthor(authorId int) []Chirp {
+	byAuthor, ok := tx.db.index.chirpsByAuthor[authorId]
+	if !ok {
+		return nil
+	}
+	return tx.chirpsByKey(byAuthor.byId)
+}
+
+func (tx *Tx) chirpsByKey(keys []chirpKey) []Chirp {
+	var result []Chirp
+	for _, key := range keys {
+		result = append(result, tx.db.data.Chirps[key.Id])
+	}
+	return result
+}
+
+// CreateChirp stores chirp under a newly allocated id. A reply bumps the
+// reply count of the chirp it replies to, which must exist and be neither
+// deleted, hidden nor a rechirp. A chirp that needs review is reported to the
+// moderation queue.
+func (tx *Tx) CreateChirp(chirp Chirp) (Chirp, error) {
+	chirp.ReplyCount = 0
+	chirp.Deleted = false
+	chirp.LikeCount = 0
+	chirp.RechirpCount = 0
+	chirp.Hidden = false
+	chirp.Hashtags = ParseHashtags(chirp.Body)
+	chirp.Mentions = tx.resolveMentions(chirp.Body)
+	chirp.AuthorHandle = ""
+	attachments, err := tx.attachments(chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp.Attachments = attachments
+
+	parentAuthorId := 0
+	if chirp.InReplyTo != 0 {
+		parent, found := tx.Chirp(chirp.InReplyTo)
+		if !found || parent.Deleted || parent.Hidden || parent.RechirpOf != 0 {
+			return Chirp{}, fmt.Errorf("reply to chirp %d: %w", chirp.InReplyTo, ErrNotFound)
+		}
+		parent.ReplyCount++
+		err := tx.UpdateChirp(parent)
+		if err != nil {
+			return Chirp{}, err
+		}
+		parentAuthorId = parent.AuthorId
+	}
+
+	chirp, err = insert(tx, chirpsTable, chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = tx.claimMedia(chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.NeedsReview {
+		_, err = insert(tx, reportsTable, filterReport(chirp))
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	for _, notification := range chirpNotifications(chirp, nil, parentAuthorId, chirp.CreatedAt) {
+		err = tx.notify(notification)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	return chirp, nil
+}
+
+// resolveMentions finds the users mentioned in body by email or handle.
+func (tx *Tx) resolveMentions(body string) []Mention {
+	mentions, _ := resolveMentions(body, func(name string) (int, bool, error) {
+		user, found := tx.UserByEmail(name)
+		if !found {
+			user, found = tx.UserByHandle(name)
+		}
+		return user.Id, found, nil
+	})
+	return mentions
+}
+
+// UpdateChirp replaces the chirp with the same id.
+func (tx *Tx) UpdateChirp(chirp Chirp) error {
+	return update(tx, chirpsTable, chirp)
+}
+
+// DeleteChirp deletes the chirp along with its edit history, likes, rechirps,
+// attachments and the notifications about it. A chirp with replies is turned into a tombstone instead so its
+// thread stays in one piece, and a tombstone is deleted for good once its last
+// reply is.
+func (tx *Tx) DeleteChirp(id int) error {
+	if _, found := tx.Chirp(id); !found {
+		return nil
+	}
+
+	for _, revisionId := range slices.Clone(tx.db.index.revisionsByChirp[id]) {
+		err := remove(tx, revisionsTable, revisionId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, notificationId := range slices.Clone(tx.db.index.notificationsByChirp[id]) {
+		err := remove(tx, notificationsTable, notificationId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, mediaId := range slices.Clone(tx.db.index.mediaByChirp[id]) {
+		err := remove(tx, mediaTable, mediaId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, likeId := range slices.Clone(tx.db.index.likesByChirp[id]) {
+		err := remove(tx, likesTable, likeId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rechirpId := range slices.Clone(tx.db.index.rechirpsByChirp[id]) {
+		err := tx.DeleteChirp(rechirpId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// deleting the rechirps changed the chirp
+	chirp, _ := tx.Chirp(id)
+	chirp.LikeCount = 0
+	if chirp.ReplyCount > 0 {
+		return tx.UpdateChirp(tombstoneOf(chirp))
+	}
+
+	err := remove(tx, chirpsTable, id)
+	if err != nil {
+		return err
+	}
+
+	if chirp.RechirpOf != 0 {
+		return tx.addToChirp(chirp.RechirpOf, func(original *Chirp) { original.RechirpCount-- })
+	}
+	if chirp.InReplyTo == 0 {
+		return nil
+	}
+	parent, found := tx.Chirp(chirp.InReplyTo)
+	if !found {
+		return nil
+	}
+	parent.ReplyCount--
+	err = tx.UpdateChirp(parent)
+	if err != nil {
+		return err
+	}
+	if parent.Deleted && parent.ReplyCount <= 0 {
+		return tx.DeleteChirp(parent.Id)
+	}
+	return nil
+}
+
+// addToChirp applies change to the chirp with id, if it is still there.
+func (tx *Tx) addToChirp(id int, change func(chirp *Chirp)) error {
+	chirp, found := tx.Chirp(id)
+	if !found {
+		return nil
+	}
+	change(&chirp)
+	return tx.UpdateChirp(chirp)
+}
+
+// Descendants returns every reply to the chirp, the replies to those replies
+// and so on, each generation ordered by id.
+func (tx *Tx) Descendants(id int) []Chirp {
+	var result []Chirp
+	queue := []int{id}
+	for len(queue) != 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, replyId := range tx.db.index.repliesByChirp[parent] {
+			result = append(result, tx.db.data.Chirps[replyId])
+			queue = append(queue, replyId)
+		}
+	}
+	return result
+}
+
+// EditChirp replaces the body of a chirp and keeps the old body in its history.
+func (tx *Tx) EditChirp(id int, body string, editedAt time.Time) (Chirp, error) {
+	chirp, found := tx.Chirp(id)
+	if !found {
+		return Chirp{}, fmt.Errorf("chirp %d: %w", id, ErrNotFound)
+	}
+
+	_, err := insert(tx, revisionsTable, revisionOf(chirp, editedAt))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	oldMentions := chirp.Mentions
+	chirp.Body = body
+	chirp.Hashtags = ParseHashtags(body)
+	chirp.Mentions = tx.resolveMentions(body)
+	chirp.UpdatedAt = editedAt
+	err = tx.UpdateChirp(chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	// only users the edit newly mentions hear about it
+	for _, notification := range chirpNotifications(chirp, oldMentions, 0, editedAt) {
+		err = tx.notify(notification)
+		if err != nil {
+			return Chirp{}, err
+		}
+	}
+	return chirp, nil
+}
+
+// SetNeedsReview flags a chirp for a moderator to look at, which reports it
+// to the moderation queue, or clears the flag, which dismisses the report.
+func (tx *Tx) SetNeedsReview(id int, needsReview bool) (Chirp, error) {
+	chirp, found := tx.Chirp(id)
+	if !found {
+		return Chirp{}, fmt.Errorf("chirp %d: %w", id, ErrNotFound)
+	}
+	if chirp.NeedsReview == needsReview {
+		return chirp, nil
+	}
+
+	chirp.NeedsReview = needsReview
+	err := tx.UpdateChirp(chirp)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if needsReview {
+		_, err = insert(tx, reportsTable, filterReport(chirp))
+	} else {
+		_, err = tx.closeReports(filterReport(chirp), ReportDismissed, 0, func(report Report) bool { return report.ReporterId == 0 })
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// ChirpHistory returns the old bodies of a chirp, oldest first.
+func (tx *Tx) ChirpHistory(id int) []ChirpRevision {
+	var result []ChirpRevision
+	for _, revisionId := range tx.db.index.revisionsByChirp[id] {
+		result = append(result, tx.db.data.Revisions[revisionId])
+	}
+	return result
+}
+
+func (tx *Tx) User(id int) (UserDatabase, bool) {
+	user, found := tx.db.data.Users[id]
+	return user, found
+}
+
+func (tx *Tx) UserByEmail(email string) (UserDatabase, bool) {
+	id, found := tx.db.index.usersByEmail[email]
+	if !found {
+		return UserDatabase{}, false
+	}
+	return tx.db.data.Users[id], true
+}
+
+// Users returns every user ordered by id.
+func (tx *Tx) Users() []UserDatabase {
+	var result []UserDatabase
+	for _, user := range tx.db.data.Users {
+		result = append(result, user)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// CreateUser stores user under a newly allocated id.
+func (tx *Tx) CreateUser(user UserDatabase) (UserDatabase, error) {
+	if _, taken := tx.UserByHandle(user.Handle); taken {
+		return UserDatabase{}, ErrHandleTaken
+	}
+	return insert(tx, usersTable, user)
+}
+
+// UpdateUser replaces the user with the same id.
+func (tx *Tx) UpdateUser(user UserDatabase) error {
+	if other, taken := tx.UserByHandle(user.Handle); taken && other.Id != user.Id {
+		return ErrHandleTaken
+	}
+	return update(tx, usersTable, user)
+}
+
+// record queues entry for the journal and undo for a rollback.
+func (tx *Tx) record(entry journalEntry, undo func()) {
+	tx.entries = append(tx.entries, entry)
+	tx.undo = append(tx.undo, undo)
+}
+
+func insert[T any](tx *Tx, t table[T], row T) (T, error) {
+	var zero T
+	if !tx.writable {
+		return zero, ErrReadOnlyTx
+	}
+
+	sequence := tx.db.data.Sequences[t.name]
+	t.setId(&row, tx.db.data.nextId(t.name))
+	tx.undo = append(tx.undo, func() { tx.db.data.Sequences[t.name] = sequence })
+
+	err := put(tx, t, row)
+	if err != nil {
+		return zero, err
+	}
+	return row, nil
+}
+
+func update[T any](tx *Tx, t table[T], row T) error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+	if _, found := t.rows(&tx.db.data)[t.getId(row)]; !found {
+		return fmt.Errorf("%s %d: %w", t.name, t.getId(row), ErrNotFound)
+	}
+	return put(tx, t, row)
+}
+
+func put[T any](tx *Tx, t table[T], row T) error {
+	id := t.getId(row)
+	entry, err := putEntry(t.name, id, row)
+	if err != nil {
+		return err
+	}
+
+	old, existed := setRow(tx.db, t, id, &row)
+	tx.record(entry, func() {
+		if existed {
+			setRow(tx.db, t, id, &old)
+		} else {
+			setRow(tx.db, t, id, nil)
+		}
+	})
+	return nil
+}
+
+// remove deletes the row with id, deleting a row that doesn't exist is not an error.
+func remove[T any](tx *Tx, t table[T], id int) error {
+	if !tx.writable {
+		return ErrReadOnlyTx
+	}
+
+	old, existed := setRow(tx.db, t, id, nil)
+	if !existed {
+		return nil
+	}
+	tx.record(deleteEntry(t.name, id), func() { setRow(tx.db, t, id, &old) })
+	return nil
+}
+
+// setRow puts row in the table under id, or deletes id when row is nil, and
+// keeps the indexes in step. It returns the row that was there before.
+func setRow[T any](db *Database, t table[T], id int, row *T) (T, bool) {
+	rows := t.rows(&db.data)
+	old, existed := rows[id]
+	if existed && t.unindex != nil {
+		t.unindex(db.index, old)
+	}
+
+	if row == nil {
+		delete(rows, id)
+	} else {
+		rows[id] = *row
+		if t.index != nil {
+			t.index(db.index, *row)
+		}
+	}
+
+	return old, existed
+}
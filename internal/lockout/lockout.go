@@ -0,0 +1,144 @@
+// Package lockout slows down guessing by counting failed attempts per key,
+// like an account or an address. Every failure makes the next attempt wait
+// twice as long, and enough of them lock the key out for a while.
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+type Config struct {
+	// MaxFailures is how many failures in a row lock a key out.
+	MaxFailures int
+	// Backoff is how long to wait after the first failure, it doubles with
+	// every one after up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Lockout is how long a key stays locked out.
+	Lockout time.Duration
+	// Forget is how long after its last failure a key starts over.
+	Forget time.Duration
+}
+
+// Limiter counts the failures of each key. It is safe to use from many
+// goroutines.
+type Limiter struct {
+	config Config
+
+	mu     sync.Mutex
+	keys   map[string]*entry
+	pruned time.Time
+}
+
+type entry struct {
+	failures    int
+	lastFailure time.Time
+	// until is when the key may try again
+	until time.Time
+	// lockedUntil is when the last lockout of the key ends
+	lockedUntil time.Time
+}
+
+func New(config Config) *Limiter {
+	return &Limiter{config: config, keys: make(map[string]*entry)}
+}
+
+// Allow reports whether key may make an attempt at now, and if not how long
+// until it may.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entry(key, now)
+	if e == nil || !now.Before(e.until) {
+		return true, 0
+	}
+	return false, e.until.Sub(now)
+}
+
+// Fail counts a failed attempt by key at now. It returns true when the
+// failure locked the key out, which happens once per lockout. Attempts that
+// were allowed before a lockout can fail after it started, those aren't
+// counted towards the next one and never shorten the wait.
+func (l *Limiter) Fail(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	e := l.entry(key, now)
+	if e == nil {
+		e = &entry{}
+		l.keys[key] = e
+	}
+	e.lastFailure = now
+	if now.Before(e.lockedUntil) {
+		return false
+	}
+	e.failures++
+
+	if l.config.MaxFailures > 0 && e.failures >= l.config.MaxFailures {
+		// starting over once the lockout ends gives the key a fresh set of
+		// attempts, and another lockout if it uses them up too
+		e.failures = 0
+		e.lockedUntil = now.Add(l.config.Lockout)
+		e.extend(e.lockedUntil)
+		return true
+	}
+	e.extend(now.Add(l.backoff(e.failures)))
+	return false
+}
+
+// extend makes the key wait until at least until.
+func (e *entry) extend(until time.Time) {
+	if until.After(e.until) {
+		e.until = until
+	}
+}
+
+// Succeed forgets the failures of key.
+func (l *Limiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+// backoff is the wait after failures failures in a row.
+func (l *Limiter) backoff(failures int) time.Duration {
+	wait := l.config.Backoff
+	for i := 1; i < failures && wait < l.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, l.config.MaxBackoff)
+}
+
+// entry returns the entry of key, or nil when it has none or is forgotten.
+func (l *Limiter) entry(key string, now time.Time) *entry {
+	e, found := l.keys[key]
+	if !found {
+		return nil
+	}
+	if l.forgotten(e, now) {
+		delete(l.keys, key)
+		return nil
+	}
+	return e
+}
+
+func (l *Limiter) forgotten(e *entry, now time.Time) bool {
+	return !now.Before(e.until) && !now.Before(e.lastFailure.Add(l.config.Forget))
+}
+
+// prune drops forgotten keys, at most once every Forget, so a flood of
+// guesses for different keys doesn't keep growing the map.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.config.Forget {
+		return
+	}
+	l.pruned = now
+	for key, e := range l.keys {
+		if l.forgotten(e, now) {
+			delete(l.keys, key)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	MaxFailures: 4,
+	Backoff:     time.Second,
+	MaxBackoff:  3 * time.Second,
+	Lockout:     time.Minute,
+	Forget:      time.Hour,
+}
+
+func TestBackoff(t *testing.T) {
+	l := New(testConfig)
+	now := time.Unix(1_700_000_000, 0)
+
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Fatal("first attempt is refused")
+	}
+
+	// waits double and stop at MaxBackoff
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if l.Fail("a", now) {
+			t.Fatalf("failure %d locked the key out", i+1)
+		}
+		ok, wait := l.Allow("a", now)
+		if ok || wait != want {
+			t.Errorf("after failure %d: got ok %t wait %s, want a wait of %s", i+1, ok, wait, want)
+		}
+		now = now.Add(want)
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Errorf("after waiting out failure %d: refused", i+1)
+		}
+	}
+
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Error("other key is refused")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l := New(testConfig)
+	now := time.Unix(1_700_000_000, 0)
+
+	locks := 0
+	for range testConfig.MaxFailures {
+		if l.Fail("a", now) {
+			locks++
+		}
+	}
+	if locks != 1 {
+		t.Fatalf("lockouts: got %d, want 1", locks)
+	}
+	ok, wait := l.Allow("a", now.Add(time.Second))
+	if ok || wait != testConfig.Lockout-time.Second {
+		t.Errorf("locked out: got ok %t wait %s", ok, wait)
+	}
+
+	// after the lockout the key gets a fresh set of attempts
+	now = now.Add(testConfig.Lockout)
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Fatal("refused after the lockout")
+	}
+	if l.Fail("a", now) {
+		t.Error("first failure after the lockout locked the key out again")
+	}
+	if ok, wait := l.Allow("a", now); ok || wait != testConfig.Backoff {
+		t.Errorf("first failure after the lockout: got ok %t wait %s", ok, wait)
+	}
+}
+
+func TestFailuresDuringLockout(t *testing.T) {
+	l := New(testConfig)
+	now := time.Unix(1_700_000_000, 0)
+
+	// guesses allowed before the lockout fail after it, all at once
+	locks := 0
+	for range testConfig.MaxFailures + 3 {
+		if l.Fail("a", now) {
+			locks++
+		}
+	}
+	if locks != 1 {
+		t.Errorf("lockouts: got %d, want 1", locks)
+	}
+	ok, wait := l.Allow("a", now)
+	if ok || wait != testConfig.Lockout {
+		t.Errorf("locked out: got ok %t wait %s, want a wait of %s", ok, wait, testConfig.Lockout)
+	}
+
+	// nor do they count towards the next lockout
+	now = now.Add(testConfig.Lockout)
+	if l.Fail("a", now) {
+		t.Error("first failure after the lockout locked the key out again")
+	}
+	if ok, wait := l.Allow("a", now); ok || wait != testConfig.Backoff {
+		t.Errorf("first failure after the lockout: got ok %t wait %s", ok, wait)
+	}
+}
+
+func TestSucceedAndForget(t *testing.T) {
+	l := New(testConfig)
+	now := time.Unix(1_700_000_000, 0)
+
+	for range testConfig.MaxFailures - 1 {
+		l.Fail("a", now)
+	}
+	l.Succeed("a")
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Error("refused after a success")
+	}
+	if l.Fail("a", now) {
+		t.Error("failures before a success still count")
+	}
+
+	for range testConfig.MaxFailures - 2 {
+		l.Fail("b", now)
+	}
+	now = now.Add(testConfig.Forget)
+	if l.Fail("b", now) {
+		t.Error("failures from before Forget still count")
+	}
+	// pruning dropped the forgotten key a
+	if _, found := l.keys["a"]; found {
+		t.Error("forgotten key is kept")
+	}
+}
+
+func TestNoMaxFailures(t *testing.T) {
+	config := testConfig
+	config.MaxFailures = 0
+	l := New(config)
+	now := time.Unix(1_700_000_000, 0)
+
+	for range 100 {
+		if l.Fail("a", now) {
+			t.Fatal("locked out without MaxFailures")
+		}
+	}
+	if ok, wait := l.Allow("a", now); ok || wait != config.MaxBackoff {
+		t.Errorf("got ok %t wait %s, want a wait of MaxBackoff", ok, wait)
+	}
+}
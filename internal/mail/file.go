@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileDrop writes each message to its own .eml file in a directory instead
+// of delivering it, for development or for something else to pick up.
+type FileDrop struct {
+	dir  string
+	from string
+}
+
+// NewFileDrop returns a FileDrop that writes messages from from into dir,
+// creating it if needed.
+func NewFileDrop(dir string, from string) (*FileDrop, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDrop{dir: dir, from: from}, nil
+}
+
+// Send writes msg to a new file named after the time it was sent, so the
+// files sort in the order they were sent. The file only shows up once it is
+// completely written.
+func (f *FileDrop) Send(msg Message) error {
+	now := time.Now()
+	data, err := format(f.from, msg, now)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := now.UTC().Format("20060102T150405.000000000") + "-" + hex.EncodeToString(suffix) + ".eml"
+
+	tmp, err := os.CreateTemp(f.dir, ".sending-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(f.dir, name))
+}
@@ -0,0 +1,109 @@
+// Package mail sends the emails chirpy sends its users, like password reset
+// links, through a transport that can be swapped out.
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBadHeader is returned for a message whose address or subject would
+// break out of its header.
+var ErrBadHeader = errors.New("mail: bad header")
+
+// Message is a plain text email to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Implementations fill in who they are from.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// format renders msg as an RFC 5322 message from from, with the body quoted
+// printable so lines of any length and any characters get through.
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	for _, value := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrBadHeader
+		}
+	}
+	sender, _, err := envelope(from, msg.To)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	body := quotedprintable.NewWriter(&buf)
+	_, err = body.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+	if err != nil {
+		return nil, err
+	}
+	err = body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Memory keeps the messages sent through it instead of delivering them,
+// for tests.
+type Memory struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *Memory) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// envelope returns the bare addresses of from and to, for the SMTP envelope.
+func envelope(from string, to string) (string, string, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", "", fmt.Errorf("from %q: %w", from, ErrBadHeader)
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", "", fmt.Errorf("to %q: %w", to, ErrBadHeader)
+	}
+	return sender.Address, recipient.Address, nil
+}
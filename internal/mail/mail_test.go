@@ -0,0 +1,173 @@
+package mail_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	netmail "net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/djmarkymark007/chirpy/internal/mail"
+)
+
+const from = "Chirpy <no-reply@chirpy.example>"
+
+var message = mail.Message{
+	To:      "Ann <ann@example.com>",
+	Subject: "Réinitialiser your password",
+	Body:    "Reset it here:\nhttps://chirpy.example/reset?token=" + strings.Repeat("ab", 40) + "\n",
+}
+
+// checkMessage parses a sent message and checks it says what message does.
+func checkMessage(t *testing.T, r io.Reader) {
+	t.Helper()
+	parsed, err := netmail.ReadMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Header.Get("From"); got != from {
+		t.Errorf("From: got %q", got)
+	}
+	if got := parsed.Header.Get("To"); got != message.To {
+		t.Errorf("To: got %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != message.Subject {
+		t.Errorf("Subject: got %q, %v", subject, err)
+	}
+	if !strings.HasSuffix(parsed.Header.Get("Message-ID"), "@chirpy.example>") {
+		t.Errorf("Message-ID: got %q", parsed.Header.Get("Message-ID"))
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(string(body), "\r\n", "\n"); got != message.Body {
+		t.Errorf("body: got %q, want %q", got, message.Body)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	mailer := &mail.Memory{}
+	var _ mail.Mailer = mailer
+	for _, subject := range []string{"one", "two"} {
+		err := mailer.Send(mail.Message{To: "ann@example.com", Subject: subject})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := mailer.Messages()
+	if len(sent) != 2 || sent[0].Subject != "one" || sent[1].Subject != "two" {
+		t.Errorf("messages: got %+v", sent)
+	}
+}
+
+func TestFileDrop(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	mailer, err := mail.NewFileDrop(dir, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mailer.Send(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Ext(files[0]) != ".eml" {
+		t.Fatalf("files: got %v, want one .eml file", files)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkMessage(t, f)
+
+	for _, bad := range []mail.Message{
+		{To: "ann@example.com\r\nBcc: everyone@example.com", Subject: "hi"},
+		{To: "ann@example.com", Subject: "hi\nBcc: everyone@example.com"},
+		{To: "not an address", Subject: "hi"},
+	} {
+		err = mailer.Send(bad)
+		if !errors.Is(err, mail.ErrBadHeader) {
+			t.Errorf("Send(%+v): got %v, want ErrBadHeader", bad, err)
+		}
+	}
+}
+
+// fakeSMTP accepts one message on a local port and sends what it got, the
+// envelope recipient and the data, on received.
+func fakeSMTP(t *testing.T) (string, <-chan [2]string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan [2]string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 fake ESMTP")
+		var rcpt string
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 fake")
+			case "RCPT":
+				rcpt = line
+				text.PrintfLine("250 ok")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received <- [2]string{rcpt, string(data)}
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	mailer := &mail.SMTP{Addr: addr, From: from}
+	err := mailer.Send(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	if got[0] != "RCPT TO:<ann@example.com>" {
+		t.Errorf("recipient: got %q", got[0])
+	}
+	checkMessage(t, bufio.NewReader(strings.NewReader(got[1])))
+}
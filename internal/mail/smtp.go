@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP delivers messages through an SMTP server. The connection is upgraded
+// with STARTTLS when the server offers it, and the credentials are only sent
+// over TLS or to localhost.
+type SMTP struct {
+	// Addr is the host:port of the server.
+	Addr     string
+	Username string
+	Password string
+	// From is the address messages are sent from, like
+	// "Chirpy <no-reply@example.com>".
+	From string
+}
+
+func (s *SMTP) Send(msg Message) error {
+	data, err := format(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	from, to, err := envelope(s.From, msg.To)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, auth, from, []string{to}, data)
+}
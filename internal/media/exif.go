@@ -0,0 +1,119 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// exifOrientationTag is the exif tag that says which way up a photo was taken.
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the exif orientation of the jpeg in data, 1 (the
+// right way up) if it has none. Cameras store photos the way the sensor read
+// them and say how to turn them in the orientation, re-encoding drops the
+// exif data so the turn has to be applied to the pixels.
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		// the image data starts at start of scan, the exif data comes before it
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation out of the first IFD of the tiff
+// structure exif data is stored as.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 0 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orient turns and flips img the way the exif orientation says, so it ends
+// up the right way up.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	dstWidth, dstHeight := width, height
+	// orientations 5 to 8 are turned a quarter, which swaps the sides
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = width-1-x, y
+			case 3:
+				sx, sy = width-1-x, height-1-y
+			case 4:
+				sx, sy = x, height-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, height-1-x
+			case 7:
+				sx, sy = width-1-y, height-1-x
+			case 8:
+				sx, sy = width-1-y, x
+			}
+			copy(result.Pix[y*result.Stride+x*4:y*result.Stride+x*4+4], img.Pix[sy*img.Stride+sx*4:])
+		}
+	}
+	return result
+}
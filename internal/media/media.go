@@ -0,0 +1,201 @@
+// Package media checks and re-encodes uploaded images. Images are decoded and
+// encoded again rather than stored as uploaded, which drops metadata like
+// the location a photo was taken at and anything smuggled in after the image
+// data.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+const (
+	// MaxPixels is the most pixels an upload can have, checked before it is
+	// decoded so a small file can't claim a huge image. Decoding one this big
+	// takes about 64MB for the image and as much again for its RGBA copy.
+	MaxPixels = 16_000_000
+	// MaxDecoding is how many images are decoded at once, so parallel
+	// uploads can't take more memory than MaxDecoding of the biggest.
+	MaxDecoding = 2
+	// jpegQuality is the quality jpegs are encoded with.
+	jpegQuality = 85
+)
+
+// decoding holds a slot for each image being decoded.
+var decoding = make(chan struct{}, MaxDecoding)
+
+var (
+	ErrUnsupported   = errors.New("only png and jpeg images are supported")
+	ErrTooManyPixels = errors.New("image has too many pixels")
+)
+
+const (
+	TypePNG  = "image/png"
+	TypeJPEG = "image/jpeg"
+)
+
+// Image is an encoded image ready to be stored.
+type Image struct {
+	Data        []byte
+	ContentType string
+	// Ext is the file extension that goes with ContentType, like ".png".
+	Ext    string
+	Width  int
+	Height int
+}
+
+// Options says what Process makes of an upload.
+type Options struct {
+	// MaxDimension is the longest the longer side of the image can be, bigger
+	// images are scaled down to fit.
+	MaxDimension int
+	// ThumbnailDimension is the longest the longer side of the thumbnail can be.
+	ThumbnailDimension int
+	// Square crops the image to the square in the middle of it, for avatars.
+	Square bool
+}
+
+// Sniff returns the content type of data going by its contents, whatever the
+// upload claimed it was. Only TypePNG and TypeJPEG are accepted.
+func Sniff(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if contentType != TypePNG && contentType != TypeJPEG {
+		return "", ErrUnsupported
+	}
+	return contentType, nil
+}
+
+// Process decodes the png or jpeg in data and returns it scaled to fit opts
+// and a thumbnail of it, both in the format it was uploaded in. It waits
+// while MaxDecoding other images are being decoded.
+func Process(data []byte, opts Options) (Image, Image, error) {
+	contentType, err := Sniff(data)
+	if err != nil {
+		return Image{}, Image{}, err
+	}
+
+	decodeConfig, decode := png.DecodeConfig, png.Decode
+	if contentType == TypeJPEG {
+		decodeConfig, decode = jpeg.DecodeConfig, jpeg.Decode
+	}
+
+	config, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, Image{}, ErrUnsupported
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return Image{}, Image{}, ErrTooManyPixels
+	}
+
+	decoding <- struct{}{}
+	defer func() { <-decoding }()
+
+	decoded, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, Image{}, ErrUnsupported
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	if contentType == TypeJPEG {
+		img = orient(img, jpegOrientation(data))
+	}
+	if opts.Square {
+		img = cropSquare(img)
+	}
+
+	full, err := encode(fit(img, opts.MaxDimension), contentType)
+	if err != nil {
+		return Image{}, Image{}, err
+	}
+	thumbnail, err := encode(fit(img, opts.ThumbnailDimension), contentType)
+	if err != nil {
+		return Image{}, Image{}, err
+	}
+	return full, thumbnail, nil
+}
+
+func encode(img *image.RGBA, contentType string) (Image, error) {
+	var buf bytes.Buffer
+	var err error
+	ext := ".png"
+	if contentType == TypeJPEG {
+		ext = ".jpg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Data: buf.Bytes(), ContentType: contentType, Ext: ext, Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+}
+
+// cropSquare returns the square in the middle of img.
+func cropSquare(img *image.RGBA) *image.RGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	side := min(width, height)
+	x, y := (width-side)/2, (height-side)/2
+
+	result := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(result, result.Bounds(), img, image.Pt(x, y), draw.Src)
+	return result
+}
+
+// fit scales img down, keeping its aspect ratio, until neither side is longer
+// than maxDimension. Images that already fit are returned as they are.
+func fit(img *image.RGBA, maxDimension int) *image.RGBA {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if maxDimension <= 0 || width <= maxDimension && height <= maxDimension {
+		return img
+	}
+
+	if width >= height {
+		height = max(height*maxDimension/width, 1)
+		width = maxDimension
+	} else {
+		width = max(width*maxDimension/height, 1)
+		height = maxDimension
+	}
+	return resize(img, width, height)
+}
+
+// resize scales img down to width by height, each pixel of the result is the
+// average of the pixels of img it covers. The pixels of an RGBA are alpha
+// premultiplied so transparent pixels don't bleed their color into the average.
+func resize(img *image.RGBA, width int, height int) *image.RGBA {
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max((y+1)*srcHeight/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max((x+1)*srcWidth/width, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[sy*img.Stride+x0*4 : sy*img.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+
+			count := (x1 - x0) * (y1 - y0)
+			offset := y*result.Stride + x*4
+			for i := range sum {
+				result.Pix[offset+i] = uint8((sum[i] + count/2) / count)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package media_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/djmarkymark007/chirpy/internal/media"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: uint8(x % 256)})
+		}
+	}
+	data := encodePNG(t, img)
+
+	full, thumbnail, err := media.Process(data, media.Options{MaxDimension: 150, ThumbnailDimension: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.ContentType != media.TypePNG || full.Ext != ".png" || full.Width != 150 || full.Height != 100 {
+		t.Errorf("full: got %s %s %dx%d", full.ContentType, full.Ext, full.Width, full.Height)
+	}
+	if thumbnail.Width != 30 || thumbnail.Height != 20 {
+		t.Errorf("thumbnail: got %dx%d", thumbnail.Width, thumbnail.Height)
+	}
+	decoded, err := png.Decode(bytes.NewReader(full.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds().Dx() != 150 {
+		t.Errorf("decoded width: got %d", decoded.Bounds().Dx())
+	}
+	// transparent pixels don't darken the red of the ones next to them
+	if r, _, _, a := decoded.At(75, 50).RGBA(); a == 0 || r*0xffff/a < 0xfe00 {
+		t.Errorf("pixel at 75,50: got r %d a %d", r, a)
+	}
+
+	square, _, err := media.Process(data, media.Options{MaxDimension: 50, ThumbnailDimension: 10, Square: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if square.Width != 50 || square.Height != 50 {
+		t.Errorf("square: got %dx%d", square.Width, square.Height)
+	}
+
+	// small images aren't scaled up
+	small, _, err := media.Process(encodePNG(t, image.NewGray(image.Rect(0, 0, 10, 5))), media.Options{MaxDimension: 150, ThumbnailDimension: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.Width != 10 || small.Height != 5 {
+		t.Errorf("small: got %dx%d", small.Width, small.Height)
+	}
+}
+
+func TestProcessRejects(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	for name, data := range map[string][]byte{
+		"gif":       gif,
+		"text":      []byte("<html><script>alert(1)</script></html>"),
+		"empty":     nil,
+		"truncated": encodePNG(t, image.NewGray(image.Rect(0, 0, 10, 10)))[:40],
+	} {
+		_, _, err := media.Process(data, media.Options{})
+		if !errors.Is(err, media.ErrUnsupported) {
+			t.Errorf("%s: got %v, want ErrUnsupported", name, err)
+		}
+	}
+
+	// a png header claiming to be 100000x100000 is refused before decoding
+	var header bytes.Buffer
+	header.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 2 // rgb
+	binary.Write(&header, binary.BigEndian, uint32(13))
+	header.Write(ihdr)
+	binary.Write(&header, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+	_, _, err := media.Process(header.Bytes(), media.Options{})
+	if !errors.Is(err, media.ErrTooManyPixels) {
+		t.Errorf("huge png: got %v, want ErrTooManyPixels", err)
+	}
+}
+
+// withOrientation adds an exif segment with orientation to the jpeg in data.
+func withOrientation(data []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var result bytes.Buffer
+	result.Write(data[:2])
+	result.Write([]byte{0xFF, 0xE1})
+	binary.Write(&result, binary.BigEndian, uint16(len(segment)+2))
+	result.Write(segment)
+	result.Write(data[2:])
+	return result.Bytes()
+}
+
+func TestProcessOrientation(t *testing.T) {
+	// a 40x20 photo, white on the left half and black on the right, taken
+	// with the camera turned so it has to be turned a quarter clockwise
+	img := image.NewGray(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full, _, err := media.Process(withOrientation(buf.Bytes(), 6), media.Options{MaxDimension: 100, ThumbnailDimension: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.ContentType != media.TypeJPEG || full.Ext != ".jpg" || full.Width != 20 || full.Height != 40 {
+		t.Fatalf("full: got %s %s %dx%d", full.ContentType, full.Ext, full.Width, full.Height)
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(full.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// turned clockwise, the white left half ends up on top
+	if y := color.GrayModel.Convert(decoded.At(10, 5)).(color.Gray).Y; y < 200 {
+		t.Errorf("top: got %d, want white", y)
+	}
+	if y := color.GrayModel.Convert(decoded.At(10, 35)).(color.Gray).Y; y > 50 {
+		t.Errorf("bottom: got %d, want black", y)
+	}
+}
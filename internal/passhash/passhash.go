@@ -0,0 +1,156 @@
+// Package passhash hashes passwords with bcrypt or argon2id and checks them
+// against hashes made with either, so the algorithm can change without
+// anyone having to reset their password.
+package passhash
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+)
+
+var (
+	// ErrTooLong is returned for passwords longer than bcrypt can hash.
+	ErrTooLong     = errors.New("password is too long")
+	ErrUnknownHash = errors.New("unknown password hash")
+)
+
+// ParseAlgorithm checks algorithm is one Hasher can hash with, "" is
+// Argon2id.
+func ParseAlgorithm(algorithm string) (string, error) {
+	switch algorithm {
+	case "":
+		return Argon2id, nil
+	case Bcrypt, Argon2id:
+		return algorithm, nil
+	default:
+		return "", fmt.Errorf("unknown algorithm %q, want %s or %s", algorithm, Argon2id, Bcrypt)
+	}
+}
+
+// Argon2Params are the costs of an argon2id hash.
+type Argon2Params struct {
+	// Memory is in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2 are the least costs OWASP recommends for argon2id.
+var DefaultArgon2 = Argon2Params{Memory: 19 * 1024, Iterations: 2, Parallelism: 1}
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+var argon2Prefix = []byte("$argon2id$")
+
+// Hasher hashes new passwords with Algorithm, at BcryptCost or with Argon2.
+type Hasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// Hash hashes password with the algorithm and costs of the hasher.
+func (h Hasher) Hash(password string) ([]byte, error) {
+	switch h.Algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return nil, ErrTooLong
+		}
+		return hash, err
+	case Argon2id:
+		salt := make([]byte, saltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		return encodeArgon2(h.Argon2, salt, argon2Key(h.Argon2, password, salt, keyLength)), nil
+	default:
+		return nil, fmt.Errorf("hashing with %q: %w", h.Algorithm, ErrUnknownHash)
+	}
+}
+
+// Verify reports whether password is the one hash was made from, and if so
+// whether hash should be replaced with a new one because it was made with
+// another algorithm or other costs than the hasher uses now.
+func (h Hasher) Verify(hash []byte, password string) (ok bool, rehash bool, err error) {
+	if bytes.HasPrefix(hash, argon2Prefix) {
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, false, err
+		}
+		got := argon2Key(params, password, salt, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false, nil
+		}
+		return true, h.Algorithm != Argon2id || params != h.Argon2 || len(key) != keyLength, nil
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return false, false, ErrUnknownHash
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, h.Algorithm != Bcrypt || cost != h.BcryptCost, nil
+}
+
+func argon2Key(params Argon2Params, password string, salt []byte, length uint32) []byte {
+	return argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, length)
+}
+
+// encodeArgon2 encodes an argon2id hash in the PHC string format other
+// argon2 libraries use, like
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key> with unpadded base64.
+func encodeArgon2(params Argon2Params, salt []byte, key []byte) []byte {
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)))
+}
+
+func decodeArgon2(hash []byte) (Argon2Params, []byte, []byte, error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+	var params Argon2Params
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil || params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil || len(key) == 0 {
+		return Argon2Params{}, nil, nil, ErrUnknownHash
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,139 @@
+package passhash
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2 keeps the tests fast, the costs don't change what is tested.
+var cheapArgon2 = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, hasher := range []Hasher{
+		{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost},
+		{Algorithm: Argon2id, Argon2: cheapArgon2},
+	} {
+		t.Run(hasher.Algorithm, func(t *testing.T) {
+			hash, err := hasher.Hash("hunter22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := hasher.Hash("hunter22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(hash, again) {
+				t.Error("hashing twice gave the same hash, the salt isn't random")
+			}
+
+			ok, rehash, err := hasher.Verify(hash, "hunter22")
+			if err != nil || !ok || rehash {
+				t.Errorf("right password: got ok %t rehash %t err %v", ok, rehash, err)
+			}
+			ok, _, err = hasher.Verify(hash, "hunter23")
+			if err != nil || ok {
+				t.Errorf("wrong password: got ok %t err %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestArgon2Format(t *testing.T) {
+	hasher := Hasher{Algorithm: Argon2id, Argon2: cheapArgon2}
+	hash, err := hasher.Hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %s isn't in the PHC format", hash)
+	}
+
+	// the costs are read back from the hash, not taken from the hasher
+	params, _, key, err := decodeArgon2(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != cheapArgon2 || len(key) != keyLength {
+		t.Errorf("decoded %+v with a %d byte key", params, len(key))
+	}
+
+	for _, bad := range []string{
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ",
+		"$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8",
+		"$argon2id$v=19$m=0,t=1,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8",
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$!!",
+		"plain text",
+		"",
+	} {
+		_, _, err := hasher.Verify([]byte(bad), "password")
+		if !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("hash %q: got %v, want ErrUnknownHash", bad, err)
+		}
+	}
+}
+
+func TestRehash(t *testing.T) {
+	bcryptHasher := Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	argonHasher := Hasher{Algorithm: Argon2id, Argon2: cheapArgon2}
+	bcryptHash, err := bcryptHasher.Hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argonHash, err := argonHasher.Hash("hunter22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher Hasher
+		hash   []byte
+		rehash bool
+	}{
+		{"bcrypt preferring argon2id", argonHasher, bcryptHash, true},
+		{"argon2id preferring bcrypt", bcryptHasher, argonHash, true},
+		{"bcrypt at a higher cost", Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"argon2id with more memory", Hasher{Algorithm: Argon2id, Argon2: Argon2Params{Memory: 128, Iterations: 1, Parallelism: 1}}, argonHash, true},
+		{"bcrypt as it is", bcryptHasher, bcryptHash, false},
+		{"argon2id as it is", argonHasher, argonHash, false},
+	}
+	for _, test := range tests {
+		ok, rehash, err := test.hasher.Verify(test.hash, "hunter22")
+		if err != nil || !ok {
+			t.Errorf("%s: got ok %t err %v", test.name, ok, err)
+		}
+		if rehash != test.rehash {
+			t.Errorf("%s: got rehash %t, want %t", test.name, rehash, test.rehash)
+		}
+	}
+}
+
+func TestBcryptTooLong(t *testing.T) {
+	hasher := Hasher{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost}
+	_, err := hasher.Hash(strings.Repeat("x", 73))
+	if !errors.Is(err, ErrTooLong) {
+		t.Errorf("73 bytes: got %v, want ErrTooLong", err)
+	}
+
+	argonHasher := Hasher{Algorithm: Argon2id, Argon2: cheapArgon2}
+	_, err = argonHasher.Hash(strings.Repeat("x", 73))
+	if err != nil {
+		t.Errorf("73 bytes with argon2id: got %v", err)
+	}
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	for input, want := range map[string]string{"": Argon2id, "argon2id": Argon2id, "bcrypt": Bcrypt} {
+		got, err := ParseAlgorithm(input)
+		if err != nil || got != want {
+			t.Errorf("ParseAlgorithm(%q): got %q %v, want %q", input, got, err, want)
+		}
+	}
+	if _, err := ParseAlgorithm("md5"); err == nil {
+		t.Error("md5: want an error")
+	}
+}
@@ -0,0 +1,126 @@
+// Package totp implements the time based one time passwords of RFC 6238 as
+// authenticator apps use them: HMAC-SHA1, six digits, thirty second steps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is how many steps a code may be off by, to allow for clocks that
+	// are a little off and codes typed in as they change.
+	Skew = 1
+	// secretSize is the size of secrets in bytes, the 160 bits RFC 4226
+	// recommends.
+	secretSize = 20
+)
+
+var ErrBadSecret = errors.New("totp secret isn't base32")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded the way
+// authenticator apps take it.
+func GenerateSecret() (string, error) {
+	var secret [secretSize]byte
+	_, err := rand.Read(secret[:])
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret[:]), nil
+}
+
+// URI returns the otpauth:// URI authenticator apps enroll secret from,
+// usually shown as a QR code. The account is labelled as issuer:account.
+func URI(issuer string, account string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return uri.String()
+}
+
+// Step returns the number of the time step t is in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, Step(t), Digits), nil
+}
+
+// Validate checks code against secret at t, allowing Skew steps either way.
+// Steps up to and including after don't count, so passing the step of the
+// last code used keeps a code from being used twice. It returns the step the
+// code was for.
+func Validate(secret string, code string, t time.Time, after int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= after {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp is the HOTP value of RFC 4226 for counter, digits long.
+func hotp(key []byte, counter int64, digits int) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for range digits {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// decodeSecret decodes a base32 secret, ignoring case, spaces and padding
+// since people type them in by hand.
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrBadSecret
+	}
+	return key, nil
+}
@@ -0,0 +1,135 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors in RFC 6238 appendix B.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestRFC6238Vectors(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	key, err := decodeSecret(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vector := range vectors {
+		at := time.Unix(vector.unix, 0)
+		if got := hotp(key, Step(at), 8); got != vector.code {
+			t.Errorf("8 digit code at %d: got %s, want %s", vector.unix, got, vector.code)
+		}
+		// six digits are the last six of the eight
+		got, err := Code(rfcSecret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := vector.code[2:]; got != want {
+			t.Errorf("code at %d: got %s, want %s", vector.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	current, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := Validate(secret, current, now, 0)
+	if !ok || step != Step(now) {
+		t.Errorf("current code: got step %d ok %t, want step %d", step, ok, Step(now))
+	}
+
+	previous, _ := Code(secret, now.Add(-Period))
+	if _, ok := Validate(secret, previous, now, 0); !ok {
+		t.Errorf("code from the step before is refused")
+	}
+	old, _ := Code(secret, now.Add(-2*Period))
+	if _, ok := Validate(secret, old, now, 0); ok {
+		t.Errorf("code from two steps before is accepted")
+	}
+
+	if _, ok := Validate(secret, current, now, Step(now)); ok {
+		t.Errorf("code of a used step is accepted")
+	}
+	if _, ok := Validate(secret, previous, now, Step(now)-1); ok {
+		t.Errorf("code older than a used step is accepted")
+	}
+
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(secret, bad, now, 0); ok {
+			t.Errorf("code %q is accepted", bad)
+		}
+	}
+	if _, ok := Validate("not base32!", current, now, 0); ok {
+		t.Errorf("bad secret is accepted")
+	}
+}
+
+func TestSecretIsForgiving(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("secret %q: got %d characters, want 32", secret, len(secret))
+	}
+
+	now := time.Now()
+	want, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typed := ""
+	for i, r := range secret {
+		if i > 0 && i%4 == 0 {
+			typed += " "
+		}
+		typed += string(r | 0x20)
+	}
+	got, err := Code(typed, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("code for %q: got %s, want %s", typed, got, want)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Chirpy", "ann@example.com", "JBSWY3DPEHPK3PXP")
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/Chirpy:ann@example.com" {
+		t.Errorf("uri %s: wrong scheme, type or label", uri)
+	}
+	query := parsed.Query()
+	want := map[string]string{"secret": "JBSWY3DPEHPK3PXP", "issuer": "Chirpy", "algorithm": "SHA1", "digits": "6", "period": "30"}
+	for key, value := range want {
+		if query.Get(key) != value {
+			t.Errorf("uri %s: %s is %q, want %q", uri, key, query.Get(key), value)
+		}
+	}
+}
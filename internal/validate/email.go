@@ -0,0 +1,78 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MaxEmailLength      = 254
+	MaxEmailLocalLength = 64
+	maxDomainLabel      = 63
+)
+
+// atext are the characters besides letters and digits an unquoted local
+// part can have, RFC 5322 section 3.2.3.
+const atext = "!#$%&'*+-/=?^_`{|}~"
+
+// Email checks email is a bare address like ann@example.com. Quoted local
+// parts, comments, display names and ip address literals are all valid in
+// RFC 5322 but refused here since no one signs up with them, as are
+// internationalized addresses. The domain must have at least two labels.
+func Email(email string) error {
+	if email == "" {
+		return errors.New("email is required")
+	}
+	if len(email) > MaxEmailLength {
+		return fmt.Errorf("email can be at most %d characters", MaxEmailLength)
+	}
+
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return errors.New("email must have an @")
+	}
+	local, domain := email[:at], email[at+1:]
+	if local == "" || len(local) > MaxEmailLocalLength {
+		return fmt.Errorf("the part of an email before the @ must be 1 to %d characters", MaxEmailLocalLength)
+	}
+	if strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, "..") {
+		return errors.New("the part of an email before the @ can't start or end with a dot or have two in a row")
+	}
+	for _, r := range local {
+		if !isAlnum(r) && r != '.' && !strings.ContainsRune(atext, r) {
+			return fmt.Errorf("email can't have %q before the @", r)
+		}
+	}
+	return emailDomain(domain)
+}
+
+// emailDomain checks domain is a host name with at least two labels of
+// letters, digits and hyphens and a top level domain that isn't a number.
+func emailDomain(domain string) error {
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return errors.New("email must have a domain like example.com after the @")
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > maxDomainLabel {
+			return errors.New("email domain has an empty or too long part")
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errors.New("email domain parts can't start or end with a hyphen")
+		}
+		for _, r := range label {
+			if !isAlnum(r) && r != '-' {
+				return fmt.Errorf("email domain can't have %q", r)
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return errors.New("email domain can't end in a number")
+	}
+	return nil
+}
+
+func isAlnum(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+}
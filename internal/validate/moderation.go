@@ -0,0 +1,22 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const MaxReasonLength = 500
+
+// ReportReason checks the reason a report is filed with says something and
+// isn't too long.
+func ReportReason(reason string) error {
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("a report needs a reason")
+	}
+	if utf8.RuneCountInString(reason) > MaxReasonLength {
+		return fmt.Errorf("reason can be at most %d characters", MaxReasonLength)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package validate
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 128
+	// minSimilarPart is how long the part of an email before the @ has to be
+	// for a password that contains it to be too similar. Shorter ones, like
+	// "al", turn up in good passwords by chance.
+	minSimilarPart = 4
+)
+
+// PasswordPolicyOptions configure a PasswordPolicy, zero values are the
+// defaults.
+type PasswordPolicyOptions struct {
+	// MinLength and MaxLength bound the length in characters, they default
+	// to MinPasswordLength and MaxPasswordLength.
+	MinLength int
+	MaxLength int
+	// BreachedFiles hold passwords known from breaches, one per line, which
+	// are refused. A line can also be the SHA-1 of a password in hex with an
+	// optional :count after it, the format of the Pwned Passwords downloads.
+	// Blank lines and lines starting with # are skipped.
+	BreachedFiles []string
+}
+
+// PasswordPolicy decides which passwords are good enough.
+type PasswordPolicy struct {
+	minLength int
+	maxLength int
+	breached  map[[sha1.Size]byte]struct{}
+}
+
+// LoadPasswordPolicy returns the policy opts describe, reading the breached
+// password lists.
+func LoadPasswordPolicy(opts PasswordPolicyOptions) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		minLength: opts.MinLength,
+		maxLength: opts.MaxLength,
+		breached:  make(map[[sha1.Size]byte]struct{}),
+	}
+	if policy.minLength <= 0 {
+		policy.minLength = MinPasswordLength
+	}
+	if policy.maxLength <= 0 {
+		policy.maxLength = MaxPasswordLength
+	}
+	if policy.minLength > policy.maxLength {
+		return nil, fmt.Errorf("passwords can't be at least %d and at most %d characters", policy.minLength, policy.maxLength)
+	}
+
+	for _, path := range opts.BreachedFiles {
+		err := policy.readBreached(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// Breached returns how many passwords the breached password lists have.
+func (policy *PasswordPolicy) Breached() int {
+	return len(policy.breached)
+}
+
+// Check checks password is long enough, isn't known from a breach and isn't
+// too much like email, the email of the account it is for.
+func (policy *PasswordPolicy) Check(password string, email string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+	length := utf8.RuneCountInString(password)
+	if length < policy.minLength || length > policy.maxLength {
+		return fmt.Errorf("password must be %d to %d characters", policy.minLength, policy.maxLength)
+	}
+	if _, found := policy.breached[sha1.Sum([]byte(password))]; found {
+		return errors.New("password is known from a data breach, pick another one")
+	}
+	if similarToEmail(password, email) {
+		return errors.New("password is too much like your email")
+	}
+	return nil
+}
+
+// similarToEmail reports whether password is the email, or has the part of
+// it before the @ in it, ignoring case and anything but letters and digits.
+func similarToEmail(password string, email string) bool {
+	password = lettersAndDigits(password)
+	if email == "" || password == "" {
+		return false
+	}
+	if password == lettersAndDigits(email) {
+		return true
+	}
+
+	local, _, _ := strings.Cut(email, "@")
+	local = lettersAndDigits(local)
+	if len(local) < minSimilarPart {
+		return false
+	}
+	return strings.Contains(password, local) || strings.Contains(local, password)
+}
+
+func lettersAndDigits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+func (policy *PasswordPolicy) readBreached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		policy.breached[breachedKey(line)] = struct{}{}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// breachedKey returns the SHA-1 of the password on a line of a breached
+// password list, which is either the password or already its SHA-1.
+func breachedKey(line string) [sha1.Size]byte {
+	hash, _, _ := strings.Cut(line, ":")
+	var key [sha1.Size]byte
+	if len(hash) == hex.EncodedLen(sha1.Size) {
+		_, err := hex.Decode(key[:], []byte(hash))
+		if err == nil {
+			return key
+		}
+	}
+	return sha1.Sum([]byte(line))
+}
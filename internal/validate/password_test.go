@@ -0,0 +1,80 @@
+package validate_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	sum := sha1.Sum([]byte("correct horse"))
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	list := "# plain and hashed passwords\npassword123\n\n" + strings.ToUpper(hex.EncodeToString(sum[:])) + ":42\n"
+	err := os.WriteFile(breached, []byte(list), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{BreachedFiles: []string{breached}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Breached() != 2 {
+		t.Errorf("breached passwords: got %d, want 2", policy.Breached())
+	}
+
+	tests := []struct {
+		password string
+		email    string
+		ok       bool
+	}{
+		{"", "ann@example.com", false},
+		{"short", "ann@example.com", false},
+		{"eight ch", "ann@example.com", true},
+		{"ééééééé", "ann@example.com", false},
+		{strings.Repeat("x", validate.MaxPasswordLength), "ann@example.com", true},
+		{strings.Repeat("x", validate.MaxPasswordLength+1), "ann@example.com", false},
+		{"password123", "ann@example.com", false},
+		{"Password123", "ann@example.com", true},
+		{"correct horse", "ann@example.com", false},
+		{"annabelle@example.com", "annabelle@example.com", false},
+		{"Annabelle-1990", "annabelle@example.com", false},
+		{"jean.luc.pic", "jean.luc.picard@example.com", false},
+		// short local parts turn up in good passwords by chance
+		{"planning ahead", "ann@example.com", true},
+		{"a long passphrase", "", true},
+	}
+	for _, test := range tests {
+		err := policy.Check(test.password, test.email)
+		if (err == nil) != test.ok {
+			t.Errorf("Check(%q, %q): got %v, want ok %t", test.password, test.email, err, test.ok)
+		}
+	}
+}
+
+func TestPasswordPolicyOptions(t *testing.T) {
+	policy, err := validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{MinLength: 12, MaxLength: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Check("eleven char", "") == nil {
+		t.Error("11 characters with a minimum of 12: want an error")
+	}
+	if err := policy.Check("twelve chars", ""); err != nil {
+		t.Errorf("12 characters: got %v", err)
+	}
+
+	_, err = validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{MinLength: 30, MaxLength: 20})
+	if err == nil {
+		t.Error("minimum over maximum: want an error")
+	}
+	_, err = validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{BreachedFiles: []string{filepath.Join(t.TempDir(), "missing.txt")}})
+	if err == nil {
+		t.Error("missing breached list: want an error")
+	}
+}
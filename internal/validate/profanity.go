@@ -0,0 +1,426 @@
+package validate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// FilterMode is what happens to a chirp with profanity in it.
+type FilterMode string
+
+const (
+	// FilterMask replaces each profane word with ****.
+	FilterMask FilterMode = "mask"
+	// FilterReject refuses the chirp.
+	FilterReject FilterMode = "reject"
+	// FilterReview lets the chirp through as it is and flags it for a moderator.
+	FilterReview FilterMode = "review"
+)
+
+// mask is what a profane word is replaced with.
+const mask = "****"
+
+// ParseFilterMode reads a FilterMode, "" is FilterMask.
+func ParseFilterMode(mode string) (FilterMode, error) {
+	switch FilterMode(mode) {
+	case "", FilterMask:
+		return FilterMask, nil
+	case FilterReject, FilterReview:
+		return FilterMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown profanity filter mode %q, want mask, reject or review", mode)
+	}
+}
+
+// FilterOptions are where a Filter gets its word lists from.
+type FilterOptions struct {
+	// WordFiles hold the words to filter, one per line, Profane is used when
+	// there are none. A word ending in * also matches words starting with it
+	// and a word between two *s matches anywhere inside a word.
+	WordFiles []string
+	// AllowFiles hold words that are never filtered, even when a word from
+	// WordFiles matches them.
+	AllowFiles []string
+	Mode       FilterMode
+}
+
+// FilterResult is what a Filter found in a text.
+type FilterResult struct {
+	// Masked is the text with every match replaced with ****.
+	Masked string
+	// Matches are the normalized words that matched, in the order they occur.
+	Matches []string
+}
+
+func (result FilterResult) Profane() bool {
+	return len(result.Matches) != 0
+}
+
+// Filter finds profanity in text. Text is normalized before it is matched so
+// case, accents, compatibility characters like full width letters, common
+// leetspeak like k3rfuffl3 and punctuation inside a word like k.e.r.f.u.f.f.l.e
+// don't get a word past it. It is safe for concurrent use and its word lists
+// can be reloaded while it is in use.
+type Filter struct {
+	opts FilterOptions
+
+	mu       sync.RWMutex
+	words    *wordList
+	modTimes map[string]time.Time
+}
+
+// NewFilter returns a Filter for the words and allowlist given.
+func NewFilter(words []string, allow []string, mode FilterMode) *Filter {
+	return &Filter{opts: FilterOptions{Mode: mode}, words: newWordList(words, allow)}
+}
+
+// LoadFilter returns a Filter with the word lists in the files of opts.
+func LoadFilter(opts FilterOptions) (*Filter, error) {
+	filter := &Filter{opts: opts}
+	err := filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (f *Filter) Mode() FilterMode {
+	if f.opts.Mode == "" {
+		return FilterMask
+	}
+	return f.opts.Mode
+}
+
+// Reload reads the word lists from their files again. The lists in use are
+// only replaced once every file has been read.
+func (f *Filter) Reload() error {
+	modTimes := make(map[string]time.Time)
+	words, err := readWordFiles(f.opts.WordFiles, modTimes)
+	if err != nil {
+		return err
+	}
+	if len(f.opts.WordFiles) == 0 {
+		words = Profane[:]
+	}
+	allow, err := readWordFiles(f.opts.AllowFiles, modTimes)
+	if err != nil {
+		return err
+	}
+
+	list := newWordList(words, allow)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.words = list
+	f.modTimes = modTimes
+	return nil
+}
+
+// Watch checks the word files every interval and reloads them when one has
+// changed. onReload, if not nil, is called with the result of each reload.
+// The returned func stops watching.
+func (f *Filter) Watch(interval time.Duration, onReload func(err error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !f.changed() {
+					continue
+				}
+				err := f.Reload()
+				if onReload != nil {
+					onReload(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// changed reports whether any of the word files was modified since it was
+// last read.
+func (f *Filter) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for path, modTime := range f.modTimes {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// readWordFiles reads the words out of paths, one per line. Blank lines and
+// lines starting with # are skipped. The modification time of each file is
+// put in modTimes.
+func readWordFiles(paths []string, modTimes map[string]time.Time) ([]string, error) {
+	var words []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		modTimes[path] = info.ModTime()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return words, nil
+}
+
+// Check finds the profanity in text.
+func (f *Filter) Check(text string) FilterResult {
+	f.mu.RLock()
+	words := f.words
+	f.mu.RUnlock()
+
+	runes := []rune(text)
+	var out strings.Builder
+	var matches []string
+	last := 0
+	for _, chunk := range scan(runes) {
+		for _, span := range words.match(chunk) {
+			start, end := chunk[span.first].start, chunk[span.last].end
+			out.WriteString(string(runes[last:start]))
+			out.WriteString(mask)
+			last = end
+			matches = append(matches, span.word)
+		}
+	}
+	out.WriteString(string(runes[last:]))
+	return FilterResult{Masked: out.String(), Matches: matches}
+}
+
+// wordList is a list of words to filter ready to be matched against.
+type wordList struct {
+	exact    map[string]bool
+	prefixes []string
+	infixes  []string
+	allow    map[string]bool
+	// maxExact is the length of the longest exact word, no longer run of
+	// tokens can match one
+	maxExact int
+}
+
+func newWordList(words []string, allow []string) *wordList {
+	list := &wordList{exact: make(map[string]bool), allow: make(map[string]bool)}
+	for _, word := range words {
+		prefix := strings.HasSuffix(word, "*")
+		infix := prefix && len(word) > 1 && strings.HasPrefix(word, "*")
+		normalized := normalizeWord(strings.Trim(word, "*"))
+		switch {
+		case normalized == "":
+		case infix:
+			list.infixes = append(list.infixes, normalized)
+		case prefix:
+			list.prefixes = append(list.prefixes, normalized)
+		default:
+			list.exact[normalized] = true
+			list.maxExact = max(list.maxExact, len(normalized))
+		}
+	}
+	for _, word := range allow {
+		if normalized := normalizeWord(word); normalized != "" {
+			list.allow[normalized] = true
+		}
+	}
+	return list
+}
+
+// token is a run of letters and digits in a text, normalized. start and end
+// are the rune offsets it covers in the text.
+type token struct {
+	text  string
+	start int
+	end   int
+}
+
+// tokenSpan is a run of tokens, first to last, that matched word.
+type tokenSpan struct {
+	first int
+	last  int
+	word  string
+}
+
+// match finds the words in a chunk of tokens. A run of tokens in the chunk
+// that spells out an exact word matches, longest run first, as does a
+// single token that a prefix or infix word matches.
+func (list *wordList) match(chunk []token) []tokenSpan {
+	var result []tokenSpan
+	for i := 0; i < len(chunk); i++ {
+		span := tokenSpan{first: i, last: -1}
+		joined := ""
+		for j := i; j < len(chunk); j++ {
+			joined += chunk[j].text
+			if len(joined) > list.maxExact {
+				break
+			}
+			if list.exact[joined] && !list.allow[joined] {
+				span.last, span.word = j, joined
+			}
+		}
+		if span.last < 0 && list.matchesPart(chunk[i].text) {
+			span.last, span.word = i, chunk[i].text
+		}
+		if span.last >= 0 {
+			result = append(result, span)
+			i = span.last
+		}
+	}
+	return result
+}
+
+// matchesPart reports whether a prefix or infix word matches word.
+func (list *wordList) matchesPart(word string) bool {
+	if list.allow[word] {
+		return false
+	}
+	for _, prefix := range list.prefixes {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	for _, infix := range list.infixes {
+		if strings.Contains(word, infix) {
+			return true
+		}
+	}
+	return false
+}
+
+// leet maps the digits and symbols that are used in place of letters to the
+// letter. Symbols only count as a letter between two letters or digits, so
+// a mention like @name or a price like $5 keeps its symbol.
+var leet = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's',
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// scan splits text into chunks at white space, and each chunk into tokens at
+// punctuation. Invisible characters like zero width spaces are skipped over
+// without splitting anything.
+func scan(runes []rune) [][]token {
+	caser := cases.Fold()
+	var chunks [][]token
+	var chunk []token
+	var current *token
+	var text strings.Builder
+
+	endToken := func() {
+		if current != nil {
+			current.text = text.String()
+			chunk = append(chunk, *current)
+			current = nil
+			text.Reset()
+		}
+	}
+	extend := func(i int, s string) {
+		if current == nil {
+			current = &token{start: i}
+		}
+		text.WriteString(s)
+		current.end = i + 1
+	}
+
+	for i, r := range runes {
+		if unicode.IsSpace(r) {
+			endToken()
+			if len(chunk) != 0 {
+				chunks = append(chunks, chunk)
+				chunk = nil
+			}
+			continue
+		}
+
+		normalized := normalizeRune(caser, r)
+		switch {
+		case normalized == "" || unicode.Is(unicode.Cf, r):
+			if current != nil {
+				current.end = i + 1
+			}
+		case isWord(normalized):
+			extend(i, normalized)
+		case leet[r] != 0 && i > 0 && i+1 < len(runes) && isWordRune(runes[i-1]) && isWordRune(runes[i+1]):
+			extend(i, string(leet[r]))
+		default:
+			endToken()
+		}
+	}
+	endToken()
+	if len(chunk) != 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// normalizeRune returns r decomposed, compatibility characters included, with
+// accents and other combining marks dropped and case folded, with digits
+// swapped for the letter they stand in for.
+func normalizeRune(caser cases.Caser, r rune) string {
+	var result strings.Builder
+	for _, d := range caser.String(norm.NFKD.String(string(r))) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		if unicode.IsDigit(d) && leet[d] != 0 {
+			d = leet[d]
+		}
+		result.WriteRune(d)
+	}
+	return result.String()
+}
+
+func isWord(s string) bool {
+	for _, r := range s {
+		if !isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeWord normalizes a word from a word list the same way text is, so
+// it is spelled the way the tokens it has to match are.
+func normalizeWord(word string) string {
+	var result strings.Builder
+	for _, chunk := range scan([]rune(word)) {
+		for _, token := range chunk {
+			result.WriteString(token.text)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,114 @@
+package validate_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+func TestFilter(t *testing.T) {
+	filter := validate.NewFilter([]string{"kerfuffle", "sharbert", "fornax*", "*frick*"}, []string{"africk"}, validate.FilterMask)
+
+	tests := map[string]string{
+		"a kerfuffle!":              "a ****!",
+		"(Kerfuffle), kerfuffle?":   "(****), ****?",
+		"a Kérfüfflé":               "a ****",
+		"a ＫＥＲＦＵＦＦＬＥ":               "a ****",
+		"a k3rfuffl3":               "a ****",
+		"a k.e.r.f.u.f.f.l.e":       "a ****",
+		"a ker-fuffle":              "a ****",
+		"a ker​fuffle":              "a ****",
+		"sh@rbert and @sharbert":    "**** and @****",
+		"kerfuffle,sharbert":        "****,****",
+		"fornaxes and fornax":       "**** and ****",
+		"africk unfricking africk":  "africk **** africk",
+		"kerfuffles":                "kerfuffles",
+		"the kerf of a fuffle":      "the kerf of a fuffle",
+		"email me at a@b.com or $5": "email me at a@b.com or $5",
+	}
+	for text, want := range tests {
+		if got := filter.Check(text).Masked; got != want {
+			t.Errorf("Check(%q): got %q, want %q", text, got, want)
+		}
+	}
+
+	result := filter.Check("Sharbert, k3rfuffle and a cat")
+	if !result.Profane() || !reflect.DeepEqual(result.Matches, []string{"sharbert", "kerfuffle"}) {
+		t.Errorf("matches: got %v", result.Matches)
+	}
+	if filter.Check("a clean chirp").Profane() {
+		t.Error("clean chirp: got profane")
+	}
+}
+
+func TestParseFilterMode(t *testing.T) {
+	for mode, want := range map[string]validate.FilterMode{"": validate.FilterMask, "reject": validate.FilterReject, "review": validate.FilterReview} {
+		got, err := validate.ParseFilterMode(mode)
+		if err != nil || got != want {
+			t.Errorf("ParseFilterMode(%q): got %q, %v", mode, got, err)
+		}
+	}
+	if _, err := validate.ParseFilterMode("delete"); err == nil {
+		t.Error("ParseFilterMode(delete): want an error")
+	}
+}
+
+func TestFilterReload(t *testing.T) {
+	dir := t.TempDir()
+	words := filepath.Join(dir, "words.txt")
+	allow := filepath.Join(dir, "allow.txt")
+	err := os.WriteFile(words, []byte("# words\nkerfuffle\n\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(allow, []byte("sharbert\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := validate.LoadFilter(validate.FilterOptions{WordFiles: []string{words}, AllowFiles: []string{allow}, Mode: validate.FilterReview})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Mode() != validate.FilterReview {
+		t.Errorf("mode: got %s", filter.Mode())
+	}
+	if got := filter.Check("kerfuffle fornax sharbert").Masked; got != "**** fornax sharbert" {
+		t.Errorf("before reload: got %q", got)
+	}
+
+	reloaded := make(chan error, 1)
+	stop := filter.Watch(10*time.Millisecond, func(err error) { reloaded <- err })
+	defer stop()
+
+	err = os.WriteFile(words, []byte("fornax\nsharbert\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make sure the change shows even where file times are coarse
+	err = os.Chtimes(words, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("word list wasn't reloaded")
+	}
+	if got := filter.Check("kerfuffle fornax sharbert").Masked; got != "kerfuffle **** sharbert" {
+		t.Errorf("after reload: got %q", got)
+	}
+
+	_, err = validate.LoadFilter(validate.FilterOptions{WordFiles: []string{filepath.Join(dir, "missing.txt")}})
+	if err == nil {
+		t.Error("missing word file: want an error")
+	}
+}
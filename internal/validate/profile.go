@@ -0,0 +1,72 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+)
+
+const (
+	MinHandleLength      = 3
+	MaxHandleLength      = 15
+	MaxDisplayNameLength = 50
+	MaxBioLength         = 160
+	MaxAvatarUrlLength   = 2048
+)
+
+// Handle checks a handle is 3 to 15 ascii letters, digits and underscores
+// with at least one letter, so a handle can never be mistaken for a user id.
+func Handle(handle string) error {
+	if len(handle) < MinHandleLength || len(handle) > MaxHandleLength {
+		return fmt.Errorf("handle must be %d to %d characters", MinHandleLength, MaxHandleLength)
+	}
+
+	hasLetter := false
+	for _, r := range handle {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+			hasLetter = true
+		case '0' <= r && r <= '9', r == '_':
+		default:
+			return errors.New("handle can only have letters, digits and underscores")
+		}
+	}
+	if !hasLetter {
+		return errors.New("handle must have a letter")
+	}
+	return nil
+}
+
+// DisplayName checks a display name isn't too long.
+func DisplayName(name string) error {
+	if utf8.RuneCountInString(name) > MaxDisplayNameLength {
+		return fmt.Errorf("display name can be at most %d characters", MaxDisplayNameLength)
+	}
+	return nil
+}
+
+// Bio checks a bio isn't too long.
+func Bio(bio string) error {
+	if utf8.RuneCountInString(bio) > MaxBioLength {
+		return fmt.Errorf("bio can be at most %d characters", MaxBioLength)
+	}
+	return nil
+}
+
+// AvatarUrl checks an avatar url is an absolute http or https url, or empty
+// for no avatar.
+func AvatarUrl(avatarUrl string) error {
+	if avatarUrl == "" {
+		return nil
+	}
+	if len(avatarUrl) > MaxAvatarUrlLength {
+		return fmt.Errorf("avatar url can be at most %d characters", MaxAvatarUrlLength)
+	}
+
+	u, err := url.Parse(avatarUrl)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("avatar url must be an http or https url")
+	}
+	return nil
+}
@@ -1,21 +1,15 @@
 package validate
 
-import "strings"
-
+// Profane is the word list a Filter uses when it isn't given one.
 var Profane = [3]string{
 	"kerfuffle",
 	"sharbert",
 	"fornax",
 }
 
+var defaultFilter = NewFilter(Profane[:], nil, FilterMask)
+
+// ProfaneFilter masks the Profane words in msg.
 func ProfaneFilter(msg string) string {
-	words := strings.Split(msg, " ")
-	for index, word := range words {
-		for _, banWord := range Profane {
-			if strings.ToLower(word) == banWord {
-				words[index] = "****"
-			}
-		}
-	}
-	return strings.Join(words, " ")
+	return defaultFilter.Check(msg).Masked
 }
@@ -1,6 +1,7 @@
 package validate_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/djmarkymark007/chirpy/internal/validate"
@@ -25,7 +26,7 @@ func TestProfaneFilter(t *testing.T) {
 	})
 	t.Run("punctuation", func(t *testing.T) {
 		msg := "This is a Kerfuffle. opinion I need to share with the world"
-		want := "This is a Kerfuffle. opinion I need to share with the world"
+		want := "This is a ****. opinion I need to share with the world"
 		got := validate.ProfaneFilter(msg)
 		if got != want {
 			t.Errorf("got %s want %s\n", got, want)
@@ -43,3 +44,95 @@ func TestProfaneFilter(t *testing.T) {
 		}
 	})
 }
+
+func TestHandle(t *testing.T) {
+	valid := []string{"bob", "Bob_99", "_x_", "a23", "fifteen_chars_x"}
+	for _, handle := range valid {
+		if err := validate.Handle(handle); err != nil {
+			t.Errorf("Handle(%q) = %s, want nil", handle, err)
+		}
+	}
+
+	invalid := []string{"", "ab", "sixteen_chars_xx", "123", "___", "bob!", "bob smith", "bób", "bob@example"}
+	for _, handle := range invalid {
+		if err := validate.Handle(handle); err == nil {
+			t.Errorf("Handle(%q) = nil, want an error", handle)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	if err := validate.DisplayName(strings.Repeat("é", validate.MaxDisplayNameLength)); err != nil {
+		t.Errorf("DisplayName at the limit: %s", err)
+	}
+	if err := validate.DisplayName(strings.Repeat("a", validate.MaxDisplayNameLength+1)); err == nil {
+		t.Error("DisplayName over the limit: want an error")
+	}
+	if err := validate.Bio(strings.Repeat("a", validate.MaxBioLength+1)); err == nil {
+		t.Error("Bio over the limit: want an error")
+	}
+
+	for _, avatarUrl := range []string{"", "https://example.com/a.png", "http://example.com/a"} {
+		if err := validate.AvatarUrl(avatarUrl); err != nil {
+			t.Errorf("AvatarUrl(%q) = %s, want nil", avatarUrl, err)
+		}
+	}
+	for _, avatarUrl := range []string{"example.com/a.png", "ftp://example.com/a", "javascript:alert(1)", "https://"} {
+		if err := validate.AvatarUrl(avatarUrl); err == nil {
+			t.Errorf("AvatarUrl(%q) = nil, want an error", avatarUrl)
+		}
+	}
+}
+
+func TestReportReason(t *testing.T) {
+	if err := validate.ReportReason("spam"); err != nil {
+		t.Errorf("ReportReason(spam) = %s, want nil", err)
+	}
+	for _, reason := range []string{"", "  \n", strings.Repeat("a", validate.MaxReasonLength+1)} {
+		if err := validate.ReportReason(reason); err == nil {
+			t.Errorf("ReportReason(%q) = nil, want an error", reason)
+		}
+	}
+}
+
+func TestEmail(t *testing.T) {
+	valid := []string{
+		"ann@example.com",
+		"Ann.Lee+chirpy@mail.example.co.uk",
+		"o'brien@example.com",
+		"x@a-b.io",
+		strings.Repeat("a", validate.MaxEmailLocalLength) + "@example.com",
+	}
+	for _, email := range valid {
+		if err := validate.Email(email); err != nil {
+			t.Errorf("Email(%q) = %s, want nil", email, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"ann",
+		"ann@",
+		"@example.com",
+		"ann@example",
+		"ann@@example.com",
+		"ann@exa mple.com",
+		".ann@example.com",
+		"ann.@example.com",
+		"an..n@example.com",
+		"ann@-example.com",
+		"ann@example..com",
+		"ann@127.0.0.1",
+		"Ann <ann@example.com>",
+		"ann@example.com\r\nBcc: everyone@example.com",
+		"ånn@example.com",
+		strings.Repeat("a", validate.MaxEmailLocalLength+1) + "@example.com",
+		"ann@" + strings.Repeat("a", 64) + ".com",
+		"ann@" + strings.Repeat("abcdefgh.", 28) + "com",
+	}
+	for _, email := range invalid {
+		if err := validate.Email(email); err == nil {
+			t.Errorf("Email(%q) = nil, want an error", email)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+)
+
+// loadKeyring loads the keys tokens are signed and verified with. JWT_KEYS
+// lists PEM files of RSA or Ed25519 keys: the first signs new tokens and the
+// rest, which can be public keys, keep verifying tokens signed before a key
+// rotation. Without JWT_KEYS tokens are signed with the JWT_SECRET HMAC
+// secret. With both, JWT_SECRET only verifies, so tokens from before the
+// switch keep working until they expire.
+func loadKeyring() *authorize.Keyring {
+	var keys []authorize.Key
+	for _, path := range listFromEnv("JWT_KEYS") {
+		key, err := authorize.LoadKey(path)
+		if err != nil {
+			log.Fatalf("JWT_KEYS: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		keys = append(keys, authorize.NewHMACKey(secret))
+	}
+	if len(keys) == 0 {
+		log.Fatal("set JWT_SECRET or JWT_KEYS to sign tokens with")
+	}
+
+	keyring, err := authorize.NewKeyring(keys[0], keys[1:]...)
+	if err != nil {
+		log.Fatalf("JWT_KEYS: %s", err)
+	}
+	return keyring
+}
+
+// getJWKS serves the public keys tokens are signed with so other services
+// can verify them.
+func getJWKS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJson(w, 200, config.jwtKeys.JWKS())
+}
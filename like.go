@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+func postLike(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postLike ---")
+	changeChirp(w, r, actionLike, func(userId int, chirpId int) (database.Chirp, error) {
+		return db.LikeChirp(userId, chirpId, time.Now().UTC())
+	})
+}
+
+func deleteLike(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteLike ---")
+	changeChirp(w, r, "", db.UnlikeChirp)
+}
+
+func postRechirp(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postRechirp ---")
+	changeChirp(w, r, actionChirp, func(userId int, chirpId int) (database.Chirp, error) {
+		return db.Rechirp(userId, chirpId, time.Now().UTC())
+	})
+}
+
+func deleteRechirp(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteRechirp ---")
+	changeChirp(w, r, "", db.Unrechirp)
+}
+
+// changeChirp runs change for the logged in user on the chirp in the path and
+// responds with the chirp it returns. Liking or rechirping a rechirp acts on
+// the chirp that was rechirped. Suspended accounts are kept from action and
+// unverified ones may be, undoing one is always allowed and passes "".
+func changeChirp(w http.ResponseWriter, r *http.Request, action string, change func(userId int, chirpId int) (database.Chirp, error)) {
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if action != "" && checkSuspended(w, userId) {
+		return
+	}
+	if checkVerified(w, userId, action) {
+		return
+	}
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	chirpId, err = originalChirpId(chirpId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	chirp, err := change(userId, chirpId)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	err = addAuthorHandles(&chirp)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, chirp)
+}
+
+// originalChirpId returns the id of the chirp that chirpId rechirps, or
+// chirpId itself when it isn't a rechirp.
+func originalChirpId(chirpId int) (int, error) {
+	chirp, err := db.GetChirpById(chirpId)
+	if err != nil {
+		return 0, err
+	}
+	if chirp.RechirpOf != 0 {
+		return chirp.RechirpOf, nil
+	}
+	return chirpId, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/lockout"
+	"github.com/djmarkymark007/chirpy/internal/passhash"
+)
+
+// loginLimits are the failed login counters, per account and per address.
+// They are kept in memory, a restart forgets them.
+type loginLimits struct {
+	accounts  *lockout.Limiter
+	addresses *lockout.Limiter
+	// lockout is how long a lockout lasts, for the audit log
+	lockout time.Duration
+	// dummyHash is compared against when someone logs in with an email no
+	// account has, so it takes as long as for one that has
+	dummyHash []byte
+}
+
+// loadLoginLimits reads the limits on failed logins from the environment.
+// An account is locked out after LOGIN_MAX_FAILURES failures in a row and an
+// address, which may be shared by many people, after LOGIN_IP_MAX_FAILURES.
+func loadLoginLimits(hasher passhash.Hasher) loginLimits {
+	config := lockout.Config{
+		Backoff:    durationFromEnv("LOGIN_BACKOFF", time.Second),
+		MaxBackoff: durationFromEnv("LOGIN_MAX_BACKOFF", 30*time.Second),
+		Lockout:    durationFromEnv("LOGIN_LOCKOUT", 15*time.Minute),
+		Forget:     durationFromEnv("LOGIN_FORGET", time.Hour),
+	}
+	accounts := config
+	accounts.MaxFailures = intFromEnv("LOGIN_MAX_FAILURES", 5)
+	// many people can share an address, so its failures don't slow anyone
+	// down until there are enough of them to lock it out
+	addresses := config
+	addresses.MaxFailures = intFromEnv("LOGIN_IP_MAX_FAILURES", 20)
+	addresses.Backoff = 0
+
+	var password [16]byte
+	_, err := rand.Read(password[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	dummyHash, err := hasher.Hash(hex.EncodeToString(password[:]))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return loginLimits{
+		accounts:  lockout.New(accounts),
+		addresses: lockout.New(addresses),
+		lockout:   config.Lockout,
+		dummyHash: dummyHash,
+	}
+}
+
+// accountKey is what failed logins for email are counted by. Emails without
+// an account are counted too, so a lockout doesn't tell whether there is one.
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientAddress is the address a request came from.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLoginAllowed responds with 429 and returns false when the account
+// with email or the address of r has to wait before trying to log in again.
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	now := time.Now()
+	okAccount, waitAccount := config.login.accounts.Allow(accountKey(email), now)
+	okAddress, waitAddress := config.login.addresses.Allow(clientAddress(r), now)
+	if okAccount && okAddress {
+		return true
+	}
+
+	respondWithRetryAfter(w, max(waitAccount, waitAddress), "too many failed logins, try again later")
+	return false
+}
+
+// respondWithRetryAfter responds with 429 and msg, telling the client to wait
+// before trying again.
+func respondWithRetryAfter(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, 429, msg)
+}
+
+// loginFailed counts a failed login for the account with email, which is
+// the user with userId or 0 when there is none, and the address of r. Each
+// lockout it causes goes in the audit log.
+func loginFailed(r *http.Request, email string, userId int) {
+	now := time.Now()
+	address := clientAddress(r)
+
+	if config.login.accounts.Fail(accountKey(email), now) {
+		logLockout(userId, fmt.Sprintf("logins to %s locked for %s after too many failures", accountKey(email), config.login.lockout))
+	}
+	if config.login.addresses.Fail(address, now) {
+		logLockout(0, fmt.Sprintf("logins from %s locked for %s after too many failures", address, config.login.lockout))
+	}
+}
+
+// loginSucceeded forgets the failed logins of the account with email. Those
+// of the address are kept, logging in to one account mustn't give more
+// guesses at others.
+func loginSucceeded(email string) {
+	config.login.accounts.Succeed(accountKey(email))
+}
+
+func logLockout(userId int, note string) {
+	log.Print(note)
+	_, err := db.LogAction(database.ModerationAction{
+		Action:    database.ActionLockLogin,
+		UserId:    userId,
+		Note:      note,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("logging lockout: %s", err)
+	}
+}
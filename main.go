@@ -2,25 +2,28 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
 
 	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/blob"
 	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/mail"
+	"github.com/djmarkymark007/chirpy/internal/passhash"
 	"github.com/djmarkymark007/chirpy/internal/validate"
 )
 
-var db *database.Database
+var db database.Store
+var blobs blob.Store
 var config apiConfig
 
 const InternalErrorMsg = "Something went wrong"
@@ -72,14 +75,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	token := getTokenFromHeader(r)
-	id, err := authorize.GetIdFromJwt(token, config.jwtSecret)
-	if err != nil {
-		log.Print(err)
-		respondWithError(w, 500, InternalErrorMsg)
-		return
-	}
-
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	id, err := authorize.GetIdFromJwt(token, config.jwtKeys)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
@@ -97,18 +93,74 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 404, "Not found")
 		return
 	}
+	// a suspended user can still change their email and password, but not
+	// what others see of them
+	if user.Suspended && (params.Handle != nil || params.DisplayName != nil || params.Bio != nil || params.AvatarUrl != nil) {
+		respondWithError(w, 403, "account is suspended")
+		return
+	}
+
+	// email and password are only changed when they are sent. A new email
+	// is pending until it is verified, sending the current one again calls
+	// the change off.
+	changingEmail := false
+	if params.Email == user.Email {
+		user.PendingEmail = ""
+	} else if params.Email != "" && params.Email != user.PendingEmail {
+		err = validate.Email(params.Email)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		taken, err := db.UserExist(params.Email)
+		if err != nil {
+			log.Print(err)
+			respondWithError(w, 500, InternalErrorMsg)
+			return
+		}
+		if taken {
+			respondWithError(w, 409, "user email already used")
+			return
+		}
+		user.PendingEmail = params.Email
+		changingEmail = true
+	}
+	if params.Password != "" {
+		var ok bool
+		user.PasswordHash, ok = hashPassword(w, params.Password, user.Email, user.PendingEmail)
+		if !ok {
+			return
+		}
+	}
 
-	user.Email = params.Email
-	user.PasswordHash = passwordHash
+	err = applyProfile(&user, params)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
 
 	err = db.UpdateUser(user)
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, 409, "handle already taken")
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
 
-	respondWithJson(w, 200, database.User{Id: id, Email: params.Email, IsChirpyRed: user.IsChirpyRed})
+	if changingEmail {
+		err = sendEmailVerification(user.Id, user.PendingEmail)
+		if err != nil {
+			log.Print(err)
+			respondWithError(w, 500, InternalErrorMsg)
+			return
+		}
+		sendEmailChangeNotice(user)
+	}
+
+	respondWithJson(w, 200, user.Account())
 }
 
 func getTokenFromHeader(r *http.Request) string {
@@ -124,6 +176,9 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		Password         string `json:"password"`
 		Email            string `json:"email"`
 		ExpiresInSeconds int    `json:"expires_in_seconds"`
+		// Device names the session in the list of sessions, the User-Agent
+		// is used when it is left out.
+		Device string `json:"device"`
 	}
 
 	params := parameters{}
@@ -135,6 +190,10 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkLoginAllowed(w, r, params.Email) {
+		return
+	}
+
 	user, err := db.GetUser(params.Email)
 	if err != nil {
 		log.Printf("postLogin: %s\n", err)
@@ -142,28 +201,51 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(params.Password)) != nil {
+	// an email without an account is compared against a made up hash, so it
+	// takes as long as one with an account and a wrong password
+	passwordHash := user.PasswordHash
+	if user.Id == 0 {
+		passwordHash = config.login.dummyHash
+	}
+	ok, rehash, err := config.hasher.Verify(passwordHash, params.Password)
+	if err != nil {
+		log.Printf("postLogin: password hash of user %d: %s", user.Id, err)
+	}
+	if !ok || user.Id == 0 {
+		loginFailed(r, params.Email, user.Id)
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
+	if rehash {
+		user = rehashPassword(user, params.Password)
+	}
+	if user.Suspended {
+		respondWithError(w, 403, "account is suspended")
+		return
+	}
 
-	jwtToken, err := authorize.CreateJwt(user.Id, params.ExpiresInSeconds, config.jwtSecret)
-	if err != nil {
-		log.Print(err)
-		respondWithError(w, 500, InternalErrorMsg)
+	device := deviceName(params.Device, r)
+	if user.TOTPEnabled {
+		// the failures are kept until the second factor is right too, or
+		// getting the password right would give more guesses at the code
+		respondWithMFAChallenge(w, authorize.MFAChallenge{UserId: user.Id, Device: device, ExpiresInSeconds: params.ExpiresInSeconds})
 		return
 	}
+	loginSucceeded(params.Email)
+	respondWithLogin(w, user, device, params.ExpiresInSeconds)
+}
 
-	refreshToken, err := authorize.CreateRefreshToken()
+// respondWithLogin starts a session for the user on device and responds
+// with its tokens.
+func respondWithLogin(w http.ResponseWriter, user database.UserDatabase, device string, expiresInSeconds int) {
+	jwtToken, err := authorize.CreateJwt(user.Id, user.RoleOf(), expiresInSeconds, config.jwtKeys)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
 
-	user.RefreshToken = refreshToken
-	user.TokenExpiresAt = time.Now().UTC().Add(60 * 24 * time.Hour)
-	err = db.UpdateUser(user)
+	refreshToken, session, err := startSession(user.Id, device)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
@@ -171,77 +253,95 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type UserWithjwt struct {
-		Id           int    `json:"id"`
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Id            int    `json:"id"`
+		Email         string `json:"email"`
+		Token         string `json:"token"`
+		RefreshToken  string `json:"refresh_token"`
+		SessionId     int    `json:"session_id"`
+		IsChirpyRed   bool   `json:"is_chirpy_red"`
+		Handle        string `json:"handle"`
+		Role          string `json:"role"`
+		EmailVerified bool   `json:"email_verified"`
 	}
 
-	respondWithJson(w, 200, UserWithjwt{Id: user.Id, Email: user.Email, Token: jwtToken, RefreshToken: refreshToken, IsChirpyRed: user.IsChirpyRed})
+	respondWithJson(w, 200, UserWithjwt{Id: user.Id, Email: user.Email, Token: jwtToken, RefreshToken: refreshToken, SessionId: session.Id, IsChirpyRed: user.IsChirpyRed, Handle: user.Handle, Role: user.RoleOf(), EmailVerified: user.EmailVerified})
 }
 
+// refreshJWT swaps the refresh token of a session for a new one and a new
+// access token. The old refresh token stops working, using it again revokes
+// the session since it must have leaked.
 func refreshJWT(w http.ResponseWriter, r *http.Request) {
 	log.Print("--- refreshJWT ---")
 	token := getTokenFromHeader(r)
 
-	validToken, currentUser, err := authorize.ValidateRefreshToken(token, db)
+	refreshToken, err := authorize.CreateRefreshToken()
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
 
-	jwtToken := ""
-	if validToken {
-		jwtToken, err = authorize.CreateJwt(currentUser.Id, 0, config.jwtSecret)
-		if err != nil {
-			log.Print(err)
-			respondWithError(w, 500, InternalErrorMsg)
-			return
-		}
-	} else {
+	session, err := db.RotateSession(authorize.HashToken(token), authorize.HashToken(refreshToken), time.Now().UTC())
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("revoked session: %s", err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	user, found, err := db.GetUserById(session.UserId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
+	jwtToken, err := authorize.CreateJwt(user.Id, user.RoleOf(), 0, config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
 	type TokenType struct {
-		JwtToken string `json:"token"`
+		JwtToken     string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
-	respondWithJson(w, 200, TokenType{JwtToken: jwtToken})
+	respondWithJson(w, 200, TokenType{JwtToken: jwtToken, RefreshToken: refreshToken})
 }
 
+// revokeToken logs out the session the refresh token belongs to.
 func revokeToken(w http.ResponseWriter, r *http.Request) {
 	log.Print("--- revokeToken ---")
 
 	token := getTokenFromHeader(r)
-	users, err := db.GetUsers()
+	session, found, err := db.GetSessionByToken(authorize.HashToken(token))
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
 
-	valid := false
-	currentUser := database.UserDatabase{}
-	for _, user := range users {
-		if user.RefreshToken == token {
-			currentUser = user
-			valid = true
-			break
-		}
-	}
-
-	if !valid {
+	if !found {
 		respondWithError(w, 401, "Unauthorized")
 		return
 	}
 
-	currentUser.RefreshToken = ""
-	currentUser.TokenExpiresAt = time.Time{}
-	err = db.UpdateUser(currentUser)
-	if err != nil {
+	err = db.RevokeSession(session.Id)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
@@ -254,6 +354,12 @@ func revokeToken(w http.ResponseWriter, r *http.Request) {
 type User struct {
 	Password string `json:"password"`
 	Email    string `json:"email"`
+	// the profile fields are pointers so a field left out of the request,
+	// which is kept as it is, can be told apart from one set to ""
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	AvatarUrl   *string `json:"avatar_url"`
 }
 
 func postUsers(w http.ResponseWriter, r *http.Request) {
@@ -267,6 +373,12 @@ func postUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = validate.Email(params.Email)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
 	alreadyExist, err := db.UserExist(params.Email)
 	if err != nil {
 		log.Print(err)
@@ -279,19 +391,51 @@ func postUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(params.Password), bcrypt.DefaultCost)
+	profile := database.UserDatabase{}
+	err = applyProfile(&profile, params)
 	if err != nil {
-		log.Print(err)
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	if profile.Handle != "" {
+		_, taken, err := db.GetUserByHandle(profile.Handle)
+		if err != nil {
+			log.Print(err)
+			respondWithError(w, 500, InternalErrorMsg)
+			return
+		}
+		if taken {
+			respondWithError(w, 409, "handle already taken")
+			return
+		}
+	}
+
+	passwordHash, ok := hashPassword(w, params.Password, params.Email)
+	if !ok {
+		return
+	}
+	profile.Email = params.Email
+	profile.PasswordHash = passwordHash
+	newUser, err := db.CreateUserWithProfile(profile)
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, 409, "handle already taken")
+		return
+	}
+	if err != nil {
+		log.Println(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
-	email, err := db.CreateUser(params.Email, passwordHash)
+
+	err = sendEmailVerification(newUser.Id, newUser.Email)
 	if err != nil {
 		log.Println(err)
 		respondWithError(w, 500, InternalErrorMsg)
+		return
 	}
 
-	respondWithJson(w, 201, email)
+	respondWithJson(w, 201, newUser)
 }
 
 func postChirps(w http.ResponseWriter, r *http.Request) {
@@ -300,16 +444,23 @@ func postChirps(w http.ResponseWriter, r *http.Request) {
 	token := getTokenFromHeader(r)
 	if token == "" {
 		respondWithError(w, 401, "Unauthorized")
+		return
 	}
 
-	userId, err := authorize.GetIdFromJwt(token, config.jwtSecret)
+	userId, err := authorize.GetIdFromJwt(token, config.jwtKeys)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionChirp) {
+		return
 	}
 
 	type parameters struct {
-		Body string `json:"body"`
+		Body          string `json:"body"`
+		InReplyTo     int    `json:"in_reply_to"`
+		AttachmentIds []int  `json:"attachment_ids"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -320,66 +471,365 @@ func postChirps(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, 400, "Invalid JSON data")
 		return
 	}
-	if len(params.Body) > 140 {
-		respondWithError(w, 400, "Chirp is to long")
+
+	body, needsReview, err := cleanChirpBody(params.Body)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	inReplyTo := params.InReplyTo
+	if inReplyTo != 0 {
+		inReplyTo, err = originalChirpId(inReplyTo)
+		if err != nil {
+			log.Println(err)
+			respondWithError(w, 500, InternalErrorMsg)
+			return
+		}
+	}
+
+	if len(params.AttachmentIds) > database.MaxAttachments {
+		respondWithError(w, 400, fmt.Sprintf("a chirp can have at most %d attachments", database.MaxAttachments))
 		return
 	}
+	var attachments []database.Attachment
+	for _, id := range params.AttachmentIds {
+		attachments = append(attachments, database.Attachment{Id: id})
+	}
 
-	chirp := database.Chirp{Id: 0, Body: validate.ProfaneFilter(params.Body), AuthorId: userId}
+	now := time.Now().UTC()
+	chirp := database.Chirp{Id: 0, Body: body, AuthorId: userId, CreatedAt: now, UpdatedAt: now, InReplyTo: inReplyTo, Attachments: attachments, NeedsReview: needsReview}
 	chirp, err = db.CreateChirp(chirp)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 400, "chirp being replied to doesn't exist")
+		return
+	}
+	if errors.Is(err, database.ErrBadAttachment) {
+		respondWithError(w, 400, "attachment doesn't exist or is already used")
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	err = addAuthorHandles(&chirp)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
 	}
 
 	respondWithJson(w, 201, chirp)
 }
 
-func getChirps(w http.ResponseWriter, r *http.Request) {
-	log.Print("--- getChirps ---")
-	var resultChrips []database.Chirp
+// cleanChirpBody checks a new or edited chirp body and runs it through the
+// profanity filter. needsReview is true when the filter let it through for a
+// moderator to look at.
+func cleanChirpBody(body string) (cleaned string, needsReview bool, err error) {
+	if len(body) > 140 {
+		return "", false, errors.New("Chirp is to long")
+	}
 
-	chirps, err := db.GetChirps()
+	result := config.profanity.Check(body)
+	if !result.Profane() {
+		return body, false, nil
+	}
+	switch config.profanity.Mode() {
+	case validate.FilterReject:
+		return "", false, errors.New("Chirp contains profanity")
+	case validate.FilterReview:
+		return body, true, nil
+	default:
+		return result.Masked, false, nil
+	}
+}
+
+func putChirp(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- putChirp ---")
+
+	token := getTokenFromHeader(r)
+	userId, err := authorize.GetIdFromJwt(token, config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionChirp) {
+		return
+	}
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	type parameters struct {
+		Body string `json:"body"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	chirp, err := db.GetChirpById(chirpId)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if chirp.Id == 0 || chirp.Deleted || chirp.Hidden {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+	if chirp.AuthorId != userId {
+		respondWithError(w, 403, "Unauthorized")
+		return
+	}
+	if chirp.RechirpOf != 0 {
+		respondWithError(w, 400, "rechirps can't be edited")
+		return
+	}
+
+	now := time.Now().UTC()
+	if chirp.CreatedAt.IsZero() || now.Sub(chirp.CreatedAt) > config.chirpEditWindow {
+		respondWithError(w, 403, "chirp can no longer be edited")
+		return
+	}
+
+	body, needsReview, err := cleanChirpBody(params.Body)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	if body != chirp.Body {
+		chirp, err = db.EditChirp(chirp.Id, body, now)
+		if err != nil {
+			log.Print(err)
+			respondWithError(w, 500, InternalErrorMsg)
+			return
+		}
+		if needsReview != chirp.NeedsReview {
+			chirp, err = db.SetNeedsReview(chirp.Id, needsReview)
+			if err != nil {
+				log.Print(err)
+				respondWithError(w, 500, InternalErrorMsg)
+				return
+			}
+		}
+	}
+
+	err = addAuthorHandles(&chirp)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, chirp)
+}
+
+func getChirpHistory(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getChirpHistory ---")
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	chirp, err := db.GetChirpById(chirpId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if chirp.Id == 0 || chirp.Deleted || chirp.Hidden {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	history, err := db.GetChirpHistory(chirp.Id)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if history == nil {
+		history = []database.ChirpRevision{}
+	}
+
+	respondWithJson(w, 200, history)
+}
+
+func getChirpThread(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getChirpThread ---")
+
+	chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	thread, found, err := database.GetThread(db, chirpId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	err = addAuthorHandles(threadChirps(&thread)...)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	if r.URL.Query().Get("flat") == "true" {
+		type flatThread struct {
+			Ancestors []database.Chirp      `json:"ancestors"`
+			Chirp     database.Chirp        `json:"chirp"`
+			Replies   []database.ThreadNode `json:"replies"`
+		}
+		respondWithJson(w, 200, flatThread{Ancestors: thread.Ancestors, Chirp: thread.Chirp, Replies: thread.Flatten()})
+		return
+	}
+
+	respondWithJson(w, 200, thread)
+}
+
+func getChirps(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getChirps ---")
+
+	query, err := chirpQueryFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
 	}
 
 	authorId := r.URL.Query().Get("author_id")
 	if authorId != "" {
-		Id, err := strconv.Atoi(authorId)
+		query.AuthorId, err = strconv.Atoi(authorId)
 		if err != nil {
 			log.Print(err)
-			respondWithError(w, 500, "Failed to convert author_id to int")
+			respondWithError(w, 400, "Failed to convert author_id to int")
 			return
 		}
-		for _, chirp := range chirps {
-			if chirp.AuthorId == Id {
-				resultChrips = append(resultChrips, chirp)
-			}
+	}
+
+	page, err := db.QueryChirps(query)
+	if errors.Is(err, database.ErrBadCursor) {
+		respondWithError(w, 400, "Invalid cursor")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithPage(w, r, page)
+}
+
+// chirpQueryFromRequest reads the paging parameters shared by every endpoint
+// that lists chirps: limit, cursor (or after), before, sort and order_by.
+// Chirps are ordered by when they were created unless order_by=id.
+func chirpQueryFromRequest(r *http.Request) (database.ChirpQuery, error) {
+	params := r.URL.Query()
+	query := database.ChirpQuery{After: params.Get("after"), Before: params.Get("before"), OrderBy: database.OrderByCreatedAt}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		query.After = cursor
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > database.MaxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", database.MaxPageSize)
 		}
-	} else {
-		resultChrips = chirps
+		query.Limit = value
 	}
 
-	sortType := r.URL.Query().Get("sort")
+	sortType := params.Get("sort")
 	if sortType == "desc" {
-		slices.Reverse(resultChrips)
+		query.Desc = true
 	} else if sortType != "asc" && sortType != "" {
-		respondWithError(w, 500, "Invaild sort")
+		return query, errors.New("Invaild sort")
+	}
+
+	orderBy := params.Get("order_by")
+	if orderBy == database.OrderById || orderBy == database.OrderByCreatedAt {
+		query.OrderBy = orderBy
+	} else if orderBy != "" {
+		return query, errors.New("order_by must be id or created_at")
+	}
+
+	return query, nil
+}
+
+// respondWithPage writes the chirps as a json array. Links to the next and
+// previous pages go in the Link header, the raw next cursor in X-Next-Cursor.
+func respondWithPage(w http.ResponseWriter, r *http.Request, page database.ChirpPage) {
+	var links []string
+	if page.NextCursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageUrl(r, "after", page.NextCursor)))
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	if page.PrevCursor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageUrl(r, "before", page.PrevCursor)))
+	}
+	if len(links) != 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
 	}
 
+	chirps := page.Chirps
+	if chirps == nil {
+		chirps = []database.Chirp{}
+	}
+	err := addAuthorHandles(chirpPointers(chirps)...)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
 	respondWithJson(w, 200, chirps)
 }
 
+func pageUrl(r *http.Request, key string, cursor string) string {
+	params := r.URL.Query()
+	params.Del("cursor")
+	params.Del("after")
+	params.Del("before")
+	params.Set(key, cursor)
+	return r.URL.Path + "?" + params.Encode()
+}
+
+// deleteChirp deletes a chirp, its author and moderators can.
 func deleteChirp(w http.ResponseWriter, r *http.Request) {
 	token := getTokenFromHeader(r)
-	userId, err := authorize.GetIdFromJwt(token, config.jwtSecret)
+	identity, err := authorize.GetIdentityFromJwt(token, config.jwtKeys)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 403, "Unauthorized")
 		return
 	}
+	identity, ok := storedIdentity(w, identity)
+	if !ok {
+		return
+	}
 
 	path := r.PathValue("chirpID")
 	chirpId, err := strconv.Atoi(path)
@@ -396,18 +846,31 @@ func deleteChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if chirp.AuthorId != userId {
-		log.Printf("chrip author id: %v, user id: %v", chirp.AuthorId, userId)
+	if chirp.Id == 0 || chirp.Deleted {
+		respondWithError(w, 404, "chirp doesn't exist")
+		return
+	}
+
+	if chirp.AuthorId != identity.Id && !authorize.HasRole(identity.Role, database.RoleModerator) {
+		log.Printf("chrip author id: %v, user id: %v", chirp.AuthorId, identity.Id)
 		respondWithError(w, 403, "Unauthorized")
 		return
 	}
 
+	attachments, err := db.GetChirpMedia(chirp.Id)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
 	err = db.DeleteChirp(chirp.Id)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
+	deleteBlobs(attachments...)
 
 	respondWithJson(w, 204, "")
 }
@@ -476,31 +939,156 @@ func getChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chirps, err := db.GetChirps()
+	chirp, err := db.GetChirpById(value)
 	if err != nil {
 		log.Print(err)
 		respondWithError(w, 500, InternalErrorMsg)
 		return
 	}
-	if value > len(chirps) {
+	if chirp.Id == 0 || chirp.Deleted || chirp.Hidden {
 		respondWithError(w, 404, "chirp doesn't exist")
 		return
 	}
 
-	var loc int = -1
-	for index, chirp := range chirps {
-		if chirp.Id == value {
-			loc = index
-		}
+	err = addAuthorHandles(&chirp)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
 	}
 
-	respondWithJson(w, 200, chirps[loc])
+	respondWithJson(w, 200, chirp)
 }
 
 type apiConfig struct {
-	fileserverHits int
-	jwtSecret      string
-	polkaSecret    string
+	fileserverHits  int
+	jwtKeys         *authorize.Keyring
+	polkaSecret     string
+	chirpEditWindow time.Duration
+	profanity       *validate.Filter
+	mailer          mail.Mailer
+	// publicUrl is where users reach chirpy, links in emails point at it
+	publicUrl            string
+	passwordResetTTL     time.Duration
+	emailVerificationTTL time.Duration
+	login                loginLimits
+	passwordReset        passwordResetLimits
+	passwordPolicy       *validate.PasswordPolicy
+	hasher               passhash.Hasher
+	// unverifiedRestrict are the actions accounts can't take until their
+	// email is verified
+	unverifiedRestrict []string
+}
+
+// durationFromEnv reads a duration like "15m" from the environment.
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s: %s", key, err)
+	}
+	return duration
+}
+
+// intFromEnv reads a whole number from the environment.
+func intFromEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s: %q isn't a number", key, value)
+	}
+	return number
+}
+
+// listFromEnv reads a comma separated list from the environment.
+func listFromEnv(key string) []string {
+	var result []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// idsFromEnv reads a comma separated list of user ids from the environment.
+func idsFromEnv(key string) []int {
+	var result []int
+	for _, item := range listFromEnv(key) {
+		id, err := strconv.Atoi(item)
+		if err != nil {
+			log.Fatalf("%s: %q isn't a user id", key, item)
+		}
+		result = append(result, id)
+	}
+	return result
+}
+
+// loadProfanityFilter loads the profanity filter from the word lists in
+// PROFANITY_WORDS and PROFANITY_ALLOW, and keeps reloading them as they change.
+func loadProfanityFilter() (*validate.Filter, func()) {
+	mode, err := validate.ParseFilterMode(os.Getenv("PROFANITY_MODE"))
+	if err != nil {
+		log.Fatalf("PROFANITY_MODE: %s", err)
+	}
+
+	filter, err := validate.LoadFilter(validate.FilterOptions{
+		WordFiles:  listFromEnv("PROFANITY_WORDS"),
+		AllowFiles: listFromEnv("PROFANITY_ALLOW"),
+		Mode:       mode,
+	})
+	if err != nil {
+		log.Fatalf("loading profanity word lists: %s", err)
+	}
+
+	stop := filter.Watch(durationFromEnv("PROFANITY_RELOAD_INTERVAL", 10*time.Second), func(err error) {
+		if err != nil {
+			log.Printf("reloading profanity word lists: %s", err)
+			return
+		}
+		log.Print("reloaded profanity word lists")
+	})
+	return filter, stop
+}
+
+// loadMailer sets up the transport emails go out through. MAIL_TRANSPORT is
+// smtp, to send them through the server at SMTP_ADDR, or file, the default,
+// to drop them in MAIL_DIR.
+func loadMailer() mail.Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@localhost>"
+	}
+
+	switch transport := os.Getenv("MAIL_TRANSPORT"); transport {
+	case "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			log.Fatal("MAIL_TRANSPORT is smtp but SMTP_ADDR isn't set")
+		}
+		return &mail.SMTP{Addr: addr, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD"), From: from}
+	case "", "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		mailer, err := mail.NewFileDrop(dir, from)
+		if err != nil {
+			log.Fatalf("MAIL_DIR: %s", err)
+		}
+		return mailer
+	default:
+		log.Fatalf("MAIL_TRANSPORT: unknown transport %q, want smtp or file", transport)
+		return nil
+	}
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -543,7 +1131,6 @@ func (cfg *apiConfig) reset(w http.ResponseWriter, _ *http.Request) {
 func main() {
 	const port = "8080"
 	const filepathRoot = "."
-	const path = "database.json"
 	var err error
 
 	err = godotenv.Load()
@@ -551,34 +1138,128 @@ func main() {
 		log.Fatalf("Error loading .env file: %s", err)
 	}
 
-	config = apiConfig{fileserverHits: 0, jwtSecret: os.Getenv("JWT_SECRET"), polkaSecret: os.Getenv("POLKA_SECRET")}
+	config = apiConfig{fileserverHits: 0, jwtKeys: loadKeyring(), polkaSecret: os.Getenv("POLKA_SECRET")}
+	config.chirpEditWindow = durationFromEnv("CHIRP_EDIT_WINDOW", 15*time.Minute)
+	config.mailer = loadMailer()
+	config.publicUrl = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if config.publicUrl == "" {
+		config.publicUrl = "http://localhost:" + port
+	}
+	config.passwordResetTTL = durationFromEnv("PASSWORD_RESET_TTL", time.Hour)
+	config.emailVerificationTTL = durationFromEnv("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	config.unverifiedRestrict = loadUnverifiedPolicy()
+	config.passwordPolicy = loadPasswordPolicy()
+	config.hasher = loadHasher()
+	config.login = loadLoginLimits(config.hasher)
+	config.passwordReset = loadPasswordResetLimits()
+	var stopWatching func()
+	config.profanity, stopWatching = loadProfanityFilter()
+	defer stopWatching()
 
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	driver := flag.String("db", database.DriverSQLite, "Database backend to use: sqlite or json")
+	journal := flag.Bool("journal", false, "Keep an append only journal for the json database")
 	flag.Parse()
+
+	path := "database.db"
+	if *driver == database.DriverJSON {
+		path = "database.json"
+	}
 	if *dbg {
 		os.Remove(path)
+		if *driver == database.DriverJSON {
+			os.Remove(path + ".journal")
+		} else {
+			// a write ahead log left by an unclean shutdown would be replayed
+			// into the fresh database
+			os.Remove(path + "-wal")
+			os.Remove(path + "-shm")
+		}
 	}
 
-	db, err = database.NewDB(path)
+	if *driver == database.DriverJSON && *journal {
+		db, err = database.NewDBWithOptions(path, database.Options{Journal: true})
+	} else {
+		db, err = database.Open(*driver, path)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = bootstrapAdmins(idsFromEnv("ADMIN_USER_IDS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "media"
+	}
+	blobs, err = blob.NewFS(mediaDir, mediaUrlPrefix)
 	if err != nil {
 		log.Fatal(err)
 	}
+	stopSweeping := sweepUnattachedMedia(durationFromEnv("UNATTACHED_MEDIA_TTL", 24*time.Hour), time.Hour)
+	defer stopSweeping()
 
 	serverHandler := http.NewServeMux()
 	serverHandler.Handle("/app/*", http.StripPrefix("/app", middlewareLog(config.middlewareMetricsInc(http.FileServer(http.Dir("."))))))
-	serverHandler.HandleFunc("GET /admin/metrics", config.metrics)
-	serverHandler.HandleFunc("GET /api/reset", config.reset)
+	serverHandler.HandleFunc("GET /admin/metrics", requireRole(database.RoleAdmin, config.metrics))
+	serverHandler.HandleFunc("GET /api/reset", requireRole(database.RoleAdmin, config.reset))
 	serverHandler.HandleFunc("GET /api/healthz", status)
+	serverHandler.HandleFunc("GET /.well-known/jwks.json", getJWKS)
 	serverHandler.HandleFunc("GET /api/chirps", getChirps)
 	serverHandler.HandleFunc("POST /api/chirps", postChirps)
 	serverHandler.HandleFunc("GET /api/chirps/{chirpID}", getChirp)
+	serverHandler.HandleFunc("PUT /api/chirps/{chirpID}", putChirp)
+	serverHandler.HandleFunc("GET /api/chirps/{chirpID}/history", getChirpHistory)
+	serverHandler.HandleFunc("GET /api/chirps/{chirpID}/thread", getChirpThread)
+	serverHandler.HandleFunc("POST /api/chirps/{chirpID}/like", postLike)
+	serverHandler.HandleFunc("DELETE /api/chirps/{chirpID}/like", deleteLike)
+	serverHandler.HandleFunc("POST /api/chirps/{chirpID}/rechirp", postRechirp)
+	serverHandler.HandleFunc("DELETE /api/chirps/{chirpID}/rechirp", deleteRechirp)
 	serverHandler.HandleFunc("POST /api/users", postUsers)
 	serverHandler.HandleFunc("POST /api/login", postLogin)
+	serverHandler.HandleFunc("POST /api/login/mfa", postLoginMFA)
 	serverHandler.HandleFunc("PUT /api/users", updateUser)
+	serverHandler.HandleFunc("GET /api/users/{handle}", getProfile)
+	serverHandler.HandleFunc("POST /api/users/avatar", postAvatar)
+	serverHandler.HandleFunc("GET "+verifyEmailPage, getVerifyEmailPage)
+	serverHandler.HandleFunc("POST /api/users/verify-email", postVerifyEmail)
+	serverHandler.HandleFunc("POST /api/users/verify-email/resend", postResendVerification)
+	serverHandler.HandleFunc("POST /api/users/totp", postTOTP)
+	serverHandler.HandleFunc("POST /api/users/totp/confirm", postTOTPConfirm)
+	serverHandler.HandleFunc("DELETE /api/users/totp", deleteTOTP)
+	serverHandler.HandleFunc("POST /api/users/totp/recovery-codes", postRecoveryCodes)
+	serverHandler.HandleFunc("POST /api/media", postMedia)
+	serverHandler.HandleFunc("GET "+mediaUrlPrefix+"{key...}", getMedia)
 	serverHandler.HandleFunc("POST /api/refresh", refreshJWT)
 	serverHandler.HandleFunc("POST /api/revoke", revokeToken)
+	serverHandler.HandleFunc("POST /api/password-reset", postPasswordReset)
+	serverHandler.HandleFunc("POST /api/password-reset/confirm", postPasswordResetConfirm)
+	serverHandler.HandleFunc("GET "+resetPasswordPage, getResetPasswordPage)
+	serverHandler.HandleFunc("GET /api/sessions", getSessions)
+	serverHandler.HandleFunc("DELETE /api/sessions", deleteSessions)
+	serverHandler.HandleFunc("DELETE /api/sessions/{sessionID}", deleteSession)
 	serverHandler.HandleFunc("DELETE /api/chirps/{chirpID}", deleteChirp)
 	serverHandler.HandleFunc("POST /api/polka/webhooks", giveChirpyRed)
+	serverHandler.HandleFunc("POST /api/users/{userID}/follow", postFollow)
+	serverHandler.HandleFunc("DELETE /api/users/{userID}/follow", deleteFollow)
+	serverHandler.HandleFunc("GET /api/users/{userID}/followers", getFollowers)
+	serverHandler.HandleFunc("GET /api/users/{userID}/following", getFollowing)
+	serverHandler.HandleFunc("GET /api/timeline", getTimeline)
+	serverHandler.HandleFunc("GET /api/search", getSearch)
+	serverHandler.HandleFunc("GET /api/hashtags/{tag}/chirps", getHashtagChirps)
+	serverHandler.HandleFunc("GET /api/trending", getTrending)
+	serverHandler.HandleFunc("GET /api/notifications", getNotifications)
+	serverHandler.HandleFunc("POST /api/notifications/read", postNotificationsRead)
+	serverHandler.HandleFunc("POST /api/reports", postReport)
+	serverHandler.HandleFunc("GET /api/moderation/reports", requireRole(database.RoleModerator, getReports))
+	serverHandler.HandleFunc("POST /api/moderation/reports/{reportID}/actions", requireRole(database.RoleModerator, postModerationAction))
+	serverHandler.HandleFunc("GET /api/moderation/log", requireRole(database.RoleModerator, getModerationLog))
+	serverHandler.HandleFunc("PUT /api/admin/users/{userID}/role", requireRole(database.RoleAdmin, putUserRole))
+	serverHandler.HandleFunc("POST /api/admin/users/{userID}/unsuspend", requireRole(database.RoleAdmin, postUnsuspend))
 
 	server := http.Server{Handler: serverHandler, Addr: ":" + port}
 
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/blob"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/media"
+)
+
+const (
+	maxAttachmentSize = 5 << 20
+	maxAvatarSize     = 2 << 20
+	// mediaUrlPrefix is where getMedia serves the blob store from.
+	mediaUrlPrefix = "/media/"
+)
+
+var (
+	attachmentOptions = media.Options{MaxDimension: 2048, ThumbnailDimension: 320}
+	avatarOptions     = media.Options{MaxDimension: 400, ThumbnailDimension: 96, Square: true}
+)
+
+var (
+	errUploadTooLarge = errors.New("upload is too large")
+	errNoUpload       = errors.New("upload must be multipart/form-data with the image in a file field")
+)
+
+// postMedia uploads an image to attach to a chirp. The response has the id
+// to post the chirp with in attachment_ids. There is no quota on uploads, ones
+// that are never posted are deleted by sweepUnattachedMedia.
+func postMedia(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postMedia ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionMedia) {
+		return
+	}
+
+	upload, ok := processUpload(w, r, maxAttachmentSize, attachmentOptions, "attachments")
+	if !ok {
+		return
+	}
+	upload.OwnerId = userId
+	upload.Kind = database.MediaAttachment
+
+	created, err := db.CreateMedia(upload)
+	if err != nil {
+		log.Print(err)
+		deleteBlobs(upload)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 201, created.Attachment())
+}
+
+// postAvatar uploads a new avatar for the user, replacing the old one.
+func postAvatar(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postAvatar ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionMedia) {
+		return
+	}
+
+	upload, ok := processUpload(w, r, maxAvatarSize, avatarOptions, "avatars")
+	if !ok {
+		return
+	}
+
+	_, replaced, err := db.SetAvatar(userId, upload)
+	if errors.Is(err, database.ErrNotFound) {
+		deleteBlobs(upload)
+		respondWithError(w, 404, "Not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		deleteBlobs(upload)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	deleteBlobs(replaced...)
+
+	user, _, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, user.Account())
+}
+
+// getMedia serves blobs out of the blob store. Keys are never reused so the
+// response can be cached for good.
+func getMedia(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	file, err := blobs.Open(key)
+	if errors.Is(err, blob.ErrNotFound) || errors.Is(err, blob.ErrBadKey) {
+		respondWithError(w, 404, "Not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	defer file.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.WriteHeader(200)
+	_, err = io.Copy(w, file)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// processUpload reads the image uploaded in the request, re-encodes it and
+// puts it and its thumbnail in the blob store under dir. On failure it
+// responds itself and returns false.
+func processUpload(w http.ResponseWriter, r *http.Request, maxSize int64, opts media.Options, dir string) (database.Media, bool) {
+	data, err := readUpload(w, r, maxSize)
+	if errors.Is(err, errUploadTooLarge) {
+		respondWithError(w, 413, err.Error())
+		return database.Media{}, false
+	}
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return database.Media{}, false
+	}
+
+	full, thumbnail, err := media.Process(data, opts)
+	if errors.Is(err, media.ErrUnsupported) {
+		respondWithError(w, 415, err.Error())
+		return database.Media{}, false
+	}
+	if errors.Is(err, media.ErrTooManyPixels) {
+		respondWithError(w, 400, err.Error())
+		return database.Media{}, false
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return database.Media{}, false
+	}
+
+	upload, err := storeImage(full, thumbnail, dir)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return database.Media{}, false
+	}
+	return upload, true
+}
+
+// readUpload reads the file field of a multipart upload of at most maxSize bytes.
+func readUpload(w http.ResponseWriter, r *http.Request, maxSize int64) ([]byte, error) {
+	// leave room for the multipart boundaries and headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64<<10)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errUploadTooLarge
+		}
+		return nil, errNoUpload
+	}
+	defer r.MultipartForm.RemoveAll()
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errUploadTooLarge
+	}
+	return data, nil
+}
+
+// storeImage puts an image and its thumbnail in the blob store under dir.
+func storeImage(full media.Image, thumbnail media.Image, dir string) (database.Media, error) {
+	key, err := blob.NewKey(dir, full.Ext)
+	if err != nil {
+		return database.Media{}, err
+	}
+	thumbnailKey := strings.TrimSuffix(key, full.Ext) + "_thumb" + thumbnail.Ext
+
+	err = blobs.Put(key, bytes.NewReader(full.Data))
+	if err != nil {
+		return database.Media{}, err
+	}
+	err = blobs.Put(thumbnailKey, bytes.NewReader(thumbnail.Data))
+	if err != nil {
+		blobs.Delete(key)
+		return database.Media{}, err
+	}
+
+	return database.Media{
+		ContentType:  full.ContentType,
+		Width:        full.Width,
+		Height:       full.Height,
+		Key:          key,
+		ThumbnailKey: thumbnailKey,
+		Url:          blobs.URL(key),
+		ThumbnailUrl: blobs.URL(thumbnailKey),
+		CreatedAt:    time.Now().UTC(),
+	}, nil
+}
+
+// sweepUnattachedMedia deletes, every interval, the attachments uploaded more
+// than maxAge ago that were never posted on a chirp, blobs and all. The
+// returned func stops sweeping.
+func sweepUnattachedMedia(maxAge time.Duration, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				removed, err := db.RemoveUnattachedMedia(time.Now().UTC().Add(-maxAge))
+				if err != nil {
+					log.Printf("sweeping unattached media: %s", err)
+					continue
+				}
+				deleteBlobs(removed...)
+				if len(removed) > 0 {
+					log.Printf("swept %d unattached uploads", len(removed))
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// deleteBlobs deletes the images of media that is gone from the database.
+// Failing to is only logged, the blobs are unreachable either way.
+func deleteBlobs(gone ...database.Media) {
+	for _, m := range gone {
+		for _, key := range []string{m.Key, m.ThumbnailKey} {
+			err := blobs.Delete(key)
+			if err != nil {
+				log.Printf("deleting blob %s: %s", key, err)
+			}
+		}
+	}
+}
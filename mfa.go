@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/totp"
+)
+
+const (
+	// totpIssuer is what authenticator apps list chirpy accounts under
+	totpIssuer = "Chirpy"
+	// mfaChallengeLifetime is how long a login that got the password right
+	// has to give the second factor
+	mfaChallengeLifetime = 5 * time.Minute
+	recoveryCodeCount    = 10
+)
+
+// secondFactor is a code from the authenticator of the user or, when they
+// don't have it, one of their recovery codes.
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// respondWithMFAChallenge responds to a login that still has to give a
+// second factor with the token to give it with at /api/login/mfa.
+func respondWithMFAChallenge(w http.ResponseWriter, challenge authorize.MFAChallenge) {
+	token, err := authorize.CreateMFAChallenge(challenge, mfaChallengeLifetime, config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	type mfaRequired struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	respondWithJson(w, 200, mfaRequired{MFARequired: true, MFAToken: token})
+}
+
+// postLoginMFA finishes a login of a user with two factor login on, trading
+// the challenge token from /api/login and a second factor for the tokens.
+func postLoginMFA(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postLoginMFA ---")
+
+	type parameters struct {
+		MFAToken string `json:"mfa_token"`
+		secondFactor
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	challenge, err := authorize.ParseMFAChallenge(params.MFAToken, config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, found, err := db.GetUserById(challenge.UserId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	// two factor login may have been turned off since the challenge
+	if !found || !user.TOTPEnabled {
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if user.Suspended {
+		respondWithError(w, 403, "account is suspended")
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, params.secondFactor) {
+		return
+	}
+	respondWithLogin(w, user, challenge.Device, challenge.ExpiresInSeconds)
+}
+
+// checkSecondFactor uses up the second factor the user gave and returns
+// true, or responds with an error and returns false when it is wrong. Wrong
+// ones count as failed logins.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user database.UserDatabase, factor secondFactor) bool {
+	if factor.Code == "" && factor.RecoveryCode == "" {
+		respondWithError(w, 400, "code or recovery_code is required")
+		return false
+	}
+	if !checkLoginAllowed(w, r, user.Email) {
+		return false
+	}
+
+	ok, err := useSecondFactor(user, factor)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return false
+	}
+	if !ok {
+		loginFailed(r, user.Email, user.Id)
+		respondWithError(w, 401, "two factor code is wrong")
+		return false
+	}
+	loginSucceeded(user.Email)
+	return true
+}
+
+// useSecondFactor uses up the code or else the recovery code in factor,
+// ok is false when it is wrong.
+func useSecondFactor(user database.UserDatabase, factor secondFactor) (bool, error) {
+	if factor.Code != "" {
+		step, ok := totp.Validate(user.TOTPSecret, factor.Code, time.Now().UTC(), user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		err := db.UseTOTPStep(user.Id, step)
+		if errors.Is(err, database.ErrCodeUsed) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	left, err := db.UseRecoveryCode(user.Id, authorize.HashRecoveryCode(factor.RecoveryCode))
+	if errors.Is(err, database.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Printf("user %d used a recovery code, %d left", user.Id, left)
+	return true, nil
+}
+
+// newRecoveryCodes returns recoveryCodeCount new recovery codes and their
+// hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := authorize.CreateRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code
+		hashes[i] = authorize.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// mfaUser returns the logged in user, or responds with an error and returns
+// false.
+func mfaUser(w http.ResponseWriter, r *http.Request) (database.UserDatabase, bool) {
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return database.UserDatabase{}, false
+	}
+
+	user, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return database.UserDatabase{}, false
+	}
+	if !found {
+		respondWithError(w, 404, "Not found")
+		return database.UserDatabase{}, false
+	}
+	return user, true
+}
+
+// postTOTP starts enrolling an authenticator. The response has the secret
+// and the otpauth:// URI to add it to the app with, two factor login is only
+// turned on once a code from the app is sent to /api/users/totp/confirm.
+// Starting again replaces the secret.
+func postTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postTOTP ---")
+
+	user, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, 409, "two factor login is already on")
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	user.TOTPSecret = secret
+	err = db.UpdateUser(user)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	type enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	respondWithJson(w, 200, enrollment{Secret: secret, URI: totp.URI(totpIssuer, user.Email, secret)})
+}
+
+// postTOTPConfirm turns two factor login on with a code from the
+// authenticator being enrolled. The response has the recovery codes, which
+// are only shown this once.
+func postTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postTOTPConfirm ---")
+
+	user, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	type parameters struct {
+		Code string `json:"code"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	if user.TOTPEnabled {
+		respondWithError(w, 409, "two factor login is already on")
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, 409, "start enrolling an authenticator first")
+		return
+	}
+	now := time.Now().UTC()
+	step, ok := totp.Validate(user.TOTPSecret, params.Code, now, 0)
+	if !ok {
+		respondWithError(w, 400, "two factor code is wrong")
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	err = db.EnableTOTP(user.Id, step, hashes, now)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithRecoveryCodes(w, codes)
+}
+
+// deleteTOTP turns two factor login off, which takes a second factor.
+func deleteTOTP(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteTOTP ---")
+
+	user, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	params := secondFactor{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	if !user.TOTPEnabled {
+		respondWithError(w, 409, "two factor login is off")
+		return
+	}
+	if !checkSecondFactor(w, r, user, params) {
+		return
+	}
+
+	err = db.DisableTOTP(user.Id)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
+
+// postRecoveryCodes replaces the recovery codes of the user with new ones,
+// which takes a second factor.
+func postRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postRecoveryCodes ---")
+
+	user, ok := mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	params := secondFactor{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	if !user.TOTPEnabled {
+		respondWithError(w, 409, "two factor login is off")
+		return
+	}
+	if !checkSecondFactor(w, r, user, params) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	err = db.SetRecoveryCodes(user.Id, hashes, time.Now().UTC())
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithRecoveryCodes(w, codes)
+}
+
+func respondWithRecoveryCodes(w http.ResponseWriter, codes []string) {
+	type recoveryCodes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	respondWithJson(w, 200, recoveryCodes{RecoveryCodes: codes})
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+// postReport reports a chirp, with chirp_id, or an account, with user_id, to
+// the moderators.
+func postReport(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postReport ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+	if checkSuspended(w, userId) || checkVerified(w, userId, actionReport) {
+		return
+	}
+
+	type parameters struct {
+		ChirpId int    `json:"chirp_id"`
+		UserId  int    `json:"user_id"`
+		Reason  string `json:"reason"`
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	if (params.ChirpId == 0) == (params.UserId == 0) {
+		respondWithError(w, 400, "report either a chirp_id or a user_id")
+		return
+	}
+	err = validate.ReportReason(params.Reason)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if params.UserId == userId {
+		respondWithError(w, 400, "you can't report yourself")
+		return
+	}
+
+	report, err := db.CreateReport(database.Report{
+		ReporterId: userId,
+		ChirpId:    params.ChirpId,
+		UserId:     params.UserId,
+		Reason:     params.Reason,
+		CreatedAt:  time.Now().UTC(),
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "reported chirp or user doesn't exist")
+		return
+	}
+	if errors.Is(err, database.ErrAlreadyReported) {
+		respondWithError(w, 409, "you already reported this")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 201, report)
+}
+
+// queueItem is a report as the moderation queue shows it, with the chirp it
+// is about so it can be judged without looking it up.
+type queueItem struct {
+	database.Report
+	Chirp *database.Chirp `json:"chirp,omitempty"`
+}
+
+// getReports lists reports oldest first, only the open ones unless status
+// asks for actioned, dismissed or all of them. Pass the id of the last one
+// as after to get the next page.
+func getReports(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getReports ---")
+
+	params := r.URL.Query()
+	query := database.ReportQuery{Status: database.ReportOpen}
+	switch status := params.Get("status"); status {
+	case "":
+	case "all":
+		query.Status = ""
+	case database.ReportOpen, database.ReportActioned, database.ReportDismissed:
+		query.Status = status
+	default:
+		respondWithError(w, 400, "status must be open, actioned, dismissed or all")
+		return
+	}
+	var err error
+	if after := params.Get("after"); after != "" {
+		query.After, err = strconv.Atoi(after)
+		if err != nil {
+			respondWithError(w, 400, "after must be a report id")
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxReports {
+			respondWithError(w, 400, fmt.Sprintf("limit must be between 1 and %d", database.MaxReports))
+			return
+		}
+	}
+
+	reports, err := db.GetReports(query)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	items := []queueItem{}
+	var chirps []*database.Chirp
+	for _, report := range reports {
+		item := queueItem{Report: report}
+		if report.ChirpId != 0 {
+			chirp, err := db.GetChirpById(report.ChirpId)
+			if err != nil {
+				log.Print(err)
+				respondWithError(w, 500, InternalErrorMsg)
+				return
+			}
+			if chirp.Id != 0 {
+				item.Chirp = &chirp
+				chirps = append(chirps, &chirp)
+			}
+		}
+		items = append(items, item)
+	}
+
+	err = addAuthorHandles(chirps...)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, items)
+}
+
+// postModerationAction acts on a report: hide_chirp hides the reported chirp,
+// suspend_user suspends the reported account and dismiss closes the report
+// without doing anything. Every open report about the same chirp or account
+// is closed with it, and the action goes in the audit log.
+func postModerationAction(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postModerationAction ---")
+
+	reportId, err := strconv.Atoi(r.PathValue("reportID"))
+	if err != nil {
+		respondWithError(w, 404, "report doesn't exist")
+		return
+	}
+
+	type parameters struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+	if utf8.RuneCountInString(params.Note) > validate.MaxReasonLength {
+		respondWithError(w, 400, fmt.Sprintf("note can be at most %d characters", validate.MaxReasonLength))
+		return
+	}
+
+	action, closed, err := db.Moderate(database.ModerationAction{
+		ModeratorId: identityFrom(r).Id,
+		Action:      params.Action,
+		ReportId:    reportId,
+		Note:        params.Note,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "report doesn't exist")
+		return
+	}
+	if errors.Is(err, database.ErrReportClosed) {
+		respondWithError(w, 409, "report was already dealt with")
+		return
+	}
+	if errors.Is(err, database.ErrBadAction) {
+		respondWithError(w, 400, "action must be hide_chirp, suspend_user or dismiss, and hide_chirp needs a chirp report")
+		return
+	}
+	if errors.Is(err, database.ErrOutranked) {
+		respondWithError(w, 403, "you can't suspend a user whose role is as high as yours")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	type response struct {
+		Action  database.ModerationAction `json:"action"`
+		Reports []database.Report         `json:"reports"`
+	}
+
+	respondWithJson(w, 200, response{Action: action, Reports: closed})
+}
+
+// postUnsuspend lifts the suspension of the user in the path. Only admins
+// can, it is logged in the audit log with the note in the body.
+func postUnsuspend(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postUnsuspend ---")
+
+	userId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	type parameters struct {
+		Note string `json:"note"`
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+	if utf8.RuneCountInString(params.Note) > validate.MaxReasonLength {
+		respondWithError(w, 400, fmt.Sprintf("note can be at most %d characters", validate.MaxReasonLength))
+		return
+	}
+
+	action, err := db.Unsuspend(database.ModerationAction{
+		ModeratorId: identityFrom(r).Id,
+		UserId:      userId,
+		Note:        params.Note,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, action)
+}
+
+// getModerationLog lists the audit log of moderation actions newest first.
+// Pass the id of the last one as before to get the next page.
+func getModerationLog(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getModerationLog ---")
+
+	params := r.URL.Query()
+	query := database.ModerationLogQuery{}
+	var err error
+	if before := params.Get("before"); before != "" {
+		query.Before, err = strconv.Atoi(before)
+		if err != nil {
+			respondWithError(w, 400, "before must be an action id")
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxReports {
+			respondWithError(w, 400, fmt.Sprintf("limit must be between 1 and %d", database.MaxReports))
+			return
+		}
+	}
+
+	actions, err := db.GetModerationLog(query)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	if actions == nil {
+		actions = []database.ModerationAction{}
+	}
+	respondWithJson(w, 200, actions)
+}
+
+// checkSuspended responds with 403 and returns true when the user was
+// suspended by a moderator.
+func checkSuspended(w http.ResponseWriter, userId int) bool {
+	user, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return true
+	}
+	if found && user.Suspended {
+		respondWithError(w, 403, "account is suspended")
+		return true
+	}
+	return false
+}
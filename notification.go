@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+// getNotifications lists the user's notifications newest first, unread=true
+// leaves out the read ones. Pass the id of the last one as before to get the
+// next page. The unread count goes in X-Unread-Count.
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getNotifications ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	params := r.URL.Query()
+	query := database.NotificationQuery{UserId: userId, UnreadOnly: params.Get("unread") == "true"}
+	if before := params.Get("before"); before != "" {
+		query.Before, err = strconv.Atoi(before)
+		if err != nil {
+			respondWithError(w, 400, "before must be a notification id")
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxNotifications {
+			respondWithError(w, 400, fmt.Sprintf("limit must be between 1 and %d", database.MaxNotifications))
+			return
+		}
+	}
+
+	notifications, err := db.GetNotifications(query)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	unread, err := db.CountUnreadNotifications(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	if notifications == nil {
+		notifications = []database.Notification{}
+	}
+	w.Header().Set("X-Unread-Count", strconv.Itoa(unread))
+	respondWithJson(w, 200, notifications)
+}
+
+// postNotificationsRead marks the notifications with the ids in the body read,
+// or every notification when there are no ids.
+func postNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postNotificationsRead ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	type parameters struct {
+		Ids []int `json:"ids"`
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			log.Printf("Error decoding parameters: %s\n", err)
+			respondWithError(w, 400, "Invalid JSON data")
+			return
+		}
+	}
+
+	err = db.MarkNotificationsRead(userId, params.Ids)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/lockout"
+	"github.com/djmarkymark007/chirpy/internal/mail"
+	"github.com/djmarkymark007/chirpy/internal/passhash"
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+const passwordResetMsg = `Someone asked to reset the password of your Chirpy account. If it was you,
+set a new password here:
+
+%s
+
+The link works once and expires at %s. If you didn't ask for this you can
+ignore this email, your password stays as it is.
+`
+
+// resetPasswordPage is where the link in a password reset email goes, a page
+// that asks for the new password and confirms the reset with it.
+const resetPasswordPage = "/app/reset-password"
+
+// passwordResetLimits are how often password reset and verification emails
+// can be asked for, per account and per address, so nobody can flood an
+// inbox with them. Like loginLimits they are kept in memory.
+type passwordResetLimits struct {
+	accounts  *lockout.Limiter
+	addresses *lockout.Limiter
+	// cooldown is how long a reset is kept before asking again replaces it
+	cooldown time.Duration
+}
+
+// loadPasswordResetLimits reads the limits on password resets from the
+// environment. An account can ask PASSWORD_RESET_MAX times and an address
+// PASSWORD_RESET_IP_MAX times before having to wait PASSWORD_RESET_WINDOW.
+func loadPasswordResetLimits() passwordResetLimits {
+	window := durationFromEnv("PASSWORD_RESET_WINDOW", time.Hour)
+	accounts := lockout.Config{Lockout: window, Forget: window}
+	accounts.MaxFailures = intFromEnv("PASSWORD_RESET_MAX", 3)
+	addresses := accounts
+	addresses.MaxFailures = intFromEnv("PASSWORD_RESET_IP_MAX", 10)
+
+	return passwordResetLimits{
+		accounts:  lockout.New(accounts),
+		addresses: lockout.New(addresses),
+		cooldown:  durationFromEnv("PASSWORD_RESET_COOLDOWN", 15*time.Minute),
+	}
+}
+
+// checkMailAllowed responds with 429 and returns false when email or the
+// address of r has asked for too many password reset or verification emails,
+// and otherwise counts this one. Emails without an account are counted too,
+// so the limit doesn't tell whether there is one.
+func checkMailAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	now := time.Now()
+	limits := config.passwordReset
+	okAccount, waitAccount := limits.accounts.Allow(accountKey(email), now)
+	okAddress, waitAddress := limits.addresses.Allow(clientAddress(r), now)
+	if !okAccount || !okAddress {
+		respondWithRetryAfter(w, max(waitAccount, waitAddress), "too many emails asked for, try again later")
+		return false
+	}
+	limits.accounts.Fail(accountKey(email), now)
+	limits.addresses.Fail(clientAddress(r), now)
+	return true
+}
+
+// postPasswordReset emails a password reset link to the account with the
+// email given. The response is the same whether there is such an account or
+// not, so it can't be used to find out who has one.
+func postPasswordReset(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postPasswordReset ---")
+
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	if !checkMailAllowed(w, r, params.Email) {
+		return
+	}
+
+	user, err := db.GetUser(params.Email)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	// the reset is issued in the background, so the response takes as long
+	// as for an email without an account
+	if user.Id != 0 && !user.Suspended {
+		go func() {
+			err := sendPasswordReset(user)
+			if errors.Is(err, database.ErrResetPending) {
+				log.Printf("password reset of user %d pending, not sending another", user.Id)
+			} else if err != nil {
+				log.Printf("password reset of user %d: %s", user.Id, err)
+			}
+		}()
+	}
+
+	respondWithJson(w, 202, struct{}{})
+}
+
+// sendPasswordReset issues a password reset for the user and emails them
+// the link to it. A reset asked for within the cooldown of the last one is
+// ErrResetPending and nothing is sent, the last link keeps working.
+func sendPasswordReset(user database.UserDatabase) error {
+	token, err := authorize.CreateResetToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	reset, err := db.CreatePasswordReset(database.PasswordReset{
+		UserId:    user.Id,
+		TokenHash: authorize.HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.passwordResetTTL),
+	}, config.passwordReset.cooldown)
+	if err != nil {
+		return err
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    fmt.Sprintf(passwordResetMsg, passwordResetLink(token), reset.ExpiresAt.Format(time.RFC1123)),
+	}
+	err = config.mailer.Send(msg)
+	if err != nil {
+		return fmt.Errorf("sending password reset %d: %w", reset.Id, err)
+	}
+	return nil
+}
+
+// passwordResetLink is the link to resetPasswordPage emailed with token.
+func passwordResetLink(token string) string {
+	return config.publicUrl + resetPasswordPage + "?token=" + url.QueryEscape(token)
+}
+
+// getResetPasswordPage serves the page password reset links open, which
+// posts the token and the new password to postPasswordResetConfirm.
+func getResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "reset-password.html")
+}
+
+// postPasswordResetConfirm sets a new password with the token from a
+// password reset email, and logs the account out everywhere.
+func postPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postPasswordResetConfirm ---")
+
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+	// the reset is looked up first so the password can be checked against
+	// the email of the account, ResetPassword checks it is still good
+	tokenHash := authorize.HashToken(params.Token)
+	reset, found, err := db.GetPasswordReset(tokenHash)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	user, userFound, err := db.GetUserById(reset.UserId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found || !userFound {
+		respondWithError(w, 400, "reset token is invalid or expired")
+		return
+	}
+
+	passwordHash, ok := hashPassword(w, params.Password, user.Email)
+	if !ok {
+		return
+	}
+
+	_, err = db.ResetPassword(tokenHash, passwordHash, time.Now().UTC())
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 400, "reset token is invalid or expired")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
+
+// loadPasswordPolicy reads the password policy from the environment.
+// Passwords are PASSWORD_MIN_LENGTH to PASSWORD_MAX_LENGTH characters and
+// can't be in the breached password lists in PASSWORD_BREACHED_LISTS.
+func loadPasswordPolicy() *validate.PasswordPolicy {
+	policy, err := validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{
+		MinLength:     intFromEnv("PASSWORD_MIN_LENGTH", validate.MinPasswordLength),
+		MaxLength:     intFromEnv("PASSWORD_MAX_LENGTH", validate.MaxPasswordLength),
+		BreachedFiles: listFromEnv("PASSWORD_BREACHED_LISTS"),
+	})
+	if err != nil {
+		log.Fatalf("loading password policy: %s", err)
+	}
+	return policy
+}
+
+// loadHasher reads how to hash passwords from the environment. New
+// passwords are hashed with PASSWORD_HASH, argon2id or bcrypt, and older
+// hashes are replaced as their users log in.
+func loadHasher() passhash.Hasher {
+	algorithm, err := passhash.ParseAlgorithm(os.Getenv("PASSWORD_HASH"))
+	if err != nil {
+		log.Fatalf("PASSWORD_HASH: %s", err)
+	}
+
+	hasher := passhash.Hasher{
+		Algorithm:  algorithm,
+		BcryptCost: intFromEnv("BCRYPT_COST", bcrypt.DefaultCost),
+		Argon2: passhash.Argon2Params{
+			Memory:      uint32(intFromEnv("ARGON2_MEMORY_KIB", int(passhash.DefaultArgon2.Memory))),
+			Iterations:  uint32(intFromEnv("ARGON2_ITERATIONS", int(passhash.DefaultArgon2.Iterations))),
+			Parallelism: uint8(intFromEnv("ARGON2_PARALLELISM", int(passhash.DefaultArgon2.Parallelism))),
+		},
+	}
+	if hasher.BcryptCost < bcrypt.MinCost || hasher.BcryptCost > bcrypt.MaxCost {
+		log.Fatalf("BCRYPT_COST: must be %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if hasher.Argon2.Memory < 8*uint32(hasher.Argon2.Parallelism) || hasher.Argon2.Iterations < 1 || hasher.Argon2.Parallelism < 1 {
+		log.Fatal("ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and ARGON2_PARALLELISM must be at least 8 times the parallelism, 1 and 1")
+	}
+	return hasher
+}
+
+// hashPassword checks password against the password policy for an account
+// with emails, which may be "", and hashes it. It responds with an error and
+// returns false when the password isn't good enough.
+func hashPassword(w http.ResponseWriter, password string, emails ...string) ([]byte, bool) {
+	err := config.passwordPolicy.Check(password, "")
+	for _, email := range emails {
+		if err == nil && email != "" {
+			err = config.passwordPolicy.Check(password, email)
+		}
+	}
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return nil, false
+	}
+
+	hash, err := config.hasher.Hash(password)
+	if errors.Is(err, passhash.ErrTooLong) {
+		respondWithError(w, 400, "password is too long")
+		return nil, false
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return nil, false
+	}
+	return hash, true
+}
+
+// rehashPassword replaces the password hash of the user, who just logged in
+// with password, with one made the way passwords are hashed now. Only the
+// hash is written, and only if the password wasn't changed meanwhile. Failing
+// to is only logged, the old hash still works.
+func rehashPassword(user database.UserDatabase, password string) database.UserDatabase {
+	hash, err := config.hasher.Hash(password)
+	if err != nil {
+		log.Printf("rehashing password of user %d: %s", user.Id, err)
+		return user
+	}
+	swapped, err := db.SwapPasswordHash(user.Id, user.PasswordHash, hash)
+	if err != nil {
+		log.Printf("rehashing password of user %d: %s", user.Id, err)
+		return user
+	}
+	if swapped {
+		user.PasswordHash = hash
+	}
+	return user
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/mail"
+	"github.com/djmarkymark007/chirpy/internal/passhash"
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+// TestPasswordResetLink follows the link in a password reset email to the
+// page it opens and confirms the reset with the token in it.
+func TestPasswordResetLink(t *testing.T) {
+	store, err := database.NewDB(t.TempDir() + "/database.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = store
+	mailer := &mail.Memory{}
+	config = apiConfig{
+		publicUrl:        "https://chirpy.example",
+		mailer:           mailer,
+		passwordResetTTL: time.Hour,
+		hasher:           passhash.Hasher{Algorithm: passhash.Bcrypt, BcryptCost: bcrypt.MinCost},
+	}
+	config.passwordPolicy, err = validate.LoadPasswordPolicy(validate.PasswordPolicyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := db.CreateUser("a@example.com", []byte("old hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _, err := db.GetUserById(created.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendPasswordReset(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := mailer.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("messages: got %+v", messages)
+	}
+	link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(messages[0].Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Host != "chirpy.example" || link.Path != resetPasswordPage {
+		t.Fatalf("link: got %s", link)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+resetPasswordPage, getResetPasswordPage)
+	mux.HandleFunc("POST /api/password-reset/confirm", postPasswordResetConfirm)
+
+	page := httptest.NewRecorder()
+	mux.ServeHTTP(page, httptest.NewRequest("GET", link.RequestURI(), nil))
+	if page.Code != 200 || !strings.Contains(page.Body.String(), "/api/password-reset/confirm") {
+		t.Fatalf("page: got %d %s", page.Code, page.Body)
+	}
+
+	body := `{"token": "` + link.Query().Get("token") + `", "password": "a new passphrase"}`
+	confirm := httptest.NewRecorder()
+	mux.ServeHTTP(confirm, httptest.NewRequest("POST", "/api/password-reset/confirm", strings.NewReader(body)))
+	if confirm.Code != 204 {
+		t.Fatalf("confirm: got %d %s", confirm.Code, confirm.Body)
+	}
+	user, _, err = db.GetUserById(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, _ := config.hasher.Verify(user.PasswordHash, "a new passphrase"); !ok {
+		t.Error("the new password doesn't log in")
+	}
+}
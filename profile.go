@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/validate"
+)
+
+// getProfile returns the public profile of the user with the handle in the path.
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getProfile ---")
+
+	profile, found, err := database.GetProfile(db, r.PathValue("handle"))
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	respondWithJson(w, 200, profile)
+}
+
+// applyProfile validates the profile fields set in params and copies them to
+// user, fields left out of the request are kept.
+func applyProfile(user *database.UserDatabase, params User) error {
+	if params.Handle != nil {
+		err := validate.Handle(*params.Handle)
+		if err != nil {
+			return err
+		}
+		user.Handle = *params.Handle
+	}
+	if params.DisplayName != nil {
+		err := validate.DisplayName(*params.DisplayName)
+		if err != nil {
+			return err
+		}
+		user.DisplayName = *params.DisplayName
+	}
+	if params.Bio != nil {
+		err := validate.Bio(*params.Bio)
+		if err != nil {
+			return err
+		}
+		user.Bio = *params.Bio
+	}
+	if params.AvatarUrl != nil {
+		err := validate.AvatarUrl(*params.AvatarUrl)
+		if err != nil {
+			return err
+		}
+		user.AvatarUrl = *params.AvatarUrl
+	}
+	return nil
+}
+
+// addAuthorHandles fills in AuthorHandle on each of the chirps.
+func addAuthorHandles(chirps ...*database.Chirp) error {
+	var authorIds []int
+	for _, chirp := range chirps {
+		if !slices.Contains(authorIds, chirp.AuthorId) {
+			authorIds = append(authorIds, chirp.AuthorId)
+		}
+	}
+
+	handles, err := db.GetUserHandles(authorIds)
+	if err != nil {
+		return err
+	}
+	for _, chirp := range chirps {
+		chirp.AuthorHandle = handles[chirp.AuthorId]
+	}
+	return nil
+}
+
+// chirpPointers points at each chirp in chirps, for addAuthorHandles.
+func chirpPointers(chirps []database.Chirp) []*database.Chirp {
+	result := make([]*database.Chirp, len(chirps))
+	for i := range chirps {
+		result[i] = &chirps[i]
+	}
+	return result
+}
+
+// threadChirps points at every chirp in thread, for addAuthorHandles.
+func threadChirps(thread *database.Thread) []*database.Chirp {
+	result := append(chirpPointers(thread.Ancestors), &thread.Chirp)
+	nodes := slices.Clone(thread.Replies)
+	for len(nodes) != 0 {
+		node := nodes[0]
+		nodes = append(nodes[1:], node.Replies...)
+		result = append(result, &node.Chirp)
+	}
+	return result
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+// identityKey is where requireRole puts the identity of the caller in the
+// request context.
+type identityKey struct{}
+
+// requireRole only lets a request through to next when it has a token for a
+// user with role or a more privileged one. The token is checked first so most
+// requests are turned away without a lookup, then the role is checked again
+// against the stored user, so a demotion or suspension applies before the
+// token expires.
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authorize.GetIdentityFromJwt(getTokenFromHeader(r), config.jwtKeys)
+		if err != nil {
+			log.Print(err)
+			respondWithError(w, 401, "Unauthorized")
+			return
+		}
+		if !authorize.HasRole(identity.Role, role) {
+			respondWithError(w, 403, "Forbidden")
+			return
+		}
+		identity, ok := storedIdentity(w, identity)
+		if !ok {
+			return
+		}
+		if !authorize.HasRole(identity.Role, role) {
+			respondWithError(w, 403, "Forbidden")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	}
+}
+
+// storedIdentity returns identity with the role the user has now rather than
+// the one in their token. It responds with an error and returns false when
+// the user is gone or suspended.
+func storedIdentity(w http.ResponseWriter, identity authorize.Identity) (authorize.Identity, bool) {
+	user, found, err := db.GetUserById(identity.Id)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return authorize.Identity{}, false
+	}
+	if !found {
+		respondWithError(w, 401, "Unauthorized")
+		return authorize.Identity{}, false
+	}
+	if user.Suspended {
+		respondWithError(w, 403, "account is suspended")
+		return authorize.Identity{}, false
+	}
+	identity.Role = user.RoleOf()
+	return identity, true
+}
+
+// identityFrom returns the caller of a handler behind requireRole.
+func identityFrom(r *http.Request) authorize.Identity {
+	identity, _ := r.Context().Value(identityKey{}).(authorize.Identity)
+	return identity
+}
+
+// putUserRole gives the user in the path the role in the body and logs them
+// out everywhere, so no session goes on with the old role. Admins can't
+// change their own role so there is always an admin left.
+func putUserRole(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- putUserRole ---")
+
+	userId, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+	if userId == identityFrom(r).Id {
+		respondWithError(w, 403, "you can't change your own role")
+		return
+	}
+
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+	if !database.ValidRole(params.Role) {
+		respondWithError(w, 400, "role must be user, moderator or admin")
+		return
+	}
+
+	user, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+
+	user.Role = params.Role
+	err = db.UpdateUser(user)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "user doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	_, err = db.RevokeSessions(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, user.Account())
+}
+
+// bootstrapAdmins makes the users with ids admins, so a new server has an
+// admin to hand out roles from.
+func bootstrapAdmins(ids []int) error {
+	for _, id := range ids {
+		user, found, err := db.GetUserById(id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			log.Printf("admin %d doesn't exist", id)
+			continue
+		}
+		if user.RoleOf() == database.RoleAdmin {
+			continue
+		}
+
+		user.Role = database.RoleAdmin
+		err = db.UpdateUser(user)
+		if err != nil {
+			return err
+		}
+		log.Printf("made user %d an admin", id)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+// getSearch finds chirps matching the words in q, best match first. q is
+// capped at database.MaxSearchLength and MaxSearchTerms. author_id,
+// since and until (RFC 3339 times) narrow the search, limit and offset page
+// through the results. The number of matches goes in X-Total-Count.
+func getSearch(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getSearch ---")
+
+	query, err := searchQueryFromRequest(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+
+	result, err := db.SearchChirps(query)
+	if errors.Is(err, database.ErrBadSearch) {
+		respondWithError(w, 400, "q must contain at least one word")
+		return
+	}
+	if errors.Is(err, database.ErrSearchTooLarge) {
+		respondWithError(w, 400, fmt.Sprintf("q can be at most %d bytes and %d words or phrases", database.MaxSearchLength, database.MaxSearchTerms))
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(result.Total))
+	if next := query.Offset + len(result.Chirps); len(result.Chirps) != 0 && next < result.Total {
+		params := r.URL.Query()
+		params.Set("offset", strconv.Itoa(next))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, params.Encode()))
+	}
+
+	chirps := result.Chirps
+	if chirps == nil {
+		chirps = []database.Chirp{}
+	}
+	err = addAuthorHandles(chirpPointers(chirps)...)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, chirps)
+}
+
+func searchQueryFromRequest(r *http.Request) (database.SearchQuery, error) {
+	params := r.URL.Query()
+	query := database.SearchQuery{Text: params.Get("q")}
+
+	var err error
+	if authorId := params.Get("author_id"); authorId != "" {
+		query.AuthorId, err = strconv.Atoi(authorId)
+		if err != nil {
+			return query, errors.New("Failed to convert author_id to int")
+		}
+	}
+	if since := params.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return query, errors.New("until must be an RFC 3339 time")
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > database.MaxSearchResults {
+			return query, fmt.Errorf("limit must be between 1 and %d", database.MaxSearchResults)
+		}
+	}
+	if offset := params.Get("offset"); offset != "" {
+		query.Offset, err = strconv.Atoi(offset)
+		if err != nil || query.Offset < 0 {
+			return query, errors.New("offset must be a positive number")
+		}
+	}
+
+	return query, nil
+}
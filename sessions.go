@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+)
+
+const (
+	// sessionLifetime is how long a device stays logged in before it has to
+	// log in again, refreshing doesn't extend it.
+	sessionLifetime = 60 * 24 * time.Hour
+	maxDeviceLength = 100
+)
+
+// sessionInfo is a session as its user sees it in the list of sessions.
+type sessionInfo struct {
+	Id         int       `json:"id"`
+	Device     string    `json:"device"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// startSession logs the user in on a new device and returns the refresh
+// token for it.
+func startSession(userId int, device string) (string, database.Session, error) {
+	refreshToken, err := authorize.CreateRefreshToken()
+	if err != nil {
+		return "", database.Session{}, err
+	}
+
+	now := time.Now().UTC()
+	session, err := db.CreateSession(database.Session{
+		UserId:    userId,
+		TokenHash: authorize.HashToken(refreshToken),
+		Device:    device,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionLifetime),
+	})
+	if err != nil {
+		return "", database.Session{}, err
+	}
+	return refreshToken, session, nil
+}
+
+// deviceName is the name of the device logging in, the one it gave or else
+// its User-Agent, cut down to maxDeviceLength characters.
+func deviceName(given string, r *http.Request) string {
+	name := strings.TrimSpace(given)
+	if name == "" {
+		name = r.UserAgent()
+	}
+	if runes := []rune(name); len(runes) > maxDeviceLength {
+		name = string(runes[:maxDeviceLength])
+	}
+	return name
+}
+
+// getSessions lists the devices the user is logged in on, oldest first.
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- getSessions ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	sessions, err := db.GetSessions(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	now := time.Now().UTC()
+	result := []sessionInfo{}
+	for _, session := range sessions {
+		if session.Expired(now) {
+			continue
+		}
+		result = append(result, sessionInfo{
+			Id:         session.Id,
+			Device:     session.Device,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+		})
+	}
+
+	respondWithJson(w, 200, result)
+}
+
+// deleteSession logs the user out on one of their devices. Access tokens
+// already handed out to it keep working until they expire.
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteSession ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	sessionId, err := strconv.Atoi(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, 404, "session doesn't exist")
+		return
+	}
+
+	sessions, err := db.GetSessions(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !slices.ContainsFunc(sessions, func(session database.Session) bool { return session.Id == sessionId }) {
+		respondWithError(w, 404, "session doesn't exist")
+		return
+	}
+
+	err = db.RevokeSession(sessionId)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 404, "session doesn't exist")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
+
+// deleteSessions logs the user out on every device, this one included.
+func deleteSessions(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- deleteSessions ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	_, err = db.RevokeSessions(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 204, "")
+}
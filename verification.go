@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/djmarkymark007/chirpy/internal/authorize"
+	"github.com/djmarkymark007/chirpy/internal/database"
+	"github.com/djmarkymark007/chirpy/internal/mail"
+)
+
+// The actions an account can be kept from until its email is verified.
+const (
+	actionChirp  = "chirp"
+	actionFollow = "follow"
+	actionLike   = "like"
+	actionReport = "report"
+	actionMedia  = "media"
+)
+
+var unverifiedActions = []string{actionChirp, actionFollow, actionLike, actionReport, actionMedia}
+
+const verifyEmailMsg = `Confirm this is your email address for Chirpy by opening this link:
+
+%s
+
+The link expires at %s. If you didn't sign up for Chirpy or change your
+email to this one you can ignore this email.
+`
+
+// verifyEmailPage is where the link in a verification email goes, a page
+// that confirms the email with the token in the link.
+const verifyEmailPage = "/app/verify-email"
+
+const emailChangeMsg = `Someone asked to change the email of your Chirpy account to %s.
+It only changes once the new address is confirmed. If it wasn't you, reset
+your password and the change won't go through.
+`
+
+// loadUnverifiedPolicy reads the actions accounts can't take until their
+// email is verified from UNVERIFIED_RESTRICT, a comma separated list of
+// chirp, follow, like, report and media, or none. It is off unless set:
+// accounts from before emails were verified are stored as unverified, and
+// would lose those actions when the server is upgraded.
+func loadUnverifiedPolicy() []string {
+	actions := listFromEnv("UNVERIFIED_RESTRICT")
+	if len(actions) == 0 || len(actions) == 1 && actions[0] == "none" {
+		return nil
+	}
+	for _, action := range actions {
+		if !slices.Contains(unverifiedActions, action) {
+			log.Fatalf("UNVERIFIED_RESTRICT: unknown action %q, want some of %s or none", action, strings.Join(unverifiedActions, ", "))
+		}
+	}
+	return actions
+}
+
+// checkVerified responds with 403 and returns true when the user hasn't
+// verified their email and the policy keeps unverified accounts from action.
+func checkVerified(w http.ResponseWriter, userId int, action string) bool {
+	if !slices.Contains(config.unverifiedRestrict, action) {
+		return false
+	}
+	user, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return true
+	}
+	if found && !user.EmailVerified {
+		respondWithError(w, 403, "verify your email first")
+		return true
+	}
+	return false
+}
+
+// sendEmailVerification emails a link to confirm the address to email,
+// which is either the email of the user or their pending one. Like a
+// password reset it is sent in the background.
+func sendEmailVerification(userId int, email string) error {
+	token, err := authorize.CreateResetToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	verification, err := db.CreateEmailVerification(database.EmailVerification{
+		UserId:    userId,
+		Email:     email,
+		TokenHash: authorize.HashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(config.emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := config.publicUrl + verifyEmailPage + "?token=" + url.QueryEscape(token)
+	msg := mail.Message{
+		To:      email,
+		Subject: "Confirm your email for Chirpy",
+		Body:    fmt.Sprintf(verifyEmailMsg, link, verification.ExpiresAt.Format(time.RFC1123)),
+	}
+	go func() {
+		err := config.mailer.Send(msg)
+		if err != nil {
+			log.Printf("sending email verification %d: %s", verification.Id, err)
+		}
+	}()
+	return nil
+}
+
+// sendEmailChangeNotice tells the old address of the user that someone is
+// changing the email away from it.
+func sendEmailChangeNotice(user database.UserDatabase) {
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy email is being changed",
+		Body:    fmt.Sprintf(emailChangeMsg, user.PendingEmail),
+	}
+	go func() {
+		err := config.mailer.Send(msg)
+		if err != nil {
+			log.Printf("sending email change notice to user %d: %s", user.Id, err)
+		}
+	}()
+}
+
+// getVerifyEmailPage serves the page verification links open, which posts
+// the token to postVerifyEmail. Confirming from the page rather than on GET
+// keeps link scanners in mail clients from confirming for the user.
+func getVerifyEmailPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "verify-email.html")
+}
+
+// postVerifyEmail confirms an email with the token from a verification
+// email. It needs no login so the link can be opened anywhere.
+func postVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postVerifyEmail ---")
+
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding parameters: %s\n", err)
+		respondWithError(w, 400, "Invalid JSON data")
+		return
+	}
+
+	user, err := db.VerifyEmail(authorize.HashToken(params.Token), time.Now().UTC())
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, 400, "verification token is invalid or expired")
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		respondWithError(w, 409, "user email already used")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 200, user.Account())
+}
+
+// postResendVerification sends the logged in user a new verification email,
+// for their pending email when they are changing it and else for their email.
+func postResendVerification(w http.ResponseWriter, r *http.Request) {
+	log.Print("--- postResendVerification ---")
+
+	userId, err := authorize.GetIdFromJwt(getTokenFromHeader(r), config.jwtKeys)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 401, "Unauthorized")
+		return
+	}
+
+	user, found, err := db.GetUserById(userId)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+	if !found {
+		respondWithError(w, 404, "Not found")
+		return
+	}
+
+	email := user.PendingEmail
+	if email == "" {
+		if user.EmailVerified {
+			respondWithError(w, 409, "email is already verified")
+			return
+		}
+		email = user.Email
+	}
+	if !checkMailAllowed(w, r, email) {
+		return
+	}
+
+	err = sendEmailVerification(user.Id, email)
+	if err != nil {
+		log.Print(err)
+		respondWithError(w, 500, InternalErrorMsg)
+		return
+	}
+
+	respondWithJson(w, 202, struct{}{})
+}